@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// unauthenticatedPaths stay reachable without the API token, for liveness and readiness probes
+var unauthenticatedPaths = map[string]bool{"/healthz": true, "/health": true}
+
+// sensitivePathPrefix is where stored response bodies are served, which may hold sensitive text and so always
+// need the token, even with api_open_reads
+const sensitivePathPrefix = "/servers/"
+
+// requireToken wraps the REST API so requests must carry "Authorization: Bearer <token>", answering 401 otherwise.
+// With openReads, GET and HEAD requests are let through and only management actions such as DELETE, and reads of
+// stored responses, need the token.
+func requireToken(next http.Handler, token string, openReads bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		openRead := openReads && (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, sensitivePathPrefix)
+		if unauthenticatedPaths[r.URL.Path] || openRead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="llm-watcher"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowCORS lets browser dashboards served from origins call the REST API, "*" allowing any origin.
+// Preflight OPTIONS requests are answered here, before the token check, as browsers send them without credentials.
+func allowCORS(next http.Handler, origins []string) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && (allowed["*"] || allowed[origin]) {
+			if allowed["*"] {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
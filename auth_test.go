@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		token     string
+		openReads bool
+		want      int
+	}{
+		{"no token", http.MethodGet, "/crashes", "", false, http.StatusUnauthorized},
+		{"wrong token", http.MethodGet, "/crashes", "nope", false, http.StatusUnauthorized},
+		{"token", http.MethodGet, "/crashes", "secret", false, http.StatusOK},
+		{"liveness probe", http.MethodGet, "/healthz", "", false, http.StatusOK},
+		{"open read", http.MethodGet, "/crashes", "", true, http.StatusOK},
+		{"open reads, delete", http.MethodDelete, "/crashes", "", true, http.StatusUnauthorized},
+		{"open reads, last response", http.MethodGet, "/servers/http:%2F%2Fa%2Fapi%2Fchat/lastresponse", "", true, http.StatusUnauthorized},
+		{"open reads, last response with token", http.MethodGet, "/servers/http:%2F%2Fa%2Fapi%2Fchat/lastresponse", "secret", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			requireToken(ok, "secret", tt.openReads).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+}
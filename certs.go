@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/x509"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// CertExpiryEvent is published when a server's certificate comes within cert_expiry_warning of expiring
+type CertExpiryEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	URL       string    `json:"url"`
+	Subject   string    `json:"subject"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+}
+
+// recordCertificate stores the expiry of the certificate a server presented and warns once per certificate
+// when it expires within threshold
+func (s *stateStore) recordCertificate(server Server, cert *x509.Certificate, threshold time.Duration) {
+	subject := cert.Subject.CommonName
+	if subject == "" && len(cert.DNSNames) > 0 {
+		subject = cert.DNSNames[0]
+	}
+	warn := false
+	s.update(server, func(state *serverState) {
+		state.CertSubject = subject
+		state.CertNotAfter = cert.NotAfter
+		if threshold > 0 && time.Until(cert.NotAfter) < threshold && !state.CertWarnedFor.Equal(cert.NotAfter) {
+			state.CertWarnedFor = cert.NotAfter
+			warn = true
+		}
+	})
+	if !warn {
+		return
+	}
+
+	daysLeft := int(time.Until(cert.NotAfter).Hours() / 24)
+	slog.Warn("Certificate expiring", "url", server.URL, "subject", subject, "not_after", cert.NotAfter, "days_left", daysLeft)
+	publisher.Publish("cert_expiring", CertExpiryEvent{
+		Timestamp: time.Now(),
+		URL:       server.URL,
+		Subject:   subject,
+		NotAfter:  cert.NotAfter,
+		DaysLeft:  daysLeft,
+	})
+}
+
+// CertStatus is an entry in the /certs response
+type CertStatus struct {
+	URL      string    `json:"url"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+	Expiring bool      `json:"expiring"` // within cert_expiry_warning
+}
+
+// certStatuses returns the certificate of every HTTPS server checked so far, soonest expiring first
+func certStatuses(threshold time.Duration) []CertStatus {
+	seen := make(map[string]bool)
+	statuses := []CertStatus{}
+	for _, state := range serverStates.all() {
+		// Servers probed for several models share a URL and certificate
+		if state.CertNotAfter.IsZero() || seen[state.URL] {
+			continue
+		}
+		seen[state.URL] = true
+		left := time.Until(state.CertNotAfter)
+		statuses = append(statuses, CertStatus{
+			URL:      state.URL,
+			Subject:  state.CertSubject,
+			NotAfter: state.CertNotAfter,
+			DaysLeft: int(left.Hours() / 24),
+			Expiring: threshold > 0 && left < threshold,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].NotAfter.Before(statuses[j].NotAfter)
+	})
+	return statuses
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestRecordCertificateWarnsOncePerCertificate(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	cert := func(subject string, dnsNames []string, left time.Duration) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: subject}, DNSNames: dnsNames, NotAfter: time.Now().Add(left).Truncate(time.Second)}
+	}
+	expiring := cert("llm.internal", nil, 3*24*time.Hour)
+	renewed := cert("", []string{"llm.internal"}, 90*24*time.Hour)
+	replaced := cert("llm.internal", nil, 5*24*time.Hour)
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		wantWarn bool
+	}{
+		{"expiring", expiring, true},
+		{"same certificate again", expiring, false},
+		{"renewed", renewed, false},
+		{"replaced by another expiring one", replaced, true},
+		{"that one again", replaced, false},
+	}
+	server := Server{URL: "https://llm.internal/api/chat", Model: "llama3"}
+	store := newStateStore()
+	for _, tt := range tests {
+		logs.Reset()
+		store.recordCertificate(server, tt.cert, 14*24*time.Hour)
+		if warned := strings.Contains(logs.String(), "Certificate expiring"); warned != tt.wantWarn {
+			t.Errorf("%s: logged %q, want a warning %v", tt.name, logs.String(), tt.wantWarn)
+		}
+		state := store.get(server)
+		if !state.CertNotAfter.Equal(tt.cert.NotAfter) || state.CertSubject != "llm.internal" {
+			t.Errorf("%s: stored %s expiring %v, want llm.internal expiring %v", tt.name, state.CertSubject, state.CertNotAfter, tt.cert.NotAfter)
+		}
+	}
+
+	logs.Reset()
+	store.recordCertificate(Server{URL: "https://other.internal/api/chat"}, expiring, 0)
+	if logs.Len() != 0 {
+		t.Errorf("warned without cert_expiry_warning: %s", logs.String())
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Duration is a time.Duration read from YAML as either a Go duration string
+// ("1500ms", "2m") or a plain number of seconds, as older configs use
+type Duration time.Duration
+
+// secondsDuration converts a number of seconds to a Duration, rejecting NaN, infinities and values out of range
+func secondsDuration(seconds float64) (Duration, error) {
+	nanos := seconds * float64(time.Second)
+	if math.IsNaN(nanos) || nanos >= math.MaxInt64 || nanos <= math.MinInt64 {
+		return 0, fmt.Errorf("invalid duration %v seconds", seconds)
+	}
+	return Duration(nanos), nil
+}
+
+// parseDuration parses s the way Duration is read from YAML, as seconds or a Go duration string
+func parseDuration(s string) (Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return secondsDuration(seconds)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return Duration(parsed), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var seconds float64
+	if err := unmarshal(&seconds); err == nil {
+		parsed, err := secondsDuration(seconds)
+		if err != nil {
+			return err
+		}
+		*d = parsed
+		return nil
+	}
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// RestartLimit is a limit on concurrent restarts read from YAML as either a count (2) or a percentage of the
+// servers it applies to ("50%")
+type RestartLimit struct {
+	Count    int
+	Fraction float64 // 0-1, set instead of Count for a percentage
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (l *RestartLimit) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var count int
+	if err := unmarshal(&count); err == nil {
+		*l = RestartLimit{Count: count}
+		return nil
+	}
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(s, "%") {
+		return fmt.Errorf("restart limit %q must be a count or a percentage such as \"50%%\"", s)
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid restart limit %q: %v", s, err)
+	}
+	// 0% would read as unlimited, the opposite of what it says; use 0 for no limit
+	if !(percent > 0 && percent <= 100) {
+		return fmt.Errorf("restart limit %q must be a percentage above 0%% and at most 100%%", s)
+	}
+	*l = RestartLimit{Fraction: percent / 100}
+	return nil
+}
+
+// limit returns the number of concurrent restarts allowed among size servers, 0 for unlimited.
+// A percentage is rounded down but allows at least one restart, so small groups still recover.
+func (l RestartLimit) limit(size int) int {
+	if l.Fraction == 0 {
+		return l.Count
+	}
+	n := int(l.Fraction * float64(size))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// applyProfile merges the named entry of the config's profiles map over the rest of the config and
+// returns the result as YAML. Maps are merged key by key, any other value in the profile replaces
+// the base value, so a profile's servers list replaces the base list as a whole.
+func applyProfile(data []byte, profile string) ([]byte, error) {
+	var base map[interface{}]interface{}
+	if err := yaml.Unmarshal(data, &base); err != nil {
+		return nil, err
+	}
+	profiles, _ := base["profiles"].(map[interface{}]interface{})
+	delete(base, "profiles")
+
+	override, ok := profiles[profile].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("profile %q is not defined in profiles", profile)
+	}
+	return yaml.Marshal(mergeYAML(base, override))
+}
+
+// mergeYAML returns base with override merged over it, recursing into maps present in both
+func mergeYAML(base, override map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := make(map[interface{}]interface{}, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		baseMap, baseIsMap := merged[key].(map[interface{}]interface{})
+		overrideMap, overrideIsMap := value.(map[interface{}]interface{})
+		if baseIsMap && overrideIsMap {
+			merged[key] = mergeYAML(baseMap, overrideMap)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// validateConfig checks a parsed config and returns every problem found, with server indices.
+// It also fills in defaults and compiles crash rule patterns and each server's success_expr.
+func validateConfig(config *Config) error {
+	var errs []error
+	if config.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative"))
+	}
+	if config.RetryDelay == 0 {
+		config.RetryDelay = Duration(time.Second)
+	}
+	if config.Retries < 0 || config.RetryDelay < 0 {
+		errs = append(errs, fmt.Errorf("retries and retry_delay must not be negative"))
+	}
+	if config.NotifyDedupWindow == 0 {
+		config.NotifyDedupWindow = Duration(10 * time.Minute)
+	}
+	if config.NotifyDedupWindow < 0 {
+		errs = append(errs, fmt.Errorf("notify_dedup_window must not be negative"))
+	}
+	if config.RetryJitter < 0 || config.RetryJitter > 1 {
+		errs = append(errs, fmt.Errorf("retry_jitter must be between 0 and 1"))
+	}
+	if config.Interval == 0 {
+		config.Interval = Duration(defaultInterval)
+	}
+	if config.Interval < 0 {
+		errs = append(errs, fmt.Errorf("interval must not be negative"))
+	}
+	score := &config.HealthScore
+	if score.Window == 0 {
+		score.Window = 20
+	}
+	if score.ErrorWeight == 0 && score.LatencyWeight == 0 && score.StreakWeight == 0 {
+		score.ErrorWeight, score.LatencyWeight, score.StreakWeight = 2, 1, 1
+	}
+	if score.SlowLatency == 0 {
+		score.SlowLatency = Duration(10 * time.Second)
+	}
+	if score.Window < 0 || score.ErrorWeight < 0 || score.LatencyWeight < 0 || score.StreakWeight < 0 || score.SlowLatency < 0 {
+		errs = append(errs, fmt.Errorf("health_score: window, weights and slow_latency must not be negative"))
+	}
+	if config.LatencyTrend.MinSamples == 0 {
+		config.LatencyTrend.MinSamples = 5
+	}
+	if config.LatencyTrend.MaxSlope < 0 || config.LatencyTrend.MinSamples < 2 {
+		errs = append(errs, fmt.Errorf("latency_trend: max_slope must not be negative and min_samples must be at least 2"))
+	}
+	if config.APIReadTimeout == 0 {
+		config.APIReadTimeout = Duration(10 * time.Second)
+	}
+	if config.APIWriteTimeout == 0 {
+		config.APIWriteTimeout = Duration(30 * time.Second)
+	}
+	if config.APIReadTimeout < 0 || config.APIWriteTimeout < 0 {
+		errs = append(errs, fmt.Errorf("api_read_timeout and api_write_timeout must not be negative"))
+	}
+	if config.LastResponseLimit == 0 {
+		config.LastResponseLimit = 4096
+	}
+	if config.LastResponseLimit < 0 {
+		errs = append(errs, fmt.Errorf("last_response_limit must not be negative"))
+	}
+	if config.SlackWebhookURL != "" {
+		if u, err := url.Parse(config.SlackWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("slack_webhook_url must be an http(s) URL"))
+		}
+	}
+	for i := range config.Webhooks {
+		webhook := &config.Webhooks[i]
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webhooks[%d]: url must be an http(s) URL", i))
+		}
+		if err := compileWebhook(webhook); err != nil {
+			errs = append(errs, fmt.Errorf("webhooks[%d]: invalid template: %v", i, err))
+		}
+	}
+	if config.RetentionDays < 0 || config.RetentionDays > math.MaxInt32/86400 {
+		errs = append(errs, fmt.Errorf("retention_days must be between 0 and %d", math.MaxInt32/86400))
+	}
+	if config.MongoConnectAttempts == 0 {
+		config.MongoConnectAttempts = 10
+	}
+	if config.MongoConnectDelay == 0 {
+		config.MongoConnectDelay = Duration(3 * time.Second)
+	}
+	if config.MongoConnectAttempts < 1 || config.MongoConnectDelay < 0 {
+		errs = append(errs, fmt.Errorf("mongo_connect_attempts must be at least 1 and mongo_connect_delay not negative"))
+	}
+	if config.MongoPassword != "" && config.MongoUsername == "" {
+		errs = append(errs, fmt.Errorf("mongo_password requires mongo_username"))
+	}
+	if config.MongoUnavailableGrace == 0 {
+		config.MongoUnavailableGrace = Duration(time.Minute)
+	}
+	if config.MongoUnavailableGrace < 0 {
+		errs = append(errs, fmt.Errorf("mongo_unavailable_grace must not be negative"))
+	}
+	if config.CertExpiryWarning == 0 {
+		config.CertExpiryWarning = Duration(14 * 24 * time.Hour)
+	}
+	if config.CertExpiryWarning < 0 {
+		errs = append(errs, fmt.Errorf("cert_expiry_warning must not be negative"))
+	}
+	if config.Publisher.Subject == "" {
+		config.Publisher.Subject = "llm_watcher"
+	}
+	if config.Digest.Period == 0 {
+		config.Digest.Period = Duration(24 * time.Hour)
+	}
+	if config.Digest.Period < 0 {
+		errs = append(errs, fmt.Errorf("digest: period must not be negative"))
+	}
+	if config.Digest.Schedule != "" {
+		if _, err := cron.ParseStandard(config.Digest.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("digest: invalid schedule: %v", err))
+		}
+	}
+	for _, recipient := range config.Digest.Recipients {
+		if recipient == "slack" || recipient == "webhooks" {
+			continue
+		}
+		if u, err := url.Parse(recipient); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("digest: recipient %q is neither slack, webhooks nor an http(s) URL", recipient))
+		}
+	}
+	if err := compileQuietHours(&config.QuietHours); err != nil {
+		errs = append(errs, fmt.Errorf("quiet_hours: %v", err))
+	}
+	if config.Shard.Count == 0 {
+		config.Shard.Count = 1
+	}
+	if config.Shard.Count < 1 || config.Shard.Index < 0 || config.Shard.Index >= config.Shard.Count {
+		errs = append(errs, fmt.Errorf("shard: count must be at least 1 and index between 0 and count-1"))
+	}
+	if err := validateLogging(config.LogLevel, config.LogFormat); err != nil {
+		errs = append(errs, err)
+	}
+	if config.CanaryPolicy != "" && config.CanaryPolicy != "continue" && config.CanaryPolicy != "skip" {
+		errs = append(errs, fmt.Errorf("canary_policy must be \"continue\" or \"skip\""))
+	}
+	if config.Restarter != "" && config.Restarter != "api" && config.Restarter != "cli" {
+		errs = append(errs, fmt.Errorf("restarter must be \"api\" or \"cli\""))
+	}
+	if limit := config.GroupRestartLimit; limit.Count < 0 || limit.Fraction < 0 || limit.Fraction > 1 {
+		errs = append(errs, fmt.Errorf("group_restart_limit must not be negative or above 100%%"))
+	}
+	if config.MaxConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("max_concurrency must not be negative"))
+	}
+	if config.TickDeadline < 0 {
+		errs = append(errs, fmt.Errorf("tick_deadline must not be negative"))
+	}
+	if config.MaxRequestsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("max_requests_per_host must not be negative"))
+	}
+	if config.MaxRestartsPerHour < 0 {
+		errs = append(errs, fmt.Errorf("max_restarts_per_hour must not be negative"))
+	}
+	if config.MaxConcurrentRestarts < 0 {
+		errs = append(errs, fmt.Errorf("max_concurrent_restarts must not be negative"))
+	}
+
+	for i := range config.CrashRules {
+		rule := &config.CrashRules[i]
+		if rule.Type == "" {
+			errs = append(errs, fmt.Errorf("crash rule %d: type is required", i))
+		}
+		if _, ok := severities[rule.Severity]; rule.Severity != "" && !ok {
+			errs = append(errs, fmt.Errorf("crash rule %d: severity must be \"info\", \"warning\" or \"critical\"", i))
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("crash rule %d: invalid pattern: %v", i, err))
+			continue
+		}
+		rule.pattern = pattern
+	}
+
+	// state, restart limits and alerts are keyed by url and model, so two servers sharing both would be mixed up
+	seen := make(map[string]int, len(config.Servers))
+	for i := range config.Servers {
+		server := &config.Servers[i]
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("server %d (%s): %s", i, server.URL, fmt.Sprintf(format, args...)))
+		}
+		if first, ok := seen[serverKey(*server)]; ok {
+			fail("same url and model as server %d", first)
+		} else {
+			seen[serverKey(*server)] = i
+		}
+
+		if server.URL == "" {
+			fail("url is required")
+		} else if err := validateURL(server.URL); err != nil {
+			fail("%v", err)
+		}
+		for _, endpoint := range server.Endpoints {
+			if err := validateURL(endpoint); err != nil {
+				fail("endpoints: %v", err)
+			}
+		}
+		if len(server.Endpoints) > 0 && server.CheckMode == "loaded" {
+			fail("endpoints cannot be combined with check_mode \"loaded\"")
+		}
+		switch server.CheckMode {
+		case "", "model":
+			if server.Model == "" {
+				fail("model is required")
+			}
+		case "loaded", "httpget":
+			if server.CheckModelListed {
+				fail("check_model_listed requires check_mode \"model\"")
+			}
+		default:
+			fail("unknown check_mode %q", server.CheckMode)
+		}
+		switch server.RestartMode {
+		case "":
+			server.RestartMode = "docker"
+		case "docker", "none":
+		case "k8s":
+			if server.Namespace == "" {
+				server.Namespace = "default"
+			}
+			if (server.Deployment == "") == (server.PodSelector == "") {
+				fail("restart_mode \"k8s\" requires exactly one of deployment and pod_selector")
+			}
+			if server.PullMissingModel {
+				fail("pull_missing_model requires restart_mode \"docker\"")
+			}
+		case "systemd":
+			if !systemdUnitPattern.MatchString(server.ServiceName) {
+				fail("restart_mode \"systemd\" requires a service_name made of letters, digits and :_.@-")
+			}
+			if server.PullMissingModel {
+				fail("pull_missing_model requires restart_mode \"docker\"")
+			}
+		default:
+			fail("restart_mode must be \"docker\", \"k8s\", \"systemd\" or \"none\"")
+		}
+		if server.Host != "" {
+			if server.RestartMode != "docker" && server.RestartMode != "systemd" {
+				fail("host requires restart_mode \"docker\" or \"systemd\"")
+			}
+			if server.DockerHost != "" || server.DockerContext != "" {
+				fail("host cannot be combined with docker_host or docker_context")
+			}
+			if server.PullMissingModel {
+				fail("pull_missing_model cannot be combined with host")
+			}
+			if user, _ := sshTarget(*server); user == "" {
+				fail("host requires a user, as user@host or ssh_user")
+			}
+		}
+		if config.RequireContainerName && server.RestartMode == "docker" && server.ContainerName == "" {
+			fail("container_name is required (require_container_name is set)")
+		}
+		if server.DockerHost != "" && server.DockerContext != "" {
+			fail("docker_host and docker_context are mutually exclusive")
+		}
+		switch server.API {
+		case "", "ollama":
+		case "openai":
+			// Loaded models, pulls and model metadata use Ollama's own API
+			if server.CheckMode == "loaded" || server.PullMissingModel || server.TagModelMetadata || server.OllamaAPIVersion != "" {
+				fail("api \"openai\" cannot be combined with check_mode \"loaded\", pull_missing_model, tag_model_metadata or ollama_api_version")
+			}
+		default:
+			fail("api must be \"ollama\" or \"openai\"")
+		}
+		if server.OllamaAPIVersion != "" && server.OllamaAPIVersion != "current" && server.OllamaAPIVersion != "legacy" {
+			fail("ollama_api_version must be \"current\" or \"legacy\"")
+		}
+		if server.NoLoadedModels != "" && server.NoLoadedModels != "healthy" && server.NoLoadedModels != "crash" {
+			fail("no_loaded_models must be \"healthy\" or \"crash\"")
+		}
+		if server.MetricsURL != "" {
+			if err := validateURL(server.MetricsURL); err != nil {
+				fail("metrics_url: %v", err)
+			}
+		}
+		for host, ip := range server.DNSOverrides {
+			if net.ParseIP(ip) == nil {
+				fail("dns_overrides: %q for host %s is not an IP address", ip, host)
+			}
+		}
+		for _, code := range server.HealthyStatusCodes {
+			if code < 100 || code > 599 {
+				fail("healthy_status_codes: %d is not an HTTP status code", code)
+			}
+		}
+		if server.RecoveryQuorum < 0 {
+			fail("recovery_quorum must not be negative")
+		}
+		if server.StatusFailureThreshold < 0 {
+			fail("status_failure_threshold must not be negative")
+		}
+		if server.PromptPadding < 0 || server.PromptPadding > maxPromptPadding {
+			fail("prompt_padding must be between 0 and %d", maxPromptPadding)
+		}
+		if server.WarmConnections < 0 {
+			fail("warm_connections must not be negative")
+		}
+		if server.WarmConnections > 0 && server.DisableKeepAlive {
+			fail("warm_connections requires keep-alive, it cannot be combined with disable_keep_alive")
+		}
+		if server.RestartCooldown < 0 {
+			fail("restart_cooldown must not be negative")
+		}
+		if server.PullTimeout < 0 || server.RestartTimeout < 0 {
+			fail("pull_timeout and restart_timeout must not be negative")
+		}
+		if server.PostRestartDelay < 0 || server.RecoveryGrace < 0 {
+			fail("post_restart_delay and recovery_grace must not be negative")
+		}
+		if server.Timeout < 0 {
+			fail("timeout must not be negative")
+		}
+		if server.LatencySLA < 0 {
+			fail("latency_sla must not be negative")
+		}
+		if server.Interval < 0 {
+			fail("interval must not be negative")
+		}
+		if server.Schedule != "" {
+			if _, err := cron.ParseStandard(server.Schedule); err != nil {
+				fail("invalid schedule: %v", err)
+			}
+		}
+		if err := compileSuccessExpr(server); err != nil {
+			fail("invalid success_expr: %v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateURL checks that rawURL is an absolute http(s) URL
+func validateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url %s: scheme must be http or https", rawURL)
+	}
+	return nil
+}
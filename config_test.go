@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := func(modify func(*Server)) []Server {
+		server := Server{URL: "http://gpu-1:11434/api/chat", Model: "llama3", ContainerName: "ollama"}
+		if modify != nil {
+			modify(&server)
+		}
+		return []Server{server}
+	}
+
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string // substring of the error, "" for none
+	}{
+		{"minimal", Config{Servers: valid(nil)}, ""},
+		{"missing url", Config{Servers: valid(func(s *Server) { s.URL = "" })}, "url is required"},
+		{"missing model", Config{Servers: valid(func(s *Server) { s.Model = "" })}, "model is required"},
+		{"loaded without model", Config{Servers: valid(func(s *Server) { s.Model, s.CheckMode = "", "loaded" })}, ""},
+		{"unknown check mode", Config{Servers: valid(func(s *Server) { s.CheckMode = "ping" })}, "unknown check_mode"},
+		{
+			"duplicate server",
+			Config{Servers: append(valid(nil), valid(func(s *Server) { s.ContainerName = "ollama-2" })...)},
+			"server 1 (http://gpu-1:11434/api/chat): same url and model as server 0",
+		},
+		{"same url, other model", Config{Servers: append(valid(nil), valid(func(s *Server) { s.Model = "mistral" })...)}, ""},
+		{"k8s deployment", Config{Servers: valid(func(s *Server) { s.RestartMode, s.Deployment = "k8s", "ollama" })}, ""},
+		{
+			"k8s deployment and pod selector",
+			Config{Servers: valid(func(s *Server) { s.RestartMode, s.Deployment, s.PodSelector = "k8s", "ollama", "app=ollama" })},
+			"exactly one of deployment and pod_selector",
+		},
+		{"systemd unit", Config{Servers: valid(func(s *Server) { s.RestartMode, s.ServiceName = "systemd", "ollama.service" })}, ""},
+		{"systemd bad unit", Config{Servers: valid(func(s *Server) { s.RestartMode, s.ServiceName = "systemd", "ollama; reboot" })}, "service_name"},
+		{"ssh host with user", Config{Servers: valid(func(s *Server) { s.Host = "ops@gpu-1" })}, ""},
+		{"ssh host without user", Config{Servers: valid(func(s *Server) { s.Host = "gpu-1" })}, "host requires a user"},
+		{"ssh host with k8s", Config{Servers: valid(func(s *Server) { s.Host, s.RestartMode, s.Deployment = "ops@gpu-1", "k8s", "ollama" })}, "host requires restart_mode"},
+		{"openai loaded", Config{Servers: valid(func(s *Server) { s.API, s.CheckMode = "openai", "loaded" })}, "api \"openai\" cannot be combined"},
+		{"crash rule", Config{CrashRules: []CrashRule{{Pattern: "CUDA out of memory", Type: "oom"}}, Servers: valid(nil)}, ""},
+		{"crash rule without type", Config{CrashRules: []CrashRule{{Pattern: "CUDA"}}}, "type is required"},
+		{"crash rule bad pattern", Config{CrashRules: []CrashRule{{Pattern: "(", Type: "oom"}}}, "invalid pattern"},
+		{"negative retries", Config{Retries: -1}, "retries and retry_delay must not be negative"},
+		{"restarter", Config{Restarter: "ssh"}, "restarter must be"},
+		{"no container name", Config{Servers: valid(func(s *Server) { s.ContainerName = "" })}, ""},
+		{
+			"container name required",
+			Config{RequireContainerName: true, Servers: valid(func(s *Server) { s.ContainerName = "" })},
+			"container_name is required",
+		},
+		{"container name required and set", Config{RequireContainerName: true, Servers: valid(nil)}, ""},
+		{
+			"container name required, k8s",
+			Config{RequireContainerName: true, Servers: valid(func(s *Server) { s.ContainerName, s.RestartMode, s.Deployment = "", "k8s", "ollama" })},
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&tt.config)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("validateConfig() error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("validateConfig() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigDefaults(t *testing.T) {
+	config := Config{Servers: []Server{{URL: "http://gpu-1:11434/api/chat", Model: "llama3", RestartMode: "k8s", Deployment: "ollama"}}}
+	if err := validateConfig(&config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Interval != Duration(defaultInterval) || config.NotifyDedupWindow == 0 || config.Shard.Count != 1 {
+		t.Errorf("config defaults not set: interval %v, notify_dedup_window %v, shard count %d",
+			config.Interval, config.NotifyDedupWindow, config.Shard.Count)
+	}
+	if server := config.Servers[0]; server.Namespace != "default" {
+		t.Errorf("namespace = %q, want default", server.Namespace)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30", 30 * time.Second, false},
+		{"1.5", 1500 * time.Millisecond, false},
+		{"0", 0, false},
+		{"90s", 90 * time.Second, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"250ms", 250 * time.Millisecond, false},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+		{"-Inf", 0, true},
+		{"1e20", 0, true},
+		{"soon", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.in)
+		if (err != nil) != tt.wantErr || time.Duration(got) != tt.want {
+			t.Errorf("parseDuration(%q) = %v, %v, want %v, error %v", tt.in, time.Duration(got), err, tt.want, tt.wantErr)
+		}
+	}
+
+	yamlTests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"timeout: 30", 30 * time.Second, false},
+		{"timeout: 0.5", 500 * time.Millisecond, false},
+		{"timeout: 2m", 2 * time.Minute, false},
+		{"timeout: .nan", 0, true},
+		{"timeout: .inf", 0, true},
+		{"timeout: -.inf", 0, true},
+		{"timeout: 1e20", 0, true},
+		{"timeout: soon", 0, true},
+	}
+	for _, tt := range yamlTests {
+		var out struct {
+			Timeout Duration `yaml:"timeout"`
+		}
+		err := yaml.Unmarshal([]byte(tt.in), &out)
+		if (err != nil) != tt.wantErr || time.Duration(out.Timeout) != tt.want {
+			t.Errorf("unmarshal %q = %v, %v, want %v, error %v", tt.in, time.Duration(out.Timeout), err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	data := []byte(`
+timeout: 30
+retries: 2
+shard:
+  index: 0
+  count: 2
+servers:
+  - url: http://gpu-1:11434/api/chat
+    model: llama3
+profiles:
+  staging:
+    timeout: 5
+    shard:
+      index: 1
+    servers:
+      - url: http://staging:11434/api/chat
+        model: phi3
+`)
+	merged, err := applyProfile(data, "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config Config
+	if err := yaml.Unmarshal(merged, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Timeout != Duration(5*time.Second) || config.Retries != 2 {
+		t.Errorf("timeout %v, retries %d, want the profile's 5s and the base's 2", time.Duration(config.Timeout), config.Retries)
+	}
+	if config.Shard != (ShardConfig{Index: 1, Count: 2}) {
+		t.Errorf("shard = %+v, want index from the profile and count from the base", config.Shard)
+	}
+	if len(config.Servers) != 1 || config.Servers[0].Model != "phi3" {
+		t.Errorf("servers = %+v, want the profile's list only", config.Servers)
+	}
+	if strings.Contains(string(merged), "profiles") {
+		t.Errorf("merged config still has profiles:\n%s", merged)
+	}
+
+	if _, err := applyProfile(data, "production"); err == nil || !strings.Contains(err.Error(), `profile "production" is not defined`) {
+		t.Errorf("undefined profile error = %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// successEnv holds the response fields available to a server's success_expr
+type successEnv struct {
+	Status    int    `expr:"status"`     // HTTP status code
+	LatencyMs int64  `expr:"latency_ms"` // time until the full response was read
+	Content   string `expr:"content"`    // concatenated message content, or generated text for legacy servers
+	Body      string `expr:"body"`       // raw response body
+}
+
+// chatResponse is the part of an Ollama /api/chat or legacy /api/generate response, or of an OpenAI-compatible
+// /v1/chat/completions response, the watcher inspects
+type chatResponse struct {
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Response string `json:"response"` // /api/generate
+	Choices  []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"` // /v1/chat/completions
+}
+
+// content returns the chunk's message content, whichever shape it has
+func (c chatResponse) content() string {
+	if len(c.Choices) > 0 {
+		return c.Choices[0].Message.Content
+	}
+	return c.Message.Content + c.Response
+}
+
+// compileSuccessExpr compiles the server's success_expr, if any, into a boolean program
+func compileSuccessExpr(server *Server) error {
+	if server.SuccessExpr == "" {
+		return nil
+	}
+	program, err := expr.Compile(server.SuccessExpr, expr.Env(successEnv{}), expr.AsBool())
+	if err != nil {
+		return err
+	}
+	server.successProgram = program
+	return nil
+}
+
+// evaluateSuccess runs a compiled success_expr against a response and reports whether it is healthy
+func evaluateSuccess(program *vm.Program, status int, latency time.Duration, body []byte) (bool, error) {
+	env := successEnv{
+		Status:    status,
+		LatencyMs: latency.Milliseconds(),
+		Content:   chatContent(body),
+		Body:      string(body),
+	}
+	out, err := expr.Run(program, env)
+	if err != nil {
+		return false, err
+	}
+	return out.(bool), nil
+}
+
+// chatContent concatenates the message content of a chat or generate response, streamed or not
+func chatContent(body []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var content strings.Builder
+	for {
+		var chunk chatResponse
+		if err := dec.Decode(&chunk); err != nil {
+			break
+		}
+		content.WriteString(chunk.content())
+	}
+	return content.String()
+}
+
+// validateChatResponse checks that a body is a chat response in the shape of the server's api with non-empty
+// content, and returns the content. Ollama responses may be streamed, OpenAI-compatible ones must carry choices.
+func validateChatResponse(body []byte, api string) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	var content strings.Builder
+	chunks := 0
+	for {
+		var chunk chatResponse
+		err := dec.Decode(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("response is not valid JSON: %v", err)
+		}
+		if api == "openai" && len(chunk.Choices) == 0 {
+			return "", errors.New("response has no choices")
+		}
+		chunks++
+		content.WriteString(chunk.content())
+	}
+	if chunks == 0 {
+		return "", errors.New("response is empty")
+	}
+	if strings.TrimSpace(content.String()) == "" {
+		return "", errors.New("response has no message content")
+	}
+	return content.String(), nil
+}
+
+// matchCrashRule returns the first rule whose pattern matches detail, or nil if none does
+func matchCrashRule(rules []CrashRule, detail string) *CrashRule {
+	for i := range rules {
+		if rules[i].pattern != nil && rules[i].pattern.MatchString(detail) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestMatchCrashRule(t *testing.T) {
+	rules := []CrashRule{
+		{Pattern: "out of memory", Type: "oom", pattern: regexp.MustCompile("out of memory")},
+		{Pattern: "CUDA", Type: "cuda", pattern: regexp.MustCompile("CUDA")},
+		{Pattern: "(", Type: "uncompiled"},
+	}
+	tests := []struct {
+		detail string
+		want   string // type of the matched rule, "" for none
+	}{
+		{"CUDA error: out of memory", "oom"},
+		{"CUDA error: device-side assert", "cuda"},
+		{"connection refused", ""},
+		{"(", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule := matchCrashRule(rules, tt.detail); rule != nil {
+			got = rule.Type
+		}
+		if got != tt.want {
+			t.Errorf("matchCrashRule(%q) = %q, want %q", tt.detail, got, tt.want)
+		}
+	}
+}
+
+func TestSuccessExpr(t *testing.T) {
+	body := []byte(`{"message":{"content":"ok"},"done":true}`)
+	tests := []struct {
+		name           string
+		expr           string
+		wantCompileErr bool // compiling fails
+		want           bool
+		wantErr        bool // evaluating fails
+	}{
+		{name: "passing", expr: `status == 200 && content == "ok" && latency_ms < 1000`, want: true},
+		{name: "failing", expr: `latency_ms < 100`},
+		{name: "body", expr: `body contains "\"done\":true"`, want: true},
+		{name: "not a bool", expr: `status + 1`, wantCompileErr: true},
+		{name: "unknown field", expr: `tokens > 0`, wantCompileErr: true},
+		{name: "syntax error", expr: `status ==`, wantCompileErr: true},
+		{name: "runtime error", expr: `int(content) > 0`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := Server{SuccessExpr: tt.expr}
+			err := compileSuccessExpr(&server)
+			if (err != nil) != tt.wantCompileErr {
+				t.Fatalf("compileSuccessExpr(%q) error = %v, want error %v", tt.expr, err, tt.wantCompileErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := evaluateSuccess(server.successProgram, 200, 500*time.Millisecond, body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("evaluateSuccess() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("evaluateSuccess() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/exp/slog"
+)
+
+// digestTopServers is how many of the most crash-prone servers a digest lists
+const digestTopServers = 5
+
+// Digest summarises the crashes and restarts of a period
+type Digest struct {
+	From            time.Time      `json:"from"`
+	To              time.Time      `json:"to"`
+	Crashes         int            `json:"crashes"`
+	CrashesByType   map[string]int `json:"crashes_by_type"`
+	FlakiestServers []DigestServer `json:"flakiest_servers"` // most crashes first
+	Restarts        int            `json:"restarts"`
+	FailedRestarts  int            `json:"failed_restarts"`
+	RestartSuccess  *float64       `json:"restart_success_rate"` // 0-1, null without restarts
+	Servers         []DigestServer `json:"servers"`              // every server that crashed or has been checked, most crashes first
+}
+
+// DigestServer is a server's line in a digest
+type DigestServer struct {
+	URL           string   `json:"url"`
+	Model         string   `json:"model"`
+	Crashes       int      `json:"crashes"`
+	PassRate      *float64 `json:"pass_rate,omitempty"`      // 0-1 over the checks in the period still held in memory, null without any
+	UptimePercent *float64 `json:"uptime_percent,omitempty"` // 0-100 over the period from the stored events, see buildUptime
+}
+
+// buildDigest compiles the digest of the period ending now from the stored events and the in-memory check history
+func buildDigest(period time.Duration, servers []Server, crashCollection, restartCollection, healthCollection *mongo.Collection) (Digest, error) {
+	to := time.Now()
+	from := to.Add(-period)
+	filter := bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}
+
+	// Decoded as OngoingCrash to get the count of deduplicated crashes, single crashes have none
+	var crashes []OngoingCrash
+	if err := findAll(crashCollection, filter, &crashes); err != nil {
+		return Digest{}, err
+	}
+	var restarts []RestartEvent
+	if err := findAll(restartCollection, filter, &restarts); err != nil {
+		return Digest{}, err
+	}
+	uptimes, err := buildUptime(servers, from, to, healthCollection)
+	if err != nil {
+		return Digest{}, err
+	}
+	return compileDigest(from, to, crashes, restarts, uptimes, serverStates.all()), nil
+}
+
+// compileDigest compiles the digest of [from, to) from its crash and restart events, the servers' uptime over it
+// and their in-memory check history. Like /stats, an OngoingCrash counts as the crashes it stands for and
+// restartCircuitOpen markers don't count as crashes.
+func compileDigest(from, to time.Time, crashes []OngoingCrash, restarts []RestartEvent, uptimes []ServerUptime, states []serverState) Digest {
+	digest := Digest{From: from, To: to, CrashesByType: make(map[string]int)}
+
+	perServer := make(map[string]*DigestServer)
+	serverEntry := func(url, model string) *DigestServer {
+		key := url + "|" + model
+		if perServer[key] == nil {
+			perServer[key] = &DigestServer{URL: url, Model: model}
+		}
+		return perServer[key]
+	}
+	for _, event := range crashes {
+		if event.CrashType == "restartCircuitOpen" {
+			continue
+		}
+		count := event.Count
+		if count < 1 {
+			count = 1
+		}
+		digest.Crashes += count
+		digest.CrashesByType[event.CrashType] += count
+		serverEntry(event.URL, event.Model).Crashes += count
+	}
+	for _, uptime := range uptimes {
+		serverEntry(uptime.URL, uptime.Model).UptimePercent = uptime.UptimePercent
+	}
+	for _, event := range restarts {
+		digest.Restarts++
+		if event.Status != "success" {
+			digest.FailedRestarts++
+		}
+	}
+	if digest.Restarts > 0 {
+		rate := float64(digest.Restarts-digest.FailedRestarts) / float64(digest.Restarts)
+		digest.RestartSuccess = &rate
+	}
+
+	for _, state := range states {
+		entry := serverEntry(state.URL, state.Model)
+		checks, passed := 0, 0
+		for _, sample := range state.Recent {
+			if sample.Time.Before(digest.From) {
+				continue
+			}
+			checks++
+			if sample.Healthy {
+				passed++
+			}
+		}
+		if checks > 0 {
+			rate := float64(passed) / float64(checks)
+			entry.PassRate = &rate
+		}
+	}
+
+	for _, entry := range perServer {
+		digest.Servers = append(digest.Servers, *entry)
+	}
+	sort.Slice(digest.Servers, func(i, j int) bool {
+		if digest.Servers[i].Crashes != digest.Servers[j].Crashes {
+			return digest.Servers[i].Crashes > digest.Servers[j].Crashes
+		}
+		if digest.Servers[i].URL != digest.Servers[j].URL {
+			return digest.Servers[i].URL < digest.Servers[j].URL
+		}
+		return digest.Servers[i].Model < digest.Servers[j].Model
+	})
+	for _, entry := range digest.Servers {
+		if entry.Crashes == 0 || len(digest.FlakiestServers) == digestTopServers {
+			break
+		}
+		digest.FlakiestServers = append(digest.FlakiestServers, entry)
+	}
+	return digest
+}
+
+// findAll decodes every document in collection matching filter into out
+func findAll(collection *mongo.Collection, filter bson.M, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return cursor.All(ctx, out)
+}
+
+// sendDigest builds the digest of the configured period, logs its headline numbers, publishes it and sends it
+// to the digest's recipients
+func sendDigest(config *Config, crashCollection, restartCollection, healthCollection *mongo.Collection) {
+	digest, err := buildDigest(time.Duration(config.Digest.Period), currentServers(), crashCollection, restartCollection, healthCollection)
+	if err != nil {
+		slog.Error("Failed to build digest", "error", err)
+		return
+	}
+	slog.Info("Digest", "from", digest.From.Format(time.RFC3339), "to", digest.To.Format(time.RFC3339), "crashes", digest.Crashes,
+		"restarts", digest.Restarts, "failed_restarts", digest.FailedRestarts)
+	publisher.Publish("digest", digest)
+
+	recipients := config.Digest.Recipients
+	if len(recipients) == 0 {
+		recipients = []string{"slack", "webhooks"}
+	}
+	for _, recipient := range recipients {
+		switch recipient {
+		case "slack":
+			notifySlack(digestAlert(digest))
+		case "webhooks":
+			notifyWebhooks("digest", "", digest)
+		default:
+			go func(recipient string) {
+				if err := deliverWebhook(WebhookConfig{URL: recipient, Method: http.MethodPost}, "digest", "", digest); err != nil {
+					slog.Error("Failed to deliver digest", "recipient", recipient, "error", err)
+				}
+			}(recipient)
+		}
+	}
+}
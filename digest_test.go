@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileDigest(t *testing.T) {
+	to := time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	from := to.Add(-24 * time.Hour)
+	percent := func(p float64) *float64 { return &p }
+	crash := func(url, crashType string) OngoingCrash {
+		return OngoingCrash{CrashEvent: CrashEvent{URL: url, Model: "llama3", CrashType: crashType}}
+	}
+	ongoing := func(url, crashType string, count int) OngoingCrash {
+		c := crash(url, crashType)
+		c.Count = count
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		crashes    []OngoingCrash
+		restarts   []RestartEvent
+		uptimes    []ServerUptime
+		states     []serverState
+		want       Digest
+		wantServer []DigestServer
+	}{
+		{
+			name: "empty period",
+			want: Digest{},
+		},
+		{
+			name:     "crashes, restarts and uptime",
+			crashes:  []OngoingCrash{crash("http://a", "timeout"), crash("http://a", "http_500"), crash("http://b", "timeout")},
+			restarts: []RestartEvent{{URL: "http://a", Status: "success"}, {URL: "http://a", Status: "fail"}},
+			uptimes: []ServerUptime{
+				{URL: "http://a", Model: "llama3", UptimePercent: percent(90)},
+				{URL: "http://c", Model: "llama3", UptimePercent: percent(100)},
+			},
+			want: Digest{Crashes: 3, Restarts: 2, FailedRestarts: 1},
+			wantServer: []DigestServer{
+				{URL: "http://a", Model: "llama3", Crashes: 2, UptimePercent: percent(90)},
+				{URL: "http://b", Model: "llama3", Crashes: 1},
+				{URL: "http://c", Model: "llama3", UptimePercent: percent(100)},
+			},
+		},
+		{
+			name:    "ongoing crashes count as their count",
+			crashes: []OngoingCrash{ongoing("http://a", "timeout", 4), crash("http://a", "http_500")},
+			want:    Digest{Crashes: 5},
+			wantServer: []DigestServer{
+				{URL: "http://a", Model: "llama3", Crashes: 5},
+			},
+		},
+		{
+			name:    "restart circuit markers are not crashes",
+			crashes: []OngoingCrash{crash("http://a", "restartCircuitOpen"), crash("http://b", "timeout")},
+			want:    Digest{Crashes: 1},
+			wantServer: []DigestServer{
+				{URL: "http://b", Model: "llama3", Crashes: 1},
+			},
+		},
+		{
+			name: "pass rate over the period only",
+			states: []serverState{{URL: "http://a", Model: "llama3", Recent: []checkSample{
+				{Time: from.Add(-time.Hour), Healthy: false},
+				{Time: from.Add(time.Hour), Healthy: true},
+				{Time: from.Add(2 * time.Hour), Healthy: false},
+			}}},
+			wantServer: []DigestServer{{URL: "http://a", Model: "llama3", PassRate: percent(0.5)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compileDigest(from, to, tt.crashes, tt.restarts, tt.uptimes, tt.states)
+			if got.Crashes != tt.want.Crashes || got.Restarts != tt.want.Restarts || got.FailedRestarts != tt.want.FailedRestarts {
+				t.Errorf("digest = %d crashes, %d restarts (%d failed), want %d, %d (%d)",
+					got.Crashes, got.Restarts, got.FailedRestarts, tt.want.Crashes, tt.want.Restarts, tt.want.FailedRestarts)
+			}
+			if len(got.Servers) != len(tt.wantServer) {
+				t.Fatalf("servers = %+v, want %+v", got.Servers, tt.wantServer)
+			}
+			for i, w := range tt.wantServer {
+				g := got.Servers[i]
+				if g.URL != w.URL || g.Model != w.Model || g.Crashes != w.Crashes {
+					t.Errorf("server %d = %+v, want %+v", i, g, w)
+				}
+				if deref(g.UptimePercent) != deref(w.UptimePercent) {
+					t.Errorf("server %d uptime = %v, want %v", i, deref(g.UptimePercent), deref(w.UptimePercent))
+				}
+				if deref(g.PassRate) != deref(w.PassRate) {
+					t.Errorf("server %d pass rate = %v, want %v", i, deref(g.PassRate), deref(w.PassRate))
+				}
+			}
+			for _, entry := range got.FlakiestServers {
+				if entry.Crashes == 0 {
+					t.Errorf("flakiest servers include %s without crashes", entry.URL)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestAlert(t *testing.T) {
+	uptime := 87.5
+	digest := Digest{
+		Crashes:         2,
+		Restarts:        1,
+		FlakiestServers: []DigestServer{{URL: "http://a", Model: "llama3", Crashes: 2, UptimePercent: &uptime}},
+	}
+	msg := digestAlert(digest)
+	for _, want := range []string{"2 crashes, 1 restarts", "http://a", "87.50% uptime"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("digestAlert() = %q, want it to contain %q", msg, want)
+		}
+	}
+}
+
+func TestValidateDigestRecipients(t *testing.T) {
+	tests := []struct {
+		recipients []string
+		wantErr    bool
+	}{
+		{nil, false},
+		{[]string{"slack", "webhooks"}, false},
+		{[]string{"https://hooks.example.com/digest"}, false},
+		{[]string{"email"}, true},
+		{[]string{"ftp://example.com"}, true},
+	}
+	for _, tt := range tests {
+		config := &Config{Digest: DigestConfig{Recipients: tt.recipients}}
+		if err := validateConfig(config); (err != nil) != tt.wantErr {
+			t.Errorf("recipients %v: error = %v, want error %v", tt.recipients, err, tt.wantErr)
+		}
+	}
+}
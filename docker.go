@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Restarter restarts server containers on their Docker daemon, pods on their Kubernetes cluster or systemd units
+type Restarter interface {
+	// Restart restarts the server's container
+	Restart(ctx context.Context, server Server) error
+	// Version returns the version of the server's Docker daemon, cluster or systemd, failing if it is unreachable
+	Version(ctx context.Context, server Server) (string, error)
+}
+
+// restarterFor returns the Restarter for a server according to its restart_mode and the config's restarter setting.
+// The Engine API client only speaks plain HTTP over unix:// and tcp:// hosts, servers using a docker
+// context, an ssh:// host or TLS always go through the CLI.
+func restarterFor(server Server, config *Config) Restarter {
+	switch server.RestartMode {
+	case "k8s":
+		return k8sRestarter{}
+	case "systemd":
+		return systemdRestarter{knownHostsFile: config.SSHKnownHosts}
+	}
+	if server.Host != "" {
+		return sshDockerRestarter{knownHostsFile: config.SSHKnownHosts}
+	}
+	if config.Restarter == "cli" || server.DockerContext != "" || os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		return cliRestarter{}
+	}
+	if _, _, err := dockerEndpoint(server); err != nil {
+		return cliRestarter{}
+	}
+	return apiRestarter{}
+}
+
+// cliRestarter shells out to the docker CLI, which must be installed in the image
+type cliRestarter struct{}
+
+// Restart implements Restarter
+func (cliRestarter) Restart(ctx context.Context, server Server) error {
+	output, err := dockerCommand(ctx, server, "restart", server.ContainerName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Version implements Restarter
+func (cliRestarter) Version(ctx context.Context, server Server) (string, error) {
+	output, err := dockerCommand(ctx, server, "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// dockerAPIVersion is the Engine API version requested, supported since Docker 17.06
+const dockerAPIVersion = "v1.30"
+
+// apiRestarter calls the Docker Engine API of the server's docker_host, DOCKER_HOST or the local socket.
+// It speaks the two calls it needs over plain HTTP itself: github.com/docker/docker/client would pull in
+// the moby module tree for them, and servers with TLS, ssh:// hosts or contexts go through the CLI anyway.
+type apiRestarter struct{}
+
+// dockerEndpoint returns the base URL of the server's Docker Engine API and the transport reaching it
+func dockerEndpoint(server Server) (string, *http.Transport, error) {
+	host := server.DockerHost
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		dialer := &net.Dialer{}
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return "http://docker/" + dockerAPIVersion, transport, nil
+	case "tcp", "http":
+		return "http://" + u.Host + "/" + dockerAPIVersion, &http.Transport{}, nil
+	default:
+		return "", nil, fmt.Errorf("docker host %s is not supported by the Engine API client", host)
+	}
+}
+
+// call sends a request to the server's Docker Engine API and decodes the JSON response into out, if not nil.
+// Error responses are returned with the daemon's message, e.g. "No such container: ollama".
+func (apiRestarter) call(ctx context.Context, server Server, method, path string, out interface{}) error {
+	base, transport, err := dockerEndpoint(server)
+	if err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, method, base+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		return fmt.Errorf("docker API %s %s: %s", method, path, apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Restart implements Restarter
+func (r apiRestarter) Restart(ctx context.Context, server Server) error {
+	return r.call(ctx, server, http.MethodPost, "/containers/"+url.PathEscape(server.ContainerName)+"/restart", nil)
+}
+
+// Version implements Restarter
+func (r apiRestarter) Version(ctx context.Context, server Server) (string, error) {
+	var version struct {
+		Version string `json:"Version"`
+	}
+	if err := r.call(ctx, server, http.MethodGet, "/version", &version); err != nil {
+		return "", err
+	}
+	return version.Version, nil
+}
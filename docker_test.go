@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// fakeDockerDaemon answers the Engine API calls apiRestarter makes, restarting only the container "ollama"
+func fakeDockerDaemon(t *testing.T, hang time.Duration) string {
+	t.Helper()
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(hang)
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/"+dockerAPIVersion+"/version":
+			w.Write([]byte(`{"Version":"24.0.9"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/"+dockerAPIVersion+"/containers/ollama/restart":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/restart"):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container: missing"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(daemon.Close)
+	return "tcp://" + strings.TrimPrefix(daemon.URL, "http://")
+}
+
+func TestAPIRestarter(t *testing.T) {
+	host := fakeDockerDaemon(t, 0)
+	tests := []struct {
+		name      string
+		container string
+		wantErr   string
+	}{
+		{"restarted", "ollama", ""},
+		{"daemon's message", "missing", "No such container: missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := apiRestarter{}.Restart(context.Background(), Server{DockerHost: host, ContainerName: tt.container})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Restart() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Restart() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	version, err := apiRestarter{}.Version(context.Background(), Server{DockerHost: host})
+	if err != nil || version != "24.0.9" {
+		t.Errorf("Version() = %q, %v, want 24.0.9", version, err)
+	}
+}
+
+func TestAPIRestarterHonorsTimeout(t *testing.T) {
+	host := fakeDockerDaemon(t, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := (apiRestarter{}).Restart(ctx, Server{DockerHost: host, ContainerName: "ollama"}); err == nil {
+		t.Error("restart through a hung daemon succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("restart took %v despite a 50ms timeout", elapsed)
+	}
+}
+
+func TestRestarterFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		server Server
+		config Config
+		want   Restarter
+	}{
+		{"local socket", Server{ContainerName: "ollama"}, Config{}, apiRestarter{}},
+		{"tcp host", Server{ContainerName: "ollama", DockerHost: "tcp://gpu-1:2375"}, Config{}, apiRestarter{}},
+		{"cli configured", Server{ContainerName: "ollama"}, Config{Restarter: "cli"}, cliRestarter{}},
+		{"docker context", Server{ContainerName: "ollama", DockerContext: "gpu-1"}, Config{}, cliRestarter{}},
+		{"ssh docker host", Server{ContainerName: "ollama", DockerHost: "ssh://gpu-1"}, Config{}, cliRestarter{}},
+		{"ssh host", Server{ContainerName: "ollama", Host: "gpu-1"}, Config{}, sshDockerRestarter{}},
+		{"k8s", Server{RestartMode: "k8s"}, Config{}, k8sRestarter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOCKER_HOST", "")
+			t.Setenv("DOCKER_TLS_VERIFY", "")
+			if got := restarterFor(tt.server, &tt.config); got != tt.want {
+				t.Errorf("restarterFor() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDockerAccess(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	reachable := fakeDockerDaemon(t, 0)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	unreachable := "tcp://" + strings.TrimPrefix(closed.URL, "http://")
+	closed.Close()
+	config := &Config{Servers: []Server{
+		{URL: "http://gpu-1:11434/api/chat", Model: "llama3", ContainerName: "ollama", DockerHost: reachable},
+		{URL: "http://gpu-1:11434/api/chat", Model: "mistral", ContainerName: "ollama", DockerHost: reachable},
+		{URL: "http://gpu-2:11434/api/chat", Model: "llama3", ContainerName: "ollama", DockerHost: unreachable},
+		{URL: "http://gpu-3:11434/api/chat", Model: "llama3", DockerHost: unreachable},
+	}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	checkDockerAccess(config)
+	var reached, warned []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Msg string `json:"msg"`
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log %q: %v", line, err)
+		}
+		switch entry.Msg {
+		case "Docker reachable":
+			reached = append(reached, entry.URL)
+		case "Docker is not reachable, container restarts will fail":
+			warned = append(warned, entry.URL)
+		}
+	}
+	// Each daemon is checked once, servers without a container aren't restarted
+	if !reflect.DeepEqual(reached, []string{"http://gpu-1:11434/api/chat"}) {
+		t.Errorf("reached docker for %v, want gpu-1 once", reached)
+	}
+	if !reflect.DeepEqual(warned, []string{"http://gpu-2:11434/api/chat"}) {
+		t.Errorf("warned for %v, want gpu-2 only", warned)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/exp/slog"
+)
+
+// maxGrafanaBuckets bounds the datapoints per series a crash count query may produce
+const maxGrafanaBuckets = 10000
+
+// TimeSeries is a series in the shape the Grafana JSON and Infinity data sources read directly
+type TimeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // [value, unix ms], oldest first
+}
+
+// seriesTarget names a server's series
+func seriesTarget(url, model string) string {
+	if model == "" {
+		return url
+	}
+	return url + " (" + model + ")"
+}
+
+// grafanaRange reads the from and to query parameters, unix milliseconds as sent by Grafana's ${__from}
+// and ${__to}, defaulting to the last 24 hours
+func grafanaRange(r *http.Request) (time.Time, time.Time, bool) {
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, false
+		}
+		*t = time.UnixMilli(ms)
+	}
+	return from, to, from.Before(to)
+}
+
+// writeSeries encodes series as the JSON response, sorted by target
+func writeSeries(w http.ResponseWriter, series []TimeSeries) {
+	sort.Slice(series, func(i, j int) bool { return series[i].Target < series[j].Target })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(series); err != nil {
+		slog.Error("Failed to encode time series response", "error", err)
+	}
+}
+
+// grafanaCrashesHandler serves GET /grafana/crashes: crash counts per server and ?interval= bucket (default 1h)
+// between ?from= and ?to=. Every series has a datapoint for every bucket, empty ones count 0.
+func grafanaCrashesHandler(crashCollection *mongo.Collection) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		from, to, ok := grafanaRange(r)
+		if !ok {
+			http.Error(w, "Invalid from or to", http.StatusBadRequest)
+			return
+		}
+		interval := time.Hour
+		if value := r.URL.Query().Get("interval"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Invalid interval", http.StatusBadRequest)
+				return
+			}
+			interval = parsed
+		}
+		buckets := int(to.Sub(from)/interval) + 1
+		if buckets > maxGrafanaBuckets {
+			http.Error(w, "Too many datapoints, use a larger interval", http.StatusBadRequest)
+			return
+		}
+
+		var crashes []CrashEvent
+		filter := bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}
+		if err := findAll(crashCollection, filter, &crashes); err != nil {
+			http.Error(w, "Failed to query crash events", http.StatusInternalServerError)
+			slog.Error("Database query error for crash events", "error", err)
+			return
+		}
+
+		counts := make(map[string][]float64)
+		for _, event := range crashes {
+			target := seriesTarget(event.URL, event.Model)
+			if counts[target] == nil {
+				counts[target] = make([]float64, buckets)
+			}
+			counts[target][int(event.Timestamp.Sub(from)/interval)]++
+		}
+		series := make([]TimeSeries, 0, len(counts))
+		for target, values := range counts {
+			s := TimeSeries{Target: target, Datapoints: make([][2]float64, buckets)}
+			for i, value := range values {
+				s.Datapoints[i] = [2]float64{value, float64(from.Add(time.Duration(i) * interval).UnixMilli())}
+			}
+			series = append(series, s)
+		}
+		writeSeries(w, series)
+	}
+}
+
+// grafanaLatencyHandler serves GET /grafana/latency: the latency in ms of each server's successful checks
+// between ?from= and ?to=, as far back as the health score window keeps them
+func grafanaLatencyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, ok := grafanaRange(r)
+	if !ok {
+		http.Error(w, "Invalid from or to", http.StatusBadRequest)
+		return
+	}
+
+	series := []TimeSeries{}
+	for _, state := range serverStates.all() {
+		s := TimeSeries{Target: seriesTarget(state.URL, state.Model), Datapoints: [][2]float64{}}
+		for _, sample := range state.Recent {
+			if !sample.Healthy || sample.Time.Before(from) || !sample.Time.Before(to) {
+				continue
+			}
+			s.Datapoints = append(s.Datapoints, [2]float64{float64(sample.Latency.Milliseconds()), float64(sample.Time.UnixMilli())})
+		}
+		series = append(series, s)
+	}
+	writeSeries(w, series)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGrafanaCrashesHandler(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	crash := func(url string, after time.Duration) bson.D {
+		return bson.D{{Key: "url", Value: url}, {Key: "model", Value: "llama3"}, {Key: "timestamp", Value: from.Add(after)}}
+	}
+
+	mt.Run("series per server", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.Coll.Database().Name()+"."+mt.Coll.Name(), mtest.FirstBatch,
+			crash("http://b", 30*time.Minute),
+			crash("http://b", 150*time.Minute),
+			crash("http://b", 170*time.Minute),
+			crash("http://a", 70*time.Minute),
+		))
+		target := "/grafana/crashes?from=" + strconv.FormatInt(from.UnixMilli(), 10) + "&to=" + strconv.FormatInt(from.Add(3*time.Hour).UnixMilli(), 10)
+		rec := httptest.NewRecorder()
+		grafanaCrashesHandler(mt.Coll)(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+
+		var series []TimeSeries
+		if err := json.NewDecoder(rec.Body).Decode(&series); err != nil {
+			t.Fatal(err)
+		}
+		if len(series) != 2 || series[0].Target != "http://a (llama3)" || series[1].Target != "http://b (llama3)" {
+			t.Fatalf("series = %+v, want http://a then http://b", series)
+		}
+		for i, want := range [][]float64{{0, 1, 0, 0}, {1, 0, 2, 0}} {
+			points := series[i].Datapoints
+			if len(points) != len(want) {
+				t.Fatalf("%s has %d datapoints, want %d", series[i].Target, len(points), len(want))
+			}
+			for j, point := range points {
+				if point[0] != want[j] || point[1] != float64(from.Add(time.Duration(j)*time.Hour).UnixMilli()) {
+					t.Errorf("%s datapoint %d = %v, want [%v, bucket %d start]", series[i].Target, j, point, want[j], j)
+				}
+			}
+		}
+	})
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"bad from", "from=yesterday"},
+		{"from after to", "from=2000&to=1000"},
+		{"bad interval", "interval=0s"},
+		{"too many buckets", "interval=1s"},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			rec := httptest.NewRecorder()
+			grafanaCrashesHandler(mt.Coll)(rec, httptest.NewRequest(http.MethodGet, "/grafana/crashes?"+tt.query, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", rec.Code)
+			}
+		})
+	}
+}
+
+func TestGrafanaLatencyHandler(t *testing.T) {
+	oldStates := serverStates
+	serverStates = newStateStore()
+	t.Cleanup(func() { serverStates = oldStates })
+	server := Server{URL: "http://a", Model: "llama3"}
+	serverStates.recordCheck(server, 10, true, 120*time.Millisecond)
+	serverStates.recordCheck(server, 10, false, 0)
+	serverStates.recordCheck(server, 10, true, 80*time.Millisecond)
+	serverStates.recordCheck(Server{URL: "http://b"}, 10, false, 0)
+
+	rec := httptest.NewRecorder()
+	grafanaLatencyHandler(rec, httptest.NewRequest(http.MethodGet, "/grafana/latency", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var series []TimeSeries
+	if err := json.NewDecoder(rec.Body).Decode(&series); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Target != "http://a (llama3)" || series[1].Target != "http://b" {
+		t.Fatalf("series = %+v, want http://a (llama3) then http://b", series)
+	}
+	if points := series[0].Datapoints; len(points) != 2 || points[0][0] != 120 || points[1][0] != 80 || points[0][1] > points[1][1] {
+		t.Errorf("http://a datapoints = %v, want the two successful checks oldest first", points)
+	}
+	if series[1].Datapoints == nil || len(series[1].Datapoints) != 0 {
+		t.Errorf("http://b datapoints = %v, want an empty list", series[1].Datapoints)
+	}
+
+	rec = httptest.NewRecorder()
+	grafanaLatencyHandler(rec, httptest.NewRequest(http.MethodGet, "/grafana/latency?to=1000", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("to before the default from: status = %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/exp/slog"
+)
+
+// configRetryInterval is how often a watcher in degraded mode retries loading its config, a var so tests don't
+// wait it out
+var configRetryInterval = 30 * time.Second
+
+// writeHealth writes a /healthz response with the given status code and body
+func writeHealth(w http.ResponseWriter, code int, body map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Failed to encode health response", "error", err)
+	}
+}
+
+// healthzHandler reports that the watcher is configured and running. MongoDB is pinged on every request,
+// but only fails the probe once it has been unreachable for grace, so a blip doesn't get the watcher killed.
+// The first successful ping clears the failure.
+func healthzHandler(client *mongo.Client, grace time.Duration) http.HandlerFunc {
+	var mu sync.Mutex
+	var failingSince time.Time // zero while MongoDB is reachable
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), mongoPingTimeout)
+		err := client.Ping(ctx, nil)
+		cancel()
+
+		mu.Lock()
+		if err == nil {
+			failingSince = time.Time{}
+		} else if failingSince.IsZero() {
+			failingSince = time.Now()
+		}
+		since := failingSince
+		mu.Unlock()
+
+		if err == nil {
+			writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+			return
+		}
+		body := map[string]string{"mongo": "unreachable", "mongo_unreachable_since": since.Format(time.RFC3339), "error": err.Error()}
+		if time.Since(since) < grace {
+			body["status"] = "ok"
+			writeHealth(w, http.StatusOK, body)
+			return
+		}
+		body["status"] = "unavailable"
+		writeHealth(w, http.StatusServiceUnavailable, body)
+	}
+}
+
+// mongoPingTimeout bounds the MongoDB ping of /health, well below typical probe timeouts
+const mongoPingTimeout = 2 * time.Second
+
+// mongoHealthHandler reports whether the watcher can reach MongoDB, for liveness and readiness probes
+func mongoHealthHandler(client *mongo.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), mongoPingTimeout)
+		defer cancel()
+		if err := client.Ping(ctx, nil); err != nil {
+			writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "mongo": "disconnected", "error": err.Error()})
+			return
+		}
+		writeHealth(w, http.StatusOK, map[string]string{"status": "ok", "mongo": "connected"})
+	}
+}
+
+// waitForConfig keeps the process up in degraded mode after the config failed to load.
+// It serves only /healthz on addr, with a 503 describing the config error, and retries loading the config
+// until it succeeds, then stops the degraded server and returns the config.
+func waitForConfig(addr, path, profile string, loadErr error) *Config {
+	var mu sync.Mutex
+	lastErr := loadErr
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		msg := lastErr.Error()
+		mu.Unlock()
+		writeHealth(w, http.StatusServiceUnavailable, map[string]string{"status": "unconfigured", "error": msg})
+	})
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Failed to start degraded server", "error", err)
+			os.Exit(1)
+		}
+	}()
+	slog.Error("Failed to load config, serving /healthz until it loads", "addr", addr, "path", path, "retry_interval", configRetryInterval.String(), "error", loadErr)
+
+	for {
+		time.Sleep(configRetryInterval)
+		config, err := loadConfig(path, profile)
+		if err != nil {
+			slog.Error("Config is still invalid", "path", path, "error", err)
+			mu.Lock()
+			lastErr = err
+			mu.Unlock()
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Failed to stop degraded server", "error", err)
+		}
+		cancel()
+		slog.Info("Loaded config, leaving degraded mode", "path", path)
+		return config
+	}
+}
+
+// configReloadInterval is how often the config file is checked for changes
+const configReloadInterval = 30 * time.Second
+
+// watchConfig polls the config file and calls reload with the new config whenever its content changes.
+// Changes that don't load or validate are logged and ignored, the previous config stays in effect.
+func watchConfig(path, profile string, reload func(*Config)) {
+	last, _ := os.ReadFile(path)
+	lastSum := sha256.Sum256(last)
+	for range time.Tick(configReloadInterval) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Failed to read config for reloading", "path", path, "error", err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if sum == lastSum {
+			continue
+		}
+		lastSum = sum
+		config, err := loadConfig(path, profile)
+		if err != nil {
+			slog.Warn("Ignoring invalid change to config, keeping the previous config", "path", path, "error", err)
+			continue
+		}
+		slog.Info("Config changed, reloading", "path", path)
+		reload(config)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestWaitForConfigServesOnlyHealthz(t *testing.T) {
+	interval := configRetryInterval
+	configRetryInterval = 20 * time.Millisecond
+	defer func() { configRetryInterval = interval }()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("servers: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, loadErr := loadConfig(path, "")
+	if loadErr == nil {
+		t.Fatal("invalid config loaded")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	loaded := make(chan *Config)
+	go func() { loaded <- waitForConfig(addr, path, "", loadErr) }()
+	get := func(path string) (*http.Response, error) {
+		resp, err := http.Get("http://" + addr + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	var resp *http.Response
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if resp, err = get("/healthz"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("degraded server not serving: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/healthz status = %d, want 503", resp.StatusCode)
+	}
+	for _, path := range []string{"/status", "/crashes", "/metrics"} {
+		if resp, err := get(path); err != nil || resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s in degraded mode = %v, %v, want a 404", path, resp, err)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("servers:\n  - url: http://a/api/chat\n    model: llama3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case config := <-loaded:
+		if len(config.Servers) != 1 || config.Servers[0].Model != "llama3" {
+			t.Errorf("loaded servers = %+v", config.Servers)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("still degraded after the config became valid")
+	}
+	if resp, err := get("/healthz"); err == nil {
+		t.Errorf("degraded server still serving after the config loaded: %s", resp.Status)
+	}
+}
+
+func TestHealthzHandlerGrace(t *testing.T) {
+	const grace = 100 * time.Millisecond
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("mongo blips", func(mt *mtest.T) {
+		handler := healthzHandler(mt.Client, grace)
+		pingFailure := mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Name: "ShutdownInProgress", Message: "shutting down"})
+		steps := []struct {
+			name  string
+			ping  bson.D
+			wait  time.Duration // before the probe
+			want  int
+			state string
+		}{
+			{"reachable", mtest.CreateSuccessResponse(), 0, http.StatusOK, "ok"},
+			{"first failure", pingFailure, 0, http.StatusOK, "ok"},
+			{"failing within grace", pingFailure, grace / 4, http.StatusOK, "ok"},
+			{"failing past grace", pingFailure, grace, http.StatusServiceUnavailable, "unavailable"},
+			{"reachable again", mtest.CreateSuccessResponse(), 0, http.StatusOK, "ok"},
+			{"new failure starts a new grace", pingFailure, 0, http.StatusOK, "ok"},
+		}
+		for _, step := range steps {
+			time.Sleep(step.wait)
+			mt.AddMockResponses(step.ping)
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			var body map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != step.want || body["status"] != step.state {
+				t.Errorf("%s: /healthz = %d %v, want %d with status %s", step.name, rec.Code, body, step.want, step.state)
+			}
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// k8sRequestTimeout bounds each request to the Kubernetes API server, on top of the restart's own timeout
+const k8sRequestTimeout = 30 * time.Second
+
+// k8sRestarter restarts servers running as Kubernetes pods through the API server of the cluster the watcher runs
+// in, authenticating with its service account, or outside a cluster the one of KUBECONFIG or ~/.kube/config.
+// It needs RBAC permission to patch deployments, or to list and delete pods, in the servers' namespaces.
+type k8sRestarter struct {
+	clientset kubernetes.Interface // nil uses the shared one, see k8sClientset
+}
+
+// k8sClient is the clientset restarts use, built on first use so its connections and the service account's CA
+// are kept. The token is reread by client-go as the kubelet rotates it.
+var k8sClient = struct {
+	sync.Mutex
+	clientset kubernetes.Interface
+}{}
+
+// k8sClientset returns the shared clientset, from the in-cluster config or else the default kubeconfig
+func k8sClientset() (kubernetes.Interface, error) {
+	k8sClient.Lock()
+	defer k8sClient.Unlock()
+	if k8sClient.clientset != nil {
+		return k8sClient.clientset, nil
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		loading := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+		var kubeconfigErr error
+		if config, kubeconfigErr = loading.ClientConfig(); kubeconfigErr != nil {
+			return nil, fmt.Errorf("not running in a Kubernetes cluster (%v) and no kubeconfig: %v", err, kubeconfigErr)
+		}
+	}
+	config.Timeout = k8sRequestTimeout
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	k8sClient.clientset = clientset
+	return clientset, nil
+}
+
+// client returns the restarter's clientset
+func (r k8sRestarter) client() (kubernetes.Interface, error) {
+	if r.clientset != nil {
+		return r.clientset, nil
+	}
+	return k8sClientset()
+}
+
+// Restart implements Restarter. A deployment is rolled the way `kubectl rollout restart` does, by stamping its pod
+// template, so replicas are replaced according to its rollout strategy. Otherwise the pods matching pod_selector
+// are deleted for their controller to recreate. Errors carry the API server's message, e.g.
+// `deployments.apps "ollama" not found`.
+func (r k8sRestarter) Restart(ctx context.Context, server Server) error {
+	clientset, err := r.client()
+	if err != nil {
+		return err
+	}
+	if server.Deployment != "" {
+		patch, err := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"annotations": map[string]string{"kubectl.kubernetes.io/restartedAt": time.Now().Format(time.RFC3339)},
+					},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = clientset.AppsV1().Deployments(server.Namespace).Patch(ctx, server.Deployment, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		return err
+	}
+
+	pods, err := clientset.CoreV1().Pods(server.Namespace).List(ctx, metav1.ListOptions{LabelSelector: server.PodSelector})
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no pods in namespace %s match %s", server.Namespace, server.PodSelector)
+	}
+	for _, pod := range pods.Items {
+		if err := clientset.CoreV1().Pods(server.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version implements Restarter, returning the API server's version
+func (r k8sRestarter) Version(ctx context.Context, server Server) (string, error) {
+	clientset, err := r.client()
+	if err != nil {
+		return "", err
+	}
+	// Discovery's ServerVersion takes no context, the request is made directly to honor ctx
+	raw, err := clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+	if err != nil {
+		return "", err
+	}
+	var info version.Info
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return "", err
+	}
+	return info.GitVersion, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestK8sRestart(t *testing.T) {
+	pod := func(name string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "llm", Labels: labels}}
+	}
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "ollama", Namespace: "llm"}}
+
+	tests := []struct {
+		name        string
+		server      Server
+		objects     []runtime.Object
+		wantErr     bool
+		wantPods    int
+		wantStamped bool
+	}{
+		{
+			name:        "deployment rolled",
+			server:      Server{Namespace: "llm", Deployment: "ollama"},
+			objects:     []runtime.Object{deployment},
+			wantStamped: true,
+		},
+		{
+			name:    "missing deployment",
+			server:  Server{Namespace: "llm", Deployment: "vllm"},
+			objects: []runtime.Object{deployment},
+			wantErr: true,
+		},
+		{
+			name:   "matching pods deleted",
+			server: Server{Namespace: "llm", PodSelector: "app=ollama"},
+			objects: []runtime.Object{
+				pod("ollama-1", map[string]string{"app": "ollama"}),
+				pod("ollama-2", map[string]string{"app": "ollama"}),
+				pod("vllm-1", map[string]string{"app": "vllm"}),
+			},
+			wantPods: 1,
+		},
+		{
+			name:     "no matching pods",
+			server:   Server{Namespace: "llm", PodSelector: "app=ollama"},
+			objects:  []runtime.Object{pod("vllm-1", map[string]string{"app": "vllm"})},
+			wantErr:  true,
+			wantPods: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tt.objects...)
+			ctx := context.Background()
+			err := k8sRestarter{clientset: clientset}.Restart(ctx, tt.server)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Restart() error = %v, want error %v", err, tt.wantErr)
+			}
+			pods, err := clientset.CoreV1().Pods("llm").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pods.Items) != tt.wantPods {
+				t.Errorf("%d pods left, want %d", len(pods.Items), tt.wantPods)
+			}
+			if tt.wantStamped {
+				got, err := clientset.AppsV1().Deployments("llm").Get(ctx, "ollama", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] == "" {
+					t.Errorf("pod template annotations = %v, want restartedAt", got.Spec.Template.Annotations)
+				}
+			}
+		})
+	}
+}
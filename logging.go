@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// logLevels maps the log_level setting to slog levels
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging makes slog log JSON (or human-readable text with format "text") to stderr from level up.
+// Libraries writing to the standard logger, such as net/http, are logged through it at info level.
+// LOG_LEVEL and LOG_FORMAT take precedence over the arguments.
+func setupLogging(level, format string) {
+	if env := os.Getenv("LOG_LEVEL"); env != "" {
+		level = env
+	}
+	if env := os.Getenv("LOG_FORMAT"); env != "" {
+		format = env
+	}
+	opts := &slog.HandlerOptions{Level: logLevels[strings.ToLower(level)]} // unknown levels fall back to info
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	log.SetFlags(0)
+	log.SetOutput(slog.NewLogLogger(handler, slog.LevelInfo).Writer())
+}
+
+// validateLogging checks the log_level and log_format settings
+func validateLogging(level, format string) error {
+	if _, ok := logLevels[level]; level != "" && !ok {
+		return fmt.Errorf("log_level must be \"debug\", \"info\", \"warn\" or \"error\"")
+	}
+	if format != "" && format != "json" && format != "text" {
+		return fmt.Errorf("log_format must be \"json\" or \"text\"")
+	}
+	return nil
+}
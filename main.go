@@ -3,94 +3,503 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/expr-lang/expr/vm"
 	"github.com/robfig/cron/v3"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slog"
 	"gopkg.in/yaml.v2"
 )
 
 // Server represents an Ollama server configuration
 type Server struct {
-	URL           string `yaml:"url"`
-	Model         string `yaml:"model"`
-	ContainerName string `yaml:"container_name"`
+	URL                    string            `yaml:"url"`
+	Model                  string            `yaml:"model"`
+	ContainerName          string            `yaml:"container_name"`
+	Timeout                Duration          `yaml:"timeout"`                  // overrides the top-level timeout for this server, 0 inherits it
+	DockerHost             string            `yaml:"docker_host"`              // daemon to restart the container on, e.g. ssh://user@gpu-1, defaults to DOCKER_HOST
+	DockerContext          string            `yaml:"docker_context"`           // docker CLI context to restart the container in, alternative to docker_host
+	RestartMode            string            `yaml:"restart_mode"`             // "docker" (default) restarts container_name, "k8s" the pods of deployment or pod_selector, "systemd" service_name, "none" never restarts
+	Namespace              string            `yaml:"namespace"`                // restart_mode "k8s": namespace of the pods, default "default"
+	Deployment             string            `yaml:"deployment"`               // restart_mode "k8s": deployment rolled on a restart
+	PodSelector            string            `yaml:"pod_selector"`             // restart_mode "k8s": label selector of the pods deleted on a restart, e.g. "app=ollama", alternative to deployment
+	ServiceName            string            `yaml:"service_name"`             // restart_mode "systemd": unit restarted with systemctl, e.g. "ollama.service"
+	Host                   string            `yaml:"host"`                     // run the restart over SSH on this host, "[user@]host[:port]", e.g. "gpu-1"; restart_mode "docker" and "systemd" only
+	SSHUser                string            `yaml:"ssh_user"`                 // user to log in to host as, overrides a user in host
+	SSHKeyPath             string            `yaml:"ssh_key_path"`             // private key to log in to host with, defaults to ~/.ssh/id_ed25519, id_ecdsa or id_rsa
+	PostRestartDelay       Duration          `yaml:"post_restart_delay"`       // time the container gets to come back before the recovery check, default 30s
+	RestartCooldown        Duration          `yaml:"restart_cooldown"`         // minimum time between restarts of the container, 0 disables
+	PullMissingModel       bool              `yaml:"pull_missing_model"`       // on modelNotFound or modelMissing, run `ollama pull` in the container; without it those crashes are only recorded
+	PullTimeout            Duration          `yaml:"pull_timeout"`             // how long a pull may take, default 30m
+	RestartTimeout         Duration          `yaml:"restart_timeout"`          // how long a restart may take, default 2m
+	CheckModelListed       bool              `yaml:"check_model_listed"`       // before each probe, make sure /api/tags (/v1/models with api "openai") lists the model, recording modelMissing if not
+	RecoveryGrace          Duration          `yaml:"recovery_grace"`           // how long the recovery check keeps retrying after post_restart_delay, default 1m
+	DNSOverrides           map[string]string `yaml:"dns_overrides"`            // host -> IP, bypasses DNS for listed hosts
+	Group                  string            `yaml:"group"`                    // restart group, defaults to the model name
+	SuccessExpr            string            `yaml:"success_expr"`             // e.g. `status == 200 && latency_ms < 5000 && content contains "true"`
+	SkipStartupCheck       bool              `yaml:"skip_startup_check"`       // don't probe on boot, wait for the first scheduled tick
+	Enabled                *bool             `yaml:"enabled"`                  // false stops monitoring the server, e.g. during maintenance, without removing it; unset means enabled
+	Canary                 bool              `yaml:"canary"`                   // checked before the other servers of the same tick, which canary_policy may skip if it fails
+	TagModelMetadata       bool              `yaml:"tag_model_metadata"`       // attach /api/show details (quantization, context size, ...) to crash events
+	MetricsURL             string            `yaml:"metrics_url"`              // Prometheus exporter (node_exporter, dcgm-exporter) scraped into crash events
+	Metrics                []string          `yaml:"metrics"`                  // metric names to keep from metrics_url, defaults to load, memory and GPU usage
+	HealthyStatusCodes     []int             `yaml:"healthy_status_codes"`     // defaults to [200]
+	StatusFailureThreshold int               `yaml:"status_failure_threshold"` // consecutive non-healthy statuses before a crash, 0 only logs them
+	RecoveryQuorum         int               `yaml:"recovery_quorum"`          // consecutive passed checks before a failed server counts as recovered, default 1
+	DisableKeepAlive       bool              `yaml:"disable_keep_alive"`       // force a fresh connection for every request
+	WarmConnections        int               `yaml:"warm_connections"`         // keep this many connections open between checks so latency excludes connection setup, 0 disables
+	CheckMode              string            `yaml:"check_mode"`               // "model" (default) probes Model, "loaded" probes every model listed by /api/ps, "httpget" GETs health_path
+	HealthPath             string            `yaml:"health_path"`              // check_mode "httpget": path requested on the server's host, defaults to the url itself
+	ExpectedSubstring      string            `yaml:"expected_substring"`       // the response body must contain this, any body is fine if empty
+	NoLoadedModels         string            `yaml:"no_loaded_models"`         // with check_mode "loaded": "healthy" (default) or "crash" when nothing is loaded
+	Endpoints              []string          `yaml:"endpoints"`                // further URLs served by the same container, all must pass; a failure restarts the container once
+	StoreLastResponse      bool              `yaml:"store_last_response"`      // keep the last response body in memory for /servers/{url}/lastresponse, off by default as it may hold sensitive text
+	Interval               Duration          `yaml:"interval"`                 // how often to check, defaults to the top-level interval
+	Schedule               string            `yaml:"schedule"`                 // cron expression, e.g. "*/5 * * * *", takes precedence over interval
+	PromptPadding          int               `yaml:"prompt_padding"`           // pad the probe prompt to this many characters to exercise larger contexts
+	Prompt                 string            `yaml:"prompt"`                   // probe message, defaults to asking for a JSON status; pair with expected_substring to check the answer
+	LatencySLA             Duration          `yaml:"latency_sla"`              // successful checks slower than this record an SLAViolationEvent, 0 disables
+	OllamaAPIVersion       string            `yaml:"ollama_api_version"`       // probe payload shape: "current" (default, /api/chat) or "legacy" (/api/generate, sent in place of the /api/chat of url)
+	API                    string            `yaml:"api"`                      // "ollama" (default) or "openai" for OpenAI-compatible servers such as vLLM or LocalAI, url then points at /v1/chat/completions
+
+	successProgram *vm.Program // compiled SuccessExpr, set by loadConfig
 }
 
 // Config holds the application configuration
 type Config struct {
-	Servers []Server `yaml:"servers"`
-	Timeout int      `yaml:"timeout"` // in seconds
+	Servers  []Server `yaml:"servers"`
+	Timeout  Duration `yaml:"timeout"`  // e.g. "1500ms" or "2m", plain numbers are seconds
+	Interval Duration `yaml:"interval"` // check interval of servers without their own, default 30m, overridden by CHECK_INTERVAL
+
+	Retries     int      `yaml:"retries"`      // times a failed request is retried before it counts as a crash, default 0
+	RetryDelay  Duration `yaml:"retry_delay"`  // wait before the first retry, doubled for each further one, default 1s
+	RetryJitter float64  `yaml:"retry_jitter"` // randomize each retry's wait by up to this fraction either way, e.g. 0.2, so servers failing together don't retry in lockstep
+
+	GroupRestartLimit     RestartLimit       `yaml:"group_restart_limit"`     // max concurrent restarts per group, a count or a percentage of its servers such as "50%", 0 means unlimited
+	MaxConcurrentRestarts int                `yaml:"max_concurrent_restarts"` // max concurrent restarts across all servers, 0 means unlimited
+	MaxRestartsPerHour    int                `yaml:"max_restarts_per_hour"`   // stop restarting a container after this many restart attempts within an hour, 0 means unlimited
+	MaxRequestsPerHost    int                `yaml:"max_requests_per_host"`   // max concurrent probes to one host:port, 0 means unlimited
+	MaxConcurrency        int                `yaml:"max_concurrency"`         // max concurrent probes across all servers, 0 means unlimited
+	TickDeadline          Duration           `yaml:"tick_deadline"`           // with max_concurrency, checks still waiting for a slot this long after their tick are deferred to the next one, 0 means no deadline
+	SkipDockerCheck       bool               `yaml:"skip_docker_check"`       // don't check at startup that the Docker daemons restarts go to are reachable
+	Restarter             string             `yaml:"restarter"`               // "api" (default) restarts through the Docker Engine API, "cli" through the docker CLI
+	SSHKnownHosts         string             `yaml:"ssh_known_hosts"`         // known_hosts file the host keys of servers' host are verified against, default ~/.ssh/known_hosts
+	RequireContainerName  bool               `yaml:"require_container_name"`  // reject servers without a container_name instead of checking them without restarts
+	CanaryPolicy          string             `yaml:"canary_policy"`           // "continue" (default) or "skip" the other checks of a tick when a canary fails
+	LastResponseLimit     int                `yaml:"last_response_limit"`     // bytes of each stored last response to keep, default 4096
+	DebugResponseContent  bool               `yaml:"debug_response_content"`  // log the content of every response at debug level, so only with log_level debug; off by default as it may be sensitive
+	LogLevel              string             `yaml:"log_level"`               // "debug", "info" (default), "warn" or "error", overridden by LOG_LEVEL
+	LogFormat             string             `yaml:"log_format"`              // "json" (default) or "text" for human-readable logs, overridden by LOG_FORMAT
+	CertExpiryWarning     Duration           `yaml:"cert_expiry_warning"`     // warn when an HTTPS server's certificate expires within this, default 14 days
+	CrashRules            []CrashRule        `yaml:"crash_rules"`             // evaluated in order, the first match wins
+	HealthScore           HealthScoreConfig  `yaml:"health_score"`
+	LatencyTrend          LatencyTrendConfig `yaml:"latency_trend"`
+	APIReadTimeout        Duration           `yaml:"api_read_timeout"`        // max time to read an API request, default 10s
+	APIWriteTimeout       Duration           `yaml:"api_write_timeout"`       // max time to write an API response, default 30s
+	APIToken              string             `yaml:"api_token"`               // bearer token the REST API requires, except /healthz and /health; overridden by API_TOKEN, empty disables
+	APIOpenReads          bool               `yaml:"api_open_reads"`          // with api_token, leave GET requests open and only require the token for changes such as DELETE and for stored responses
+	AllowedOrigins        []string           `yaml:"allowed_origins"`         // origins of browser dashboards allowed to call the API (CORS), "*" for any
+	MongoUnavailableGrace Duration           `yaml:"mongo_unavailable_grace"` // how long MongoDB may be unreachable before /healthz fails, default 1m
+	MongoConnectAttempts  int                `yaml:"mongo_connect_attempts"`  // attempts to connect to MongoDB at startup before giving up, default 10
+	MongoConnectDelay     Duration           `yaml:"mongo_connect_delay"`     // wait between those attempts, default 3s
+	MongoUsername         string             `yaml:"mongo_username"`          // MongoDB user, overridden by MONGO_USERNAME; empty uses the credentials of MONGO_URL, if any
+	MongoPassword         string             `yaml:"mongo_password"`          // its password, overridden by MONGO_PASSWORD
+	MongoAuthSource       string             `yaml:"mongo_auth_source"`       // database the user is defined in, default "admin"
+	MongoTLS              bool               `yaml:"mongo_tls"`               // connect to MongoDB over TLS, implied by mongo_ca_file or tls=true in MONGO_URL
+	MongoCAFile           string             `yaml:"mongo_ca_file"`           // PEM file of the CAs trusted for MongoDB's certificate, instead of the system pool
+	RetentionDays         int                `yaml:"retention_days"`          // delete events older than this many days, 0 keeps them forever
+	DedupeCrashes         bool               `yaml:"dedupe_crashes"`          // store a run of identical consecutive crashes as one OngoingCrash with a count instead of one event each
+	SlackWebhookURL       string             `yaml:"slack_webhook_url"`       // Slack incoming webhook alerted on crashes and failed restarts, empty disables
+	Webhooks              []WebhookConfig    `yaml:"webhooks"`                // HTTP endpoints notified of crashes and failed restarts
+	NotifyDedupWindow     Duration           `yaml:"notify_dedup_window"`     // alerts with the same idempotency key are sent once within this, default 10m
+	Publisher             PublisherConfig    `yaml:"publisher"`
+	Digest                DigestConfig       `yaml:"digest"`
+	QuietHours            QuietHoursConfig   `yaml:"quiet_hours"`
+	Shard                 ShardConfig        `yaml:"shard"`
+}
+
+// HealthScoreConfig controls how the 0-100 health score shown by /status is computed
+type HealthScoreConfig struct {
+	Window        int      `yaml:"window"`         // number of recent checks considered, default 20
+	ErrorWeight   float64  `yaml:"error_weight"`   // weight of the success rate, default 2
+	LatencyWeight float64  `yaml:"latency_weight"` // weight of the average latency, default 1
+	StreakWeight  float64  `yaml:"streak_weight"`  // weight of the current failure streak, default 1
+	SlowLatency   Duration `yaml:"slow_latency"`   // average latency that scores 0, default 10s
+}
+
+// PublisherConfig configures publishing events to a message bus alongside MongoDB
+type PublisherConfig struct {
+	NATSURL string `yaml:"nats_url"` // e.g. "nats://nats:4222", publishing is disabled when empty
+	Subject string `yaml:"subject"`  // subject prefix, events go to <subject>.crash and <subject>.restart, default "llm_watcher"
+}
+
+// DigestConfig schedules a periodic summary of crashes and restarts, published as a "digest" event
+type DigestConfig struct {
+	Schedule   string   `yaml:"schedule"`   // cron spec, e.g. "0 8 * * 1" or "@daily", empty disables the digest
+	Period     Duration `yaml:"period"`     // span each digest covers, default 24h
+	Recipients []string `yaml:"recipients"` // "slack", "webhooks" or the http(s) URL of a further webhook, default slack and webhooks
+}
+
+// LatencyTrendConfig controls detection of the gradual latency creep that precedes crashes.
+// The trend is fitted over the checks kept for the health score window.
+type LatencyTrendConfig struct {
+	MaxSlope   Duration `yaml:"max_slope"`   // latency increase per hour that marks a server as degrading, 0 disables detection
+	MinSamples int      `yaml:"min_samples"` // successful checks needed before a trend is fitted, default 5
+}
+
+// CrashRule reclassifies a crash whose error or response matches Pattern
+type CrashRule struct {
+	Pattern  string `yaml:"pattern"`  // regular expression
+	Type     string `yaml:"type"`     // crash type to record instead of the built-in one
+	Restart  *bool  `yaml:"restart"`  // whether to restart the container, defaults to true
+	Severity string `yaml:"severity"` // severity of the crash's alert, "info", "warning" (default) or "critical", see quiet_hours
+
+	pattern *regexp.Regexp // compiled Pattern, set by loadConfig
 }
 
 // CrashEvent represents a crash event stored in MongoDB
 type CrashEvent struct {
-	Timestamp time.Time `bson:"timestamp"`
-	URL       string    `bson:"url"`
-	Model     string    `bson:"model"`
-	CrashType string    `bson:"crash_type"` // e.g., "modelTimeouted", "ollamaTimeouted"
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"` // set by recordCrash, alerts about the crash derive their idempotency key from it
+	Timestamp     time.Time          `bson:"timestamp" json:"timestamp"`
+	URL           string             `bson:"url" json:"url"`
+	Model         string             `bson:"model" json:"model"`
+	CrashType     string             `bson:"crash_type" json:"crash_type"`                             // e.g., "timeout", "connectionRefused", "dnsFailure", "other", "criterionFailed", "unhealthyStatus", "invalidResponse", "modelNotFound", "modelMissing", "noModelsLoaded", "restartCircuitOpen"
+	RemoteAddr    string             `bson:"remote_addr,omitempty" json:"remote_addr,omitempty"`       // address the check was connected to, if a connection was made
+	ResolvedAddrs []string           `bson:"resolved_addrs,omitempty" json:"resolved_addrs,omitempty"` // what the host resolved to during the check, empty for IPs and dns_overrides
+	Retries       int                `bson:"retries,omitempty" json:"retries,omitempty"`               // failed attempts retried before this crash, see Config.Retries
+	Tags          map[string]string  `bson:"tags,omitempty" json:"tags,omitempty"`                     // model metadata, see Server.TagModelMetadata
+	SystemMetrics []SystemMetric     `bson:"system_metrics,omitempty" json:"system_metrics,omitempty"` // resource usage at the time of the crash, see Server.MetricsURL
+	Timing        *RequestTiming     `bson:"timing,omitempty" json:"timing,omitempty"`                 // phases of the failed request, unset if none was sent
+}
+
+// OngoingCrash stands for a run of identical consecutive crashes of a server with dedupe_crashes, stored in
+// crash_events instead of one CrashEvent per crash. Its timestamp follows last_seen, its other details are
+// those of the first crash.
+type OngoingCrash struct {
+	CrashEvent `bson:",inline"`
+	FirstSeen  time.Time `bson:"first_seen" json:"first_seen"`
+	LastSeen   time.Time `bson:"last_seen" json:"last_seen"`
+	Count      int       `bson:"count" json:"count"`
+	Open       bool      `bson:"open,omitempty" json:"open,omitempty"` // further identical crashes are still counted on it
 }
 
 // RestartEvent represents a container restart attempt stored in MongoDB
 type RestartEvent struct {
-	Timestamp     time.Time `bson:"timestamp"`
-	ContainerName string    `bson:"container_name"`
-	URL           string    `bson:"url"`
-	Model         string    `bson:"model"`
-	Status        string    `bson:"status"` // "success" or "fail"
-	ErrorMessage  string    `bson:"error_message,omitempty"` // Error message if status is "fail"
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"` // set by restartContainer, alerts about the restart derive their idempotency key from it
+	Timestamp     time.Time          `bson:"timestamp" json:"timestamp"`
+	ContainerName string             `bson:"container_name" json:"container_name"`
+	URL           string             `bson:"url" json:"url"`
+	Model         string             `bson:"model" json:"model"`
+	DockerHost    string             `bson:"docker_host,omitempty" json:"docker_host,omitempty"`
+	DockerContext string             `bson:"docker_context,omitempty" json:"docker_context,omitempty"`
+	Namespace     string             `bson:"namespace,omitempty" json:"namespace,omitempty"`
+	Deployment    string             `bson:"deployment,omitempty" json:"deployment,omitempty"`
+	PodSelector   string             `bson:"pod_selector,omitempty" json:"pod_selector,omitempty"`
+	ServiceName   string             `bson:"service_name,omitempty" json:"service_name,omitempty"`
+	Host          string             `bson:"host,omitempty" json:"host,omitempty"`
+	Action        string             `bson:"action,omitempty" json:"action,omitempty"`               // "pull" for model pulls, empty for restarts
+	Status        string             `bson:"status" json:"status"`                                   // "success" or "fail"
+	ErrorMessage  string             `bson:"error_message,omitempty" json:"error_message,omitempty"` // Error message if status is "fail"
+	Recovered     *bool              `bson:"recovered,omitempty" json:"recovered,omitempty"`         // result of the post-restart check, unset until it ran
 }
 
-// loadConfig reads and parses the YAML configuration file
-func loadConfig(filename string) (*Config, error) {
+// SLAViolationEvent represents a successful check that exceeded the server's latency_sla, stored in MongoDB
+type SLAViolationEvent struct {
+	Timestamp  time.Time `bson:"timestamp" json:"timestamp"`
+	URL        string    `bson:"url" json:"url"`
+	Model      string    `bson:"model" json:"model"`
+	LatencyMs  int64     `bson:"latency_ms" json:"latency_ms"`
+	SLAMs      int64     `bson:"sla_ms" json:"sla_ms"`
+	RemoteAddr string    `bson:"remote_addr,omitempty" json:"remote_addr,omitempty"`
+}
+
+// HealthEvent represents a check and, if it passed, its latency, stored in MongoDB
+type HealthEvent struct {
+	Timestamp  time.Time      `bson:"timestamp" json:"timestamp"`
+	URL        string         `bson:"url" json:"url"`
+	Model      string         `bson:"model" json:"model"`
+	LatencyMs  int64          `bson:"latency_ms" json:"latency_ms"`
+	RemoteAddr string         `bson:"remote_addr,omitempty" json:"remote_addr,omitempty"`
+	Timing     *RequestTiming `bson:"timing,omitempty" json:"timing,omitempty"`
+	Failed     bool           `bson:"failed,omitempty" json:"failed,omitempty"` // the check failed, whether or not it was recorded as a crash
+}
+
+// passedChecks matches the health events of passed checks, including those stored before failed checks were
+var passedChecks = bson.M{"failed": bson.M{"$ne": true}}
+
+// actualCrashes matches the crash_events documents standing for crashes, leaving out restartCircuitOpen markers
+var actualCrashes = bson.M{"crash_type": bson.M{"$ne": "restartCircuitOpen"}}
+
+// loadConfig reads and parses the YAML configuration file, with the named profile merged over it if not empty
+func loadConfig(filename, profile string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	if profile != "" {
+		if data, err = applyProfile(data, profile); err != nil {
+			return nil, err
+		}
+	}
 	var config Config
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
 		return nil, err
 	}
+	if env := os.Getenv("CHECK_INTERVAL"); env != "" {
+		interval, err := parseDuration(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CHECK_INTERVAL: %v", err)
+		}
+		config.Interval = interval
+	}
+	if env := os.Getenv("API_TOKEN"); env != "" {
+		config.APIToken = env
+	}
+	for name, field := range map[string]*string{"MONGO_USERNAME": &config.MongoUsername, "MONGO_PASSWORD": &config.MongoPassword} {
+		if env := os.Getenv(name); env != "" {
+			*field = env
+		}
+	}
+	for name, field := range map[string]*int{"SHARD_INDEX": &config.Shard.Index, "SHARD_COUNT": &config.Shard.Count} {
+		if env := os.Getenv(name); env != "" {
+			value, err := strconv.Atoi(env)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = value
+		}
+	}
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
+// ensureIndexes creates the indexes the event endpoints query by: timestamp for sorting and time ranges, and
+// url and model with timestamp for the filters. Creating an index that already exists with the same keys
+// is a no-op, so this is safe on every startup.
+func ensureIndexes(collections ...*mongo.Collection) error {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "url", Value: 1}, {Key: "timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "model", Value: 1}, {Key: "timestamp", Value: -1}}},
+	}
+	for _, collection := range collections {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		names, err := collection.Indexes().CreateMany(ctx, models)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%s: %v", collection.Name(), err)
+		}
+		slog.Info("Ensured indexes", "collection", collection.Name(), "indexes", names)
+	}
+	return nil
+}
+
+// ensureRetention creates a TTL index on timestamp so MongoDB deletes events older than days.
+// An existing TTL index with another expiry is left alone with a warning, as changing it needs collMod.
+func ensureRetention(days int, collections ...*mongo.Collection) {
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(days * 86400)),
+	}
+	for _, collection := range collections {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		_, err := collection.Indexes().CreateOne(ctx, model)
+		cancel()
+		var cmdErr mongo.CommandError
+		switch {
+		case err == nil:
+			slog.Info("Events expire", "collection", collection.Name(), "retention_days", days)
+		case errors.As(err, &cmdErr) && (cmdErr.Name == "IndexOptionsConflict" || cmdErr.Name == "IndexKeySpecsConflict"):
+			slog.Warn("Collection already has a timestamp_1 index with other options, retention_days is not applied. "+
+				"Drop the index or change its expireAfterSeconds with collMod", "collection", collection.Name(), "retention_days", days, "error", err)
+		default:
+			slog.Error("Failed to create TTL index", "collection", collection.Name(), "error", err)
+		}
+	}
+}
+
+// mongoClientOptions returns the options connecting to MongoDB at uri, with the configured credentials and TLS
+// settings applied over those of the URI. Credentials embedded in the URI, e.g. an Atlas mongodb+srv:// URI, are
+// honored as is when mongo_username is empty.
+func mongoClientOptions(uri string, config *Config) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri)
+	if config.MongoUsername != "" {
+		opts.SetAuth(options.Credential{
+			Username:   config.MongoUsername,
+			Password:   config.MongoPassword,
+			AuthSource: config.MongoAuthSource,
+		})
+	}
+	if config.MongoTLS || config.MongoCAFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.MongoCAFile != "" {
+			pem, err := os.ReadFile(config.MongoCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read mongo_ca_file: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("mongo_ca_file %s contains no PEM certificates", config.MongoCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	return opts, opts.Validate()
+}
+
 // connectMongoDB establishes a connection to MongoDB
-func connectMongoDB(uri string) (*mongo.Client, error) {
-	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+func connectMongoDB(opts *options.ClientOptions) (*mongo.Client, error) {
+	client, err := mongo.Connect(context.Background(), opts)
 	if err != nil {
 		return nil, err
 	}
-	err = client.Ping(context.Background(), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
+	err = client.Ping(ctx, nil)
 	if err != nil {
+		client.Disconnect(context.Background())
 		return nil, err
 	}
 	return client, nil
 }
 
-// checkServer sends a request to an Ollama server, logs a crash event, and attempts a container restart if it fails
-func checkServer(server Server, timeout int, crashCollection, restartCollection *mongo.Collection) {
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout: 5 * time.Second,
-		}).DialContext,
-		ResponseHeaderTimeout: time.Duration(timeout) * time.Second,
+// mongoConnectTimeout bounds each attempt to reach MongoDB at startup
+const mongoConnectTimeout = 10 * time.Second
+
+// connectMongoDBWithRetry connects to MongoDB, retrying up to attempts times delay apart,
+// since Mongo may still be starting when the watcher comes up alongside it
+func connectMongoDBWithRetry(opts *options.ClientOptions, attempts int, delay time.Duration) (*mongo.Client, error) {
+	for attempt := 1; ; attempt++ {
+		client, err := connectMongoDB(opts)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= attempts {
+			return nil, fmt.Errorf("giving up after %d attempts: %v", attempts, err)
+		}
+		slog.Warn("Failed to connect to MongoDB, retrying", "attempt", attempt, "attempts", attempts, "delay", delay.String(), "error", err)
+		time.Sleep(delay)
 	}
-	client := &http.Client{
-		Transport: transport,
+}
+
+// dialContext returns a dial function that connects to the overridden IP for hosts listed in overrides
+func dialContext(dialer *net.Dialer, overrides map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(overrides) == 0 {
+		return dialer.DialContext
 	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := overrides[host]; ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// checkTimeout returns the timeout of a server's checks: its own timeout if set, otherwise the top-level one
+func checkTimeout(server Server, config *Config) time.Duration {
+	if server.Timeout > 0 {
+		return time.Duration(server.Timeout)
+	}
+	return time.Duration(config.Timeout)
+}
+
+// newTransport builds the HTTP transport used to check a server
+func newTransport(server Server, config *Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+	}
+	return &http.Transport{
+		DialContext:           dialContext(dialer, server.DNSOverrides),
+		ResponseHeaderTimeout: checkTimeout(server, config),
+		DisableKeepAlives:     server.DisableKeepAlive,
+	}
+}
+
+// defaultPrompt is the probe message sent to servers
+const defaultPrompt = "create a json response that status is true;just give me json dont explain somthing"
+
+// maxPromptPadding is the largest prompt_padding accepted, in characters
+const maxPromptPadding = 1 << 20
+
+// probePrompt returns the server's prompt or the default one, padded to the server's prompt_padding characters.
+// The filler goes before the instruction so the model still answers it last.
+func probePrompt(server Server) string {
+	prompt := defaultPrompt
+	if server.Prompt != "" {
+		prompt = server.Prompt
+	}
+	fill := server.PromptPadding - len(prompt) - 1
+	if fill <= 0 {
+		return prompt
+	}
+	const filler = "padding "
+	padding := strings.Repeat(filler, fill/len(filler)+1)[:fill]
+	return padding + "\n" + prompt
+}
 
-	payload := struct {
+// probePayload returns the probe request body in the shape the server's api and ollama_api_version expect
+func probePayload(server Server) interface{} {
+	if server.API == "openai" {
+		type message struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}
+		return struct {
+			Model    string    `json:"model"`
+			Messages []message `json:"messages"`
+			Stream   bool      `json:"stream"`
+		}{
+			Model:    server.Model,
+			Messages: []message{{Role: "user", Content: probePrompt(server)}},
+			Stream:   false,
+		}
+	}
+	if server.OllamaAPIVersion == "legacy" {
+		// Servers predating /api/chat only take a prompt and stream unless told otherwise
+		return struct {
+			Model  string `json:"model"`
+			Prompt string `json:"prompt"`
+			Stream bool   `json:"stream"`
+		}{
+			Model:  server.Model,
+			Prompt: probePrompt(server),
+			Stream: false,
+		}
+	}
+
+	return struct {
 		Model    string `json:"model"`
 		Messages []struct {
 			Role    string `json:"role"`
@@ -104,109 +513,855 @@ func checkServer(server Server, timeout int, crashCollection, restartCollection
 		}{
 			{
 				Role:    "user",
-				Content: "create a json response that status is true;just give me json dont explain somthing",
+				Content: probePrompt(server),
 			},
 		},
 	}
-	payloadBytes, err := json.Marshal(payload)
+}
+
+// legacyProbeURL returns the /api/generate URL the legacy payload is sent to, in place of the /api/chat of
+// rawURL, keeping any path prefix in front of it
+func legacyProbeURL(rawURL string) (string, error) {
+	target, err := url.Parse(rawURL)
 	if err != nil {
-		log.Printf("Failed to marshal payload for %s: %v", server.URL, err)
-		return
+		return "", err
+	}
+	if !strings.HasSuffix(target.Path, "/api/generate") {
+		target.Path = strings.TrimSuffix(strings.TrimSuffix(target.Path, "/"), "/api/chat") + "/api/generate"
+		target.RawPath = ""
+	}
+	return target.String(), nil
+}
+
+// newProbeRequest builds the request a check sends: a plain GET of the health path for check_mode "httpget",
+// otherwise a chat probe, or a generate probe to /api/generate with ollama_api_version "legacy"
+func newProbeRequest(server Server) (*http.Request, error) {
+	if server.CheckMode == "httpget" {
+		target, err := url.Parse(server.URL)
+		if err != nil {
+			return nil, err
+		}
+		if server.HealthPath != "" {
+			target = target.ResolveReference(&url.URL{Path: server.HealthPath})
+		}
+		return http.NewRequest("GET", target.String(), nil)
 	}
 
-	req, err := http.NewRequest("POST", server.URL, bytes.NewReader(payloadBytes))
+	payloadBytes, err := json.Marshal(probePayload(server))
 	if err != nil {
-		log.Printf("Failed to create request for %s: %v", server.URL, err)
-		return
+		return nil, err
+	}
+	target := server.URL
+	if server.OllamaAPIVersion == "legacy" && server.API != "openai" {
+		target, err = legacyProbeURL(server.URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout+5)*time.Second)
-	defer cancel()
-	req = req.WithContext(ctx)
+// crash is a failed check to be recorded as a CrashEvent.
+// detail is the error or response that caused it, matched against the configured crash rules.
+type crash struct {
+	event  CrashEvent
+	detail string
+}
+
+// hostRequests limits concurrent probes per target host:port
+var hostRequests = &keyedLimiter{sems: make(map[string]chan struct{})}
+
+// maxRetryShift caps the doubling of retry_delay, so many retries don't overflow or wait for days
+const maxRetryShift = 10
+
+// retryDelay returns the wait before the retry following retry earlier ones: base doubled for each of those,
+// up to maxRetryShift times, then moved by up to jitter of itself either way using random, which returns
+// values in [0, 1) like rand.Float64
+func retryDelay(base time.Duration, retry int, jitter float64, random func() float64) time.Duration {
+	if retry > maxRetryShift {
+		retry = maxRetryShift
+	}
+	delay := base << retry
+	if jitter > 0 {
+		delay += time.Duration(float64(delay) * jitter * (2*random() - 1))
+	}
+	return delay
+}
+
+// checkSlots limits concurrent probes across all servers, see Config.MaxConcurrency
+var checkSlots = &keyedLimiter{sems: make(map[string]chan struct{})}
+
+// checkServer sends a request to an Ollama server and reports whether it responded healthily.
+// A failure that should be recorded as a crash is returned; recording it and restarting the container is up to the caller.
+// Every check is recorded in healthCollection, healthy responses slower than the server's latency_sla in
+// slaCollection, unless they are nil. A check that can't get a max_concurrency slot before deadline, unless zero,
+// is deferred to the next tick: it sends nothing, records nothing and returns neither a pass nor a failure.
+// The check's outcome, streaks and last response are recorded in states.
+func checkServer(server Server, config *Config, deadline time.Time, states *stateStore, slaCollection, healthCollection *mongo.Collection) (passed bool, failure *crash) {
+	var latency time.Duration
+	var remoteAddr string
+	var timing *timingTrace // of the last request attempt
+	deferred := false
+	defer func() {
+		if deferred {
+			return
+		}
+		states.recordCheck(server, config.HealthScore.Window, passed, latency)
+		states.detectRecovery(server)
+		states.detectDegradation(server, config.LatencyTrend)
+		if healthCollection != nil {
+			recordHealthEvent(server, passed, latency, remoteAddr, timing.result(latency), healthCollection)
+		}
+		if passed && slaCollection != nil && server.LatencySLA > 0 && latency > time.Duration(server.LatencySLA) {
+			recordSLAViolation(server, latency, remoteAddr, slaCollection)
+		}
+		states.persist(server)
+	}()
+
+	client := &http.Client{
+		Transport: transportFor(server, config),
+	}
 
-	resp, err := client.Do(req)
+	req, err := newProbeRequest(server)
 	if err != nil {
-		fmt.Printf("err my abo: %v\n", err)
-		crashType := "ollamaTimeouted"
-		if err == context.DeadlineExceeded {
-			crashType = "modelTimeouted"
-		}
-
-		// Log crash event
-		event := CrashEvent{
-			Timestamp: time.Now(),
-			URL:       server.URL,
-			Model:     server.Model,
-			CrashType: crashType,
-		}
-		_, insertErr := crashCollection.InsertOne(context.Background(), event)
-		if insertErr != nil {
-			log.Printf("Failed to insert crash event for %s: %v", server.URL, insertErr)
-		} else {
-			log.Printf("Logged crash event for %s (model: %s, type: %s)", server.URL, server.Model, crashType)
+		slog.Error("Failed to create request", "url", server.URL, "error", err)
+		return false, nil
+	}
+
+	// Endpoints, loaded models and recovery checks can all target the same host at once, and every server's
+	// checks start together on startup and on shared ticks. Wait for slots before the timeout starts so
+	// queueing doesn't count against the server.
+	releaseCheck, ok := checkSlots.acquireBefore("", config.MaxConcurrency, deadline)
+	if !ok {
+		deferred = true
+		slog.Warn("No check slot before the tick deadline, deferring check to the next tick", "url", server.URL, "model", server.Model,
+			"tick_deadline", time.Duration(config.TickDeadline).String())
+		return false, nil
+	}
+	// The slots are given up while waiting to retry, see below
+	defer func() { releaseCheck() }()
+	// Warming and listing models take a host slot per request themselves, so they come before the probe's
+	if server.WarmConnections > 0 {
+		warmConnections(client, server, config, req.URL)
+	}
+
+	// A probe for a model that isn't there times out or fails like a hung server, while it needs a pull rather
+	// than a restart. The probe still runs if the list can't be fetched, its outcome then decides.
+	if server.CheckModelListed && server.CheckMode != "loaded" && server.CheckMode != "httpget" {
+		models, err := fetchAvailableModels(server, config)
+		if err != nil {
+			slog.Warn("Failed to list models, probing anyway", "url", server.URL, "model", server.Model, "error", err)
+		} else if !modelListed(models, server.Model, server.API) {
+			slog.Error("Model not listed by server", "url", server.URL, "model", server.Model, "available", models)
+			return false, &crash{newCrashEvent(server, "modelMissing", ""), fmt.Sprintf("model %s is not listed, available: %s", server.Model, strings.Join(models, ", "))}
 		}
+	}
+	releaseHost := hostRequests.acquire(req.URL.Host, config.MaxRequestsPerHost)
+	defer func() { releaseHost() }()
 
-		// Attempt container restart and log it
-		if server.ContainerName != "" {
-			restartEvent := RestartEvent{
-				Timestamp:     time.Now(),
-				ContainerName: server.ContainerName,
-				URL:           server.URL,
-				Model:         server.Model,
+	// Record which backend the check hit and what the name resolved to, useful behind DNS round-robin
+	// and when DNS drifts. DNSDone runs on the dialing goroutine, hence the lock.
+	var resolvedMu sync.Mutex
+	var resolved []string
+	var gotConn time.Time
+	trace := &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			resolvedMu.Lock()
+			defer resolvedMu.Unlock()
+			for _, addr := range info.Addrs {
+				resolved = append(resolved, addr.String())
 			}
-			cmd := exec.Command("docker", "restart", server.ContainerName)
-			if err := cmd.Run(); err != nil {
-				log.Printf("Failed to restart container %s for server %s: %v", server.ContainerName, server.URL, err)
-				restartEvent.Status = "fail"
-				restartEvent.ErrorMessage = err.Error()
-			} else {
-				log.Printf("Successfully restarted container %s for server %s", server.ContainerName, server.URL)
-				restartEvent.Status = "success"
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			remoteAddr = info.Conn.RemoteAddr().String()
+			gotConn = time.Now()
+		},
+	}
+	resolvedAddrs := func() []string {
+		resolvedMu.Lock()
+		defer resolvedMu.Unlock()
+		return append([]string(nil), resolved...)
+	}
+	retries := 0
+	crashEvent := func(crashType string) CrashEvent {
+		event := newCrashEvent(server, crashType, remoteAddr)
+		event.ResolvedAddrs = resolvedAddrs()
+		event.Retries = retries
+		event.Timing = timing.result(latency)
+		return event
+	}
+
+	// Request errors such as a network blip are retried with exponential backoff before they count as a crash.
+	// Every attempt gets the full timeout. The last attempt's context lives on while its body is read.
+	var resp *http.Response
+	var start time.Time
+	var cancelAttempt context.CancelFunc
+	defer func() { cancelAttempt() }()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout(server, config)+5*time.Second)
+		cancelAttempt = cancel
+		timing = newTimingTrace()
+		start = timing.start
+		gotConn = time.Time{}
+		resp, err = client.Do(req.WithContext(httptrace.WithClientTrace(httptrace.WithClientTrace(ctx, timing.clientTrace()), trace)))
+		latency = time.Since(start)
+		if server.WarmConnections > 0 && !gotConn.IsZero() {
+			// Measure model time only, a connection that still had to be dialed doesn't count
+			latency = time.Since(gotConn)
+		}
+		checkDuration.WithLabelValues(server.URL).Observe(latency.Seconds())
+		if err == nil || retries >= config.Retries {
+			break
+		}
+
+		delay := retryDelay(time.Duration(config.RetryDelay), retries, config.RetryJitter, rand.Float64)
+		retries++
+		slog.Warn("Check failed, retrying", "url", server.URL, "model", server.Model, "retry", retries, "retries", config.Retries, "delay", delay.String(), "error", err)
+		// Other checks get the slots while this one waits
+		cancel()
+		releaseHost()
+		releaseCheck()
+		time.Sleep(delay)
+		releaseCheck = checkSlots.acquire("", config.MaxConcurrency)
+		releaseHost = hostRequests.acquire(req.URL.Host, config.MaxRequestsPerHost)
+		// The previous attempt consumed the request body
+		if req, err = newProbeRequest(server); err != nil {
+			slog.Error("Failed to create request", "url", server.URL, "error", err)
+			return false, nil
+		}
+	}
+	states.recordResolution(server, resolvedAddrs())
+	if err != nil {
+		crashType := requestErrorType(err)
+		slog.Error("Check failed", "url", server.URL, "model", server.Model, "crash_type", crashType, "retries", retries, "error", err)
+		return false, &crash{crashEvent(crashType), err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		states.recordCertificate(server, resp.TLS.PeerCertificates[0], time.Duration(config.CertExpiryWarning))
+	}
+
+	var body []byte
+	// Chat responses are always read to validate their content, other bodies only when something uses them
+	if server.CheckMode != "httpget" || server.successProgram != nil || server.StoreLastResponse || server.ExpectedSubstring != "" || config.DebugResponseContent {
+		var readErr error
+		body, readErr = io.ReadAll(resp.Body)
+		if readErr != nil {
+			slog.Error("Failed to read response", "url", server.URL, "error", readErr)
+		}
+		if server.StoreLastResponse {
+			states.update(server, func(s *serverState) {
+				s.LastResponse = newLastResponse(resp.StatusCode, body, config.LastResponseLimit)
+			})
+		}
+		if config.DebugResponseContent {
+			logResponseContent(server, resp.StatusCode, body, config.LastResponseLimit)
+		}
+	}
+
+	if server.successProgram != nil {
+		healthy, evalErr := evaluateSuccess(server.successProgram, resp.StatusCode, latency, body)
+		if evalErr != nil {
+			slog.Error("Failed to evaluate success_expr", "url", server.URL, "error", evalErr)
+			return false, nil
+		}
+		if !healthy {
+			slog.Warn("Check failed success_expr", "url", server.URL, "model", server.Model, "success_expr", server.SuccessExpr, "status", resp.StatusCode)
+			return false, &crash{crashEvent("criterionFailed"), string(body)}
+		}
+		return true, nil
+	}
+
+	if isHealthyStatus(server, resp.StatusCode) {
+		if server.CheckMode != "httpget" {
+			// A model can answer 200 with an empty or garbled body while it is broken
+			if _, err := validateChatResponse(body, server.API); err != nil {
+				slog.Warn("Invalid response", "url", server.URL, "model", server.Model, "error", err)
+				return false, &crash{crashEvent("invalidResponse"), err.Error() + "\n" + string(body)}
 			}
-			_, insertErr := restartCollection.InsertOne(context.Background(), restartEvent)
-			if insertErr != nil {
-				log.Printf("Failed to insert restart event for container %s: %v", server.ContainerName, insertErr)
-			} else {
-				log.Printf("Logged restart event for container %s (status: %s)", server.ContainerName, restartEvent.Status)
+		}
+		if server.ExpectedSubstring != "" && !bytes.Contains(body, []byte(server.ExpectedSubstring)) {
+			slog.Warn("Response lacks expected substring", "url", server.URL, "model", server.Model, "expected_substring", server.ExpectedSubstring)
+			return false, &crash{crashEvent("criterionFailed"), string(body)}
+		}
+		states.update(server, func(s *serverState) { s.StatusFailures = 0 })
+		return true, nil
+	}
+
+	slog.Warn("Non-healthy status", "url", server.URL, "model", server.Model, "status", resp.StatusCode)
+	// Ollama answers 404 "model ... not found" for models that aren't pulled, OpenAI-compatible servers such as vLLM
+	// "The model ... does not exist"; retrying or restarting won't change that
+	if resp.StatusCode == http.StatusNotFound && (bytes.Contains(body, []byte("not found")) || bytes.Contains(body, []byte("does not exist"))) {
+		return false, &crash{crashEvent("modelNotFound"), resp.Status + "\n" + string(body)}
+	}
+	if server.StatusFailureThreshold <= 0 {
+		return false, nil
+	}
+	state := states.update(server, func(s *serverState) {
+		s.StatusFailures++
+		if s.StatusFailures >= server.StatusFailureThreshold {
+			s.StatusFailures = 0
+		}
+	})
+	if state.StatusFailures != 0 {
+		slog.Info("Non-healthy status not treated as a crash yet", "url", server.URL, "model", server.Model, "status_failures", state.StatusFailures, "threshold", server.StatusFailureThreshold)
+		return false, nil
+	}
+	if body == nil {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	}
+	return false, &crash{crashEvent("unhealthyStatus"), resp.Status + "\n" + string(body)}
+}
+
+// recordHealthEvent inserts a health event for a check. Those of healthy checks are the baseline slowdowns show
+// up against, all of them together what uptime is computed from.
+func recordHealthEvent(server Server, passed bool, latency time.Duration, remoteAddr string, timing *RequestTiming, healthCollection *mongo.Collection) {
+	event := HealthEvent{
+		Timestamp:  time.Now(),
+		URL:        server.URL,
+		Model:      server.Model,
+		LatencyMs:  latency.Milliseconds(),
+		RemoteAddr: remoteAddr,
+		Timing:     timing,
+		Failed:     !passed,
+	}
+	if _, err := healthCollection.InsertOne(context.Background(), event); err != nil {
+		slog.Error("Failed to insert health event", "url", server.URL, "error", err)
+	}
+}
+
+// recordSLAViolation inserts an SLA violation event for a healthy but slow check
+func recordSLAViolation(server Server, latency time.Duration, remoteAddr string, slaCollection *mongo.Collection) {
+	event := SLAViolationEvent{
+		Timestamp:  time.Now(),
+		URL:        server.URL,
+		Model:      server.Model,
+		LatencyMs:  latency.Milliseconds(),
+		SLAMs:      time.Duration(server.LatencySLA).Milliseconds(),
+		RemoteAddr: remoteAddr,
+	}
+	_, insertErr := slaCollection.InsertOne(context.Background(), event)
+	if insertErr != nil {
+		slog.Error("Failed to insert SLA violation event", "url", server.URL, "error", insertErr)
+	} else {
+		slog.Warn("SLA violation", "url", server.URL, "model", server.Model, "latency_ms", event.LatencyMs, "sla_ms", event.SLAMs)
+	}
+	publisher.Publish("sla_violation", event)
+}
+
+// logResponseContent logs the content extracted from a response, at most limit bytes of it cut on a rune boundary.
+// Responses may contain sensitive text, so this only runs with debug_response_content, and the content is
+// logged at debug level so it only shows with log_level debug.
+func logResponseContent(server Server, status int, body []byte, limit int) {
+	content := string(body)
+	if server.CheckMode != "httpget" {
+		content = chatContent(body)
+	}
+	if len(content) > limit {
+		content = truncateUTF8(content, limit) + "...(truncated)"
+	}
+	slog.Debug("Response content", "url", server.URL, "model", server.Model, "status", status, "content", content)
+}
+
+// isHealthyStatus reports whether code is one of the server's healthy status codes
+func isHealthyStatus(server Server, code int) bool {
+	if len(server.HealthyStatusCodes) == 0 {
+		return code == http.StatusOK
+	}
+	for _, healthy := range server.HealthyStatusCodes {
+		if code == healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// newCrashEvent builds a crash event for a server observed now
+func newCrashEvent(server Server, crashType, remoteAddr string) CrashEvent {
+	return CrashEvent{
+		Timestamp:  time.Now(),
+		URL:        server.URL,
+		Model:      server.Model,
+		CrashType:  crashType,
+		RemoteAddr: remoteAddr,
+	}
+}
+
+// requestErrorType classifies an error of a probe request, which client.Do wraps in a *url.Error, as the crash type
+// "dnsFailure", "timeout" (the dial, response header or overall timeout ran out), "connectionRefused" or "other".
+// DNS is looked at first as its lookups can time out too.
+func requestErrorType(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dnsFailure"
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && errors.Is(err, syscall.ECONNREFUSED) {
+		return "connectionRefused"
+	}
+	return "other"
+}
+
+// runCheck checks a server according to its check_mode and endpoints, records any crashes and restarts the container once.
+// It returns the number of crashes found and an error describing them, see crashesError.
+func runCheck(server Server, config *Config, deadline time.Time, crashCollection, restartCollection, slaCollection, healthCollection *mongo.Collection) (int, error) {
+	var crashes []crash
+	if server.CheckMode == "loaded" {
+		crashes = checkLoadedModels(server, config, deadline, slaCollection, healthCollection)
+	} else {
+		crashes = checkEndpoints(server, config, deadline, slaCollection, healthCollection)
+	}
+	if len(crashes) > 0 {
+		handleCrash(server, config, crashes, crashCollection, restartCollection)
+	}
+	return len(crashes), crashesError(crashes)
+}
+
+// maxCrashDetail bounds how much of a crash's detail, often a response body, crashesError includes
+const maxCrashDetail = 200
+
+// truncateUTF8 cuts s to at most limit bytes without splitting a UTF-8 encoded character
+func truncateUTF8(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// crashesError describes crashes as one error, e.g. "timeout on http://gpu-1:11434/api/chat: context deadline
+// exceeded", or returns nil without crashes
+func crashesError(crashes []crash) error {
+	if len(crashes) == 0 {
+		return nil
+	}
+	descriptions := make([]string, len(crashes))
+	for i, c := range crashes {
+		descriptions[i] = c.event.CrashType + " on " + c.event.URL
+		if detail := strings.TrimSpace(c.detail); detail != "" {
+			if len(detail) > maxCrashDetail {
+				detail = truncateUTF8(detail, maxCrashDetail) + "..."
+			}
+			descriptions[i] += ": " + detail
+		}
+	}
+	return errors.New(strings.Join(descriptions, "; "))
+}
+
+// checkEndpoints checks the server's URL and every additional endpoint concurrently and returns the crashes found
+func checkEndpoints(server Server, config *Config, deadline time.Time, slaCollection, healthCollection *mongo.Collection) []crash {
+	endpoints := append([]string{server.URL}, server.Endpoints...)
+	failures := make([]*crash, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			endpointServer := server
+			endpointServer.URL = endpoint
+			_, failures[i] = checkServer(endpointServer, config, deadline, serverStates, slaCollection, healthCollection)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	var crashes []crash
+	for _, failure := range failures {
+		if failure != nil {
+			crashes = append(crashes, *failure)
+		}
+	}
+	return crashes
+}
+
+// checkLoadedModels probes every model listed by the server's /api/ps and returns the crashes found
+func checkLoadedModels(server Server, config *Config, deadline time.Time, slaCollection, healthCollection *mongo.Collection) []crash {
+	models, err := fetchLoadedModels(server, config)
+	if err != nil {
+		slog.Error("Failed to list loaded models", "url", server.URL, "error", err)
+		return []crash{{newCrashEvent(server, "discoveryFailed", ""), err.Error()}}
+	}
+	if len(models) == 0 {
+		if server.NoLoadedModels == "crash" {
+			return []crash{{newCrashEvent(server, "noModelsLoaded", ""), ""}}
+		}
+		slog.Debug("No models loaded, treating as healthy", "url", server.URL)
+		return nil
+	}
+
+	for _, model := range models {
+		modelServer := server
+		modelServer.Model = model
+		// Stop at the first failure, the container is about to be restarted and the remaining models unloaded
+		if passed, failure := checkServer(modelServer, config, deadline, serverStates, slaCollection, healthCollection); !passed {
+			if failure != nil {
+				return []crash{*failure}
 			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// handleCrash logs the crash events of a failed check and restarts the server's container once.
+// The restart is skipped when every crash matched a crash rule that disables restarts, and when a model is
+// missing: with pull_missing_model those models are pulled instead, without it the crash is only recorded.
+func handleCrash(server Server, config *Config, crashes []crash, crashCollection, restartCollection *mongo.Collection) {
+	restart := false
+	for _, c := range crashes {
+		if recordCrash(server, c, config, crashCollection) {
+			restart = true
+		}
+	}
+
+	pulls, restart := recoveryFor(server, crashes, restart)
+	for _, model := range pulls {
+		pullModel(server, model, restartCollection)
+	}
+	if restart {
+		restartContainer(server, config, crashCollection, restartCollection)
+	}
+}
+
+// recoveryFor decides how handleCrash recovers the server: missing models are pulled with pull_missing_model and
+// otherwise only recorded, as a restart can't bring back a model that isn't there. Other crashes restart the
+// server unless the crash rules disabled it.
+func recoveryFor(server Server, crashes []crash, restart bool) (pulls []string, restarts bool) {
+	if models := missingModels(crashes); len(models) > 0 {
+		if !server.PullMissingModel {
+			slog.Warn("Model missing, skipping restart; set pull_missing_model to pull it", "url", server.URL, "models", models)
+			return nil, false
+		}
+		return models, false
+	}
+	if !restart {
+		slog.Info("Crash rules disable restarts, skipping restart", "url", server.URL)
+	}
+	return nil, restart
+}
+
+// missingModels returns the models of the crashes that found their model missing
+func missingModels(crashes []crash) []string {
+	var models []string
+	for _, c := range crashes {
+		if c.event.CrashType == "modelNotFound" || c.event.CrashType == "modelMissing" {
+			models = append(models, c.event.Model)
+		}
+	}
+	return models
+}
+
+// recordCrash applies the crash rules to a crash, inserts its event and reports whether it calls for a restart
+func recordCrash(server Server, c crash, config *Config, crashCollection *mongo.Collection) bool {
+	event := c.event
+	restart := true
+	severity := "warning"
+	if rule := matchCrashRule(config.CrashRules, c.detail); rule != nil {
+		event.CrashType = rule.Type
+		if rule.Restart != nil {
+			restart = *rule.Restart
+		}
+		if rule.Severity != "" {
+			severity = rule.Severity
+		}
+	}
+
+	if server.TagModelMetadata {
+		tagServer := server
+		tagServer.URL, tagServer.Model = event.URL, event.Model
+		tags, err := fetchModelTags(tagServer, config)
+		if err != nil {
+			slog.Warn("Failed to fetch model metadata", "url", event.URL, "error", err)
 		} else {
-			log.Printf("No container_name specified for server %s, skipping restart", server.URL)
+			event.Tags = tags
 		}
+	}
 
-		log.Printf("Error checking server %s (type: %s): %v", server.URL, crashType, err)
-		return
+	if server.MetricsURL != "" {
+		metrics, err := fetchSystemMetrics(server)
+		if err != nil {
+			slog.Warn("Failed to fetch system metrics", "url", event.URL, "metrics_url", server.MetricsURL, "error", err)
+		}
+		if len(metrics) > 0 {
+			event.SystemMetrics = metrics
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Server %s returned non-200 status: %s", server.URL, resp.Status)
+	event.ID = primitive.NewObjectID()
+	var insertErr error
+	// With dedupe_crashes, alerts go out when an ongoing crash starts, not on every check it continues through.
+	// A new OngoingCrash takes the ID of the crash starting it.
+	opened := true
+	if config.DedupeCrashes {
+		opened, insertErr = recordOngoingCrash(event, crashCollection)
+	} else {
+		_, insertErr = crashCollection.InsertOne(context.Background(), event)
+	}
+	crashesTotal.WithLabelValues(event.URL, event.Model, event.CrashType).Inc()
+	if insertErr != nil {
+		slog.Error("Failed to insert crash event", "url", event.URL, "error", insertErr)
+	} else {
+		slog.Error("Crash recorded", "url", event.URL, "model", event.Model, "crash_type", event.CrashType, "container", server.ContainerName, "remote_addr", event.RemoteAddr)
 	}
+	publisher.Publish("crash", event)
+	if opened {
+		notify(severity, crashAlert(event), "crash", alertKey("crash", event.ID), event)
+	}
+	return restart
 }
 
-// startScheduler initiates the cron job to check servers every 30 minutes
-func startScheduler(config *Config, crashCollection, restartCollection *mongo.Collection) {
-	for _, server := range config.Servers {
-		go checkServer(server, config.Timeout, crashCollection, restartCollection)
+// continuesOngoingCrash reports whether a crash continues the server's ongoing crash rather than starting a new one
+func continuesOngoingCrash(state serverState, event CrashEvent) bool {
+	return state.OngoingCrashType != "" && state.OngoingCrashType == event.CrashType
+}
+
+// ongoingCrashUpdate is the upsert counting a crash on an open OngoingCrash: a new one gets the crash's details,
+// an open one only its timestamp, last_seen and count moved on
+func ongoingCrashUpdate(event CrashEvent) (bson.M, error) {
+	raw, err := bson.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	details := bson.M{}
+	if err := bson.Unmarshal(raw, &details); err != nil {
+		return nil, err
 	}
+	// Set by the filter or below on every crash
+	for _, key := range []string{"timestamp", "url", "model", "crash_type"} {
+		delete(details, key)
+	}
+	details["first_seen"] = event.Timestamp
+	return bson.M{
+		"$setOnInsert": details,
+		"$set":         bson.M{"timestamp": event.Timestamp, "last_seen": event.Timestamp},
+		"$inc":         bson.M{"count": 1},
+	}, nil
+}
 
-	c := cron.New()
-	_, err := c.AddFunc("@every 1800s", func() {
-		for _, server := range config.Servers {
-			go checkServer(server, config.Timeout, crashCollection, restartCollection)
+// recordOngoingCrash counts a crash on the server's open OngoingCrash of its crash type, or starts one, in a single
+// upsert keyed by url, model and crash_type. A passed check or a crash of another type ends the open one first.
+// It reports whether the crash started a new one.
+func recordOngoingCrash(event CrashEvent, crashCollection *mongo.Collection) (bool, error) {
+	eventServer := Server{URL: event.URL, Model: event.Model}
+	// Errors still report a crash that would have started a new one, it's worth alerting on even if it
+	// couldn't be stored
+	continues := continuesOngoingCrash(serverStates.get(eventServer), event)
+	if !continues {
+		_, err := crashCollection.UpdateMany(context.Background(), bson.M{"url": event.URL, "model": event.Model, "open": true},
+			bson.M{"$unset": bson.M{"open": ""}})
+		if err != nil {
+			return true, err
 		}
+	}
+
+	update, err := ongoingCrashUpdate(event)
+	if err != nil {
+		return !continues, err
+	}
+	filter := bson.M{"url": event.URL, "model": event.Model, "crash_type": event.CrashType, "open": true}
+	result, err := crashCollection.UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return !continues, err
+	}
+	serverStates.update(eventServer, func(s *serverState) {
+		s.OngoingCrashType = event.CrashType
 	})
+	serverStates.persist(eventServer)
+	return result.UpsertedCount == 1, nil
+}
+
+// startScheduler checks all servers once and then schedules each on its own interval or cron schedule
+func startScheduler(config *Config, crashCollection, restartCollection, slaCollection, healthCollection *mongo.Collection) {
+	scheduler.mu.Lock()
+	scheduler.cron = cron.New()
+	scheduler.startup = time.Now()
+	scheduler.canaryPolicy = config.CanaryPolicy
+	scheduler.tickDeadline = time.Duration(config.TickDeadline)
+	scheduler.mu.Unlock()
+
+	// Each server gets its own entry so it is checked on its own cadence
+	var monitored, disabled []string
+	for _, server := range config.Servers {
+		server := server
+		if server.Enabled != nil && !*server.Enabled {
+			disabled = append(disabled, server.URL)
+			continue
+		}
+		monitored = append(monitored, server.URL)
+		entry, check, err := scheduleServer(server, config, crashCollection, restartCollection, slaCollection, healthCollection)
+		if err != nil {
+			slog.Error("Failed to schedule checks", "url", server.URL, "error", err)
+			os.Exit(1)
+		}
+
+		if server.SkipStartupCheck {
+			slog.Info("Skipping startup check, the server is checked on the first scheduled tick", "url", server.URL)
+			continue
+		}
+		go scheduler.run(entry, scheduler.startup, check)
+	}
+	if config.Digest.Schedule != "" {
+		_, err := scheduler.cron.AddFunc(config.Digest.Schedule, func() {
+			sendDigest(config, crashCollection, restartCollection, healthCollection)
+		})
+		if err != nil {
+			slog.Error("Failed to schedule digest", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Sending digests", "period", time.Duration(config.Digest.Period).String(), "schedule", config.Digest.Schedule)
+	}
+	scheduler.cron.Start()
+	slog.Info("Scheduler started", "servers", monitored)
+	if len(disabled) > 0 {
+		slog.Info("Not monitoring disabled servers", "servers", disabled)
+	}
+}
+
+// scheduleServer registers a server's checks with the scheduler and returns its entry and check function
+func scheduleServer(server Server, config *Config, crashCollection, restartCollection, slaCollection, healthCollection *mongo.Collection) (*scheduledCheck, checkFunc, error) {
+	spec := scheduleSpec(server, config)
+	check := func(deadline time.Time) (int, error) {
+		return runCheck(server, config, deadline, crashCollection, restartCollection, slaCollection, healthCollection)
+	}
+	entry, err := scheduler.add(server, spec, check)
 	if err != nil {
-		log.Fatalf("Failed to schedule job: %v", err)
+		return nil, nil, err
+	}
+	slog.Info("Scheduled checks", "url", server.URL, "model", server.Model, "schedule", spec)
+	return entry, check, nil
+}
+
+// reloadServers brings the scheduled servers in line with a reloaded config: checks of removed, disabled or
+// changed servers are unscheduled, new and changed servers are scheduled and checked right away. Runs in progress
+// finish. New and changed servers are checked with the reloaded top-level settings, unchanged servers keep the
+// previous ones. The shard keeps its value from config until the watcher restarts.
+func reloadServers(reloaded, config *Config, crashCollection, restartCollection, slaCollection, healthCollection *mongo.Collection) {
+	var wanted []Server
+	for _, server := range shardServers(reloaded.Servers, config.Shard) {
+		if server.Enabled == nil || *server.Enabled {
+			wanted = append(wanted, server)
+		}
+	}
+	checks := scheduler.list()
+	scheduled := make([]Server, len(checks))
+	for i, check := range checks {
+		scheduled[i] = check.server
+	}
+	diff := diffServers(scheduled, wanted)
+
+	// Modified servers are unscheduled and scheduled again with their new settings
+	unschedule := make(map[string]bool)
+	for _, ref := range append(diff.Removed, diff.Modified...) {
+		unschedule[serverKey(Server{URL: ref.URL, Model: ref.Model})] = true
 	}
-	c.Start()
-	log.Println("Scheduler started, checking servers every 30 minutes")
+	for _, check := range checks {
+		if unschedule[serverKey(check.server)] {
+			scheduler.remove(check)
+			dropWarmTransports(check.server)
+		}
+	}
+	schedule := make(map[string]bool)
+	for _, ref := range append(diff.Added, diff.Modified...) {
+		schedule[serverKey(Server{URL: ref.URL, Model: ref.Model})] = true
+	}
+	for _, server := range wanted {
+		if !schedule[serverKey(server)] {
+			continue
+		}
+		entry, check, err := scheduleServer(server, reloaded, crashCollection, restartCollection, slaCollection, healthCollection)
+		if err != nil {
+			slog.Error("Failed to schedule checks", "url", server.URL, "error", err)
+			continue
+		}
+		go scheduler.run(entry, time.Now(), check)
+	}
+
+	// Catch Docker misconfiguration of added servers now rather than at their first restart
+	if !reloaded.SkipDockerCheck && len(diff.Added) > 0 {
+		added := *reloaded
+		added.Servers = nil
+		for _, server := range wanted {
+			if addedServer(diff, server) {
+				added.Servers = append(added.Servers, server)
+			}
+		}
+		go checkDockerAccess(&added)
+	}
+
+	setConfiguredServers(shardServers(reloaded.Servers, config.Shard))
+	lastReload.Lock()
+	lastReload.diff = &diff
+	lastReload.Unlock()
+	slog.Info("Reloaded servers, unchanged servers keep the previous settings until restart", "added", diff.Added, "removed", diff.Removed, "modified", diff.Modified)
 }
 
-// fetchEvents is a helper to query events from a MongoDB collection
-func fetchEvents(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, entityType string) {
+// sameServer reports whether two servers have the same configuration, comparing every setting. The compiled
+// success_expr is left out, it follows SuccessExpr but is compiled anew on every load.
+func sameServer(a, b Server) bool {
+	a.successProgram, b.successProgram = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// defaultInterval is how often servers are checked when neither they nor the config set an interval
+const defaultInterval = 30 * time.Minute
+
+// scheduleSpec returns the cron spec a server is checked on
+func scheduleSpec(server Server, config *Config) string {
+	if server.Schedule != "" {
+		return server.Schedule
+	}
+	interval := time.Duration(server.Interval)
+	if interval == 0 {
+		interval = time.Duration(config.Interval)
+	}
+	return "@every " + interval.String()
+}
+
+// fetchEvents is a helper to query events matching filter from a MongoDB collection.
+// ?url= and ?model= restrict the events to exact matches, ?from= and ?to= (RFC3339, inclusive) to a time range;
+// each is optional.
+// ?offset= skips that many events for paging, invalid or negative offsets count as 0.
+// With ?withTotal=true or an offset the number of matching events is returned in the X-Total-Count header.
+// With ?withTotal=true the body is an EventPage carrying it too, instead of the bare array of events.
+func fetchEvents(w http.ResponseWriter, r *http.Request, collection *mongo.Collection, filter bson.M, entityType string) {
 	limitStr := r.URL.Query().Get("limit")
 	sortStr := r.URL.Query().Get("sort")
+	offsetStr := r.URL.Query().Get("offset")
+	pageRequested := r.URL.Query().Get("withTotal") == "true"
+	withTotal := pageRequested || offsetStr != ""
+
+	for _, field := range []string{"url", "model"} {
+		if value := r.URL.Query().Get(field); value != "" {
+			filter[field] = value
+		}
+	}
+
+	timeRange := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s %q, expected an RFC3339 timestamp such as 2006-01-02T15:04:05Z", param, value), http.StatusBadRequest)
+			return
+		}
+		timeRange[op] = t
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
 
 	limit := int64(10)
 	sortOrder := -1 // descending (newest first)
@@ -218,15 +1373,32 @@ func fetchEvents(w http.ResponseWriter, r *http.Request, collection *mongo.Colle
 	if sortStr == "asc" {
 		sortOrder = 1 // ascending (oldest first)
 	}
+	offset := int64(0)
+	if parsedOffset, err := strconv.ParseInt(offsetStr, 10, 64); err == nil && parsedOffset > 0 {
+		offset = parsedOffset
+	}
 
 	findOptions := options.Find()
-	findOptions.SetSort(bson.D{{"timestamp", sortOrder}})
+	findOptions.SetSort(bson.D{{Key: "timestamp", Value: sortOrder}})
 	findOptions.SetLimit(limit)
+	findOptions.SetSkip(offset)
+
+	var total int64
+	if withTotal {
+		var err error
+		total, err = collection.CountDocuments(context.Background(), filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to count %s", entityType), http.StatusInternalServerError)
+			slog.Error("Database count error", "entity", entityType, "error", err)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	}
 
-	cursor, err := collection.Find(context.Background(), bson.M{}, findOptions)
+	cursor, err := collection.Find(context.Background(), filter, findOptions)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to query %s", entityType), http.StatusInternalServerError)
-		log.Printf("Database query error for %s: %v", entityType, err)
+		slog.Error("Database query error", "entity", entityType, "error", err)
 		return
 	}
 	defer cursor.Close(context.Background())
@@ -234,76 +1406,499 @@ func fetchEvents(w http.ResponseWriter, r *http.Request, collection *mongo.Colle
 	var results []bson.M
 	if err = cursor.All(context.Background(), &results); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to decode %s", entityType), http.StatusInternalServerError)
-		log.Printf("Cursor decode error for %s: %v", entityType, err)
+		slog.Error("Cursor decode error", "entity", entityType, "error", err)
 		return
 	}
 
+	var body interface{} = results
+	if pageRequested {
+		if results == nil {
+			results = []bson.M{}
+		}
+		body = EventPage{Events: results, Total: total}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Failed to encode response", "entity", entityType, "error", err)
+	}
+}
+
+// EventPage is the body of an event query with ?withTotal=true
+type EventPage struct {
+	Events []bson.M `json:"events"`
+	Total  int64    `json:"total"` // events matching the query's filter, across all pages
+}
+
+// newAPIServer returns the REST API server, bounding how long a client may take to send its request and to
+// read the response with api_read_timeout and api_write_timeout
+func newAPIServer(addr string, handler http.Handler, config *Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.APIReadTimeout),
+		ReadTimeout:       time.Duration(config.APIReadTimeout),
+		WriteTimeout:      time.Duration(config.APIWriteTimeout),
+	}
+}
+
+// restartFilter builds the GET /restarts filter from its query: status, "success" or "fail", if given
+func restartFilter(query url.Values) (bson.M, error) {
+	filter := bson.M{}
+	switch status := query.Get("status"); status {
+	case "":
+	case "success", "fail":
+		filter["status"] = status
+	default:
+		return nil, fmt.Errorf("Invalid status %q, expected \"success\" or \"fail\"", status)
+	}
+	return filter, nil
+}
+
+// lastResponseHandler serves GET /servers/{url}/lastresponse, where {url} is the path-escaped server URL,
+// e.g. /servers/http:%2F%2Fhost:11434%2Fapi%2Fchat/lastresponse
+func lastResponseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), "/servers/")
+	if !strings.HasSuffix(escaped, "/lastresponse") {
+		http.NotFound(w, r)
+		return
+	}
+	serverURL, err := url.PathUnescape(strings.TrimSuffix(escaped, "/lastresponse"))
+	if err != nil {
+		http.Error(w, "Invalid server URL", http.StatusBadRequest)
+		return
+	}
+	responses := lastResponses(serverURL)
+	if len(responses) == 0 {
+		http.Error(w, "No stored response for server", http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(w).Encode(results); err != nil {
-		log.Printf("Failed to encode %s response: %v", entityType, err)
+	if err := json.NewEncoder(w).Encode(responses); err != nil {
+		slog.Error("Failed to encode last response", "error", err)
 	}
 }
 
+// shutdownGrace is how long running checks get to finish on SIGINT or SIGTERM
+const shutdownGrace = 30 * time.Second
+
+// defaultConfigPath is where the watcher reads its configuration from unless told otherwise
+const defaultConfigPath = "/usr/share/llm-watcher/config.yaml"
+
 func main() {
-	// Load configuration from /usr/share/llm-watcher/config.yaml
-	config, err := loadConfig("/usr/share/llm-watcher/config.yaml")
+	// Get the config error behaviour from the environment, overridable by flag
+	onConfigErrorDefault := os.Getenv("CONFIG_ERROR_MODE")
+	if onConfigErrorDefault == "" {
+		onConfigErrorDefault = "exit"
+	}
+	// Log with LOG_LEVEL and LOG_FORMAT until the config may change them
+	setupLogging("", "")
+
+	configPathDefault := os.Getenv("CONFIG_PATH")
+	if configPathDefault == "" {
+		configPathDefault = defaultConfigPath
+	}
+
+	configFlag := flag.String("config", configPathDefault, "config file to load, defaults to $CONFIG_PATH or "+defaultConfigPath)
+	validateOnly := flag.Bool("validate", false, "validate the config file and exit without starting the watcher")
+	onConfigError := flag.String("on-config-error", onConfigErrorDefault, `when the config cannot be loaded: "exit", or "serve" to report the error on /healthz and retry until it loads`)
+	profile := flag.String("profile", os.Getenv("ACTIVE_PROFILE"), "config profile to merge over the base config, defaults to $ACTIVE_PROFILE")
+	testNotifiersOnly := flag.Bool("test-notifiers", false, "send a test message through Slack and every webhook, report the outcome per channel and exit")
+	flag.Parse()
+	configPath := *configFlag
+	if *onConfigError != "exit" && *onConfigError != "serve" {
+		slog.Error("Invalid -on-config-error, must be \"exit\" or \"serve\"", "value", *onConfigError)
+		os.Exit(1)
+	}
+
+	// Load configuration from -config, $CONFIG_PATH or /usr/share/llm-watcher/config.yaml
+	config, err := loadConfig(configPath, *profile)
+	if *validateOnly {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Config %s is invalid:\n%v\n", configPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Config %s is valid (%d servers)\n", configPath, len(config.Servers))
+		os.Exit(0)
+	}
+	if *testNotifiersOnly {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Config %s is invalid:\n%v\n", configPath, err)
+			os.Exit(1)
+		}
+		slackWebhookURL = config.SlackWebhookURL
+		webhooks = config.Webhooks
+		results := testNotifiers()
+		if len(results) == 0 {
+			fmt.Println("No notifiers configured")
+		}
+		failed := false
+		for _, result := range results {
+			if result.OK {
+				fmt.Printf("%s: ok\n", result.Channel)
+			} else {
+				fmt.Printf("%s: failed: %s\n", result.Channel, result.Error)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		if *onConfigError != "serve" {
+			slog.Error("Failed to load config", "error", err)
+			os.Exit(1)
+		}
+		config = waitForConfig(":8080", configPath, *profile, err)
+	}
+	setupLogging(config.LogLevel, config.LogFormat)
+	if *profile != "" {
+		slog.Info("Using config profile", "profile", *profile)
+	}
+	if config.Shard.Count > 1 {
+		total := len(config.Servers)
+		config.Servers = shardServers(config.Servers, config.Shard)
+		slog.Info("Checking shard", "index", config.Shard.Index, "count", config.Shard.Count, "servers", len(config.Servers), "total_servers", total)
 	}
+	setConfiguredServers(config.Servers)
 
-	// Get MongoDB URL from environment variable or default to container hostname
+	// Get MongoDB URL from environment variable or default to container hostname.
+	// The URL may hold credentials, so it is never logged.
 	mongoURL := os.Getenv("MONGO_URL")
 	if mongoURL == "" {
 		mongoURL = "mongodb://mongo:27017"
 	}
+	mongoOptions, err := mongoClientOptions(mongoURL, config)
+	if err != nil {
+		slog.Error("Invalid MongoDB settings", "error", err)
+		os.Exit(1)
+	}
 
 	// Connect to MongoDB
-	mongoClient, err := connectMongoDB(mongoURL)
+	mongoClient, err := connectMongoDBWithRetry(mongoOptions, config.MongoConnectAttempts, time.Duration(config.MongoConnectDelay))
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		slog.Error("Failed to connect to MongoDB", "error", err)
+		os.Exit(1)
 	}
 	db := mongoClient.Database("ollama_monitor")
 	crashCollection := db.Collection("crash_events")
 	restartCollection := db.Collection("restart_events")
+	slaCollection := db.Collection("sla_events")
+	healthCollection := db.Collection("health_events")
+	if err := ensureIndexes(crashCollection, restartCollection, slaCollection, healthCollection); err != nil {
+		slog.Warn("Failed to create indexes, event queries may be slow", "error", err)
+	}
+	if config.RetentionDays > 0 {
+		ensureRetention(config.RetentionDays, crashCollection, restartCollection, slaCollection, healthCollection)
+	}
+
+	// Pick up where the previous run left off before the first checks
+	if err := serverStates.restore(db.Collection("server_state"), config); err != nil {
+		slog.Warn("Failed to restore server state, starting fresh", "error", err)
+	}
+
+	slackWebhookURL = config.SlackWebhookURL
+	webhooks = config.Webhooks
+	quietHours = config.QuietHours
+	sentAlerts.setWindow(time.Duration(config.NotifyDedupWindow))
+
+	// Publish events to NATS if configured
+	if config.Publisher.NATSURL != "" {
+		natsPublisher, err := newNATSPublisher(config.Publisher)
+		if err != nil {
+			slog.Error("Failed to connect to NATS, events will not be published", "error", err)
+		} else {
+			publisher = natsPublisher
+			slog.Info("Publishing events to NATS", "subjects", config.Publisher.Subject+".*")
+		}
+	}
+
+	// Catch Docker misconfiguration now rather than at the first restart
+	if !config.SkipDockerCheck {
+		checkDockerAccess(config)
+	}
 
 	// Start the scheduler in a goroutine
-	go startScheduler(config, crashCollection, restartCollection)
+	go startScheduler(config, crashCollection, restartCollection, slaCollection, healthCollection)
+	go watchConfig(configPath, *profile, func(reloaded *Config) {
+		reloadServers(reloaded, config, crashCollection, restartCollection, slaCollection, healthCollection)
+	})
 
 	// Set up REST API
 	http.HandleFunc("/crashes", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			fetchEvents(w, r, crashCollection, "crash events")
+			fetchEvents(w, r, crashCollection, bson.M{}, "crash events")
 
 		case http.MethodDelete:
-			result, err := crashCollection.DeleteMany(context.Background(), bson.M{})
+			// ?id= deletes one event, ?before= (RFC3339) those older than it, and ?all=true every event
+			query := r.URL.Query()
+			filter := bson.M{}
+			message := "All crash events deleted"
+			switch {
+			case query.Get("id") != "":
+				id, err := primitive.ObjectIDFromHex(query.Get("id"))
+				if err != nil {
+					http.Error(w, "Invalid id", http.StatusBadRequest)
+					return
+				}
+				filter["_id"] = id
+				message = "Crash event " + id.Hex() + " deleted"
+			case query.Get("before") != "":
+				before, err := time.Parse(time.RFC3339, query.Get("before"))
+				if err != nil {
+					http.Error(w, "Invalid before, expected an RFC3339 timestamp such as 2006-01-02T15:04:05Z", http.StatusBadRequest)
+					return
+				}
+				filter["timestamp"] = bson.M{"$lt": before}
+				message = "Crash events before " + before.Format(time.RFC3339) + " deleted"
+			case query.Get("all") != "true":
+				http.Error(w, "Pass id, before or all=true to choose the crash events to delete", http.StatusBadRequest)
+				return
+			}
+
+			result, err := crashCollection.DeleteMany(context.Background(), filter)
 			if err != nil {
 				http.Error(w, "Failed to delete crash events", http.StatusInternalServerError)
-				log.Printf("Delete error: %v", err)
+				slog.Error("Delete error", "error", err)
 				return
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"message":      "All crash events deleted",
+				"message":      message,
 				"deletedCount": result.DeletedCount,
 			})
-			log.Printf("Deleted %d crash events", result.DeletedCount)
+			slog.Info("Deleted crash events", "count", result.DeletedCount)
 
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(serverStatuses(config.HealthScore)); err != nil {
+			slog.Error("Failed to encode status response", "error", err)
+		}
+	})
+
 	http.HandleFunc("/restarts", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			filter, err := restartFilter(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fetchEvents(w, r, restartCollection, filter, "restart events")
+
+		case http.MethodDelete:
+			result, err := restartCollection.DeleteMany(context.Background(), bson.M{})
+			if err != nil {
+				http.Error(w, "Failed to delete restart events", http.StatusInternalServerError)
+				slog.Error("Delete error", "error", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"message":      "All restart events deleted",
+				"deletedCount": result.DeletedCount,
+			})
+			slog.Info("Deleted restart events", "count", result.DeletedCount)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/sla", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fetchEvents(w, r, slaCollection, bson.M{}, "SLA violation events")
+	})
+
+	http.HandleFunc("/health-events", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		fetchEvents(w, r, restartCollection, "restart events")
+		fetchEvents(w, r, healthCollection, passedChecks, "health events")
 	})
 
-	log.Println("Starting REST API server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	http.HandleFunc("/scheduler", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(scheduler.entries()); err != nil {
+			slog.Error("Failed to encode scheduler response", "error", err)
+		}
+	})
+
+	http.HandleFunc("/digest", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		period := time.Duration(config.Digest.Period)
+		if periodStr := r.URL.Query().Get("period"); periodStr != "" {
+			parsed, err := time.ParseDuration(periodStr)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Invalid period", http.StatusBadRequest)
+				return
+			}
+			period = parsed
+		}
+		digest, err := buildDigest(period, currentServers(), crashCollection, restartCollection, healthCollection)
+		if err != nil {
+			http.Error(w, "Failed to build digest", http.StatusInternalServerError)
+			slog.Error("Digest error", "error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(digest); err != nil {
+			slog.Error("Failed to encode digest response", "error", err)
+		}
+	})
+
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var since time.Time
+		if value := r.URL.Query().Get("since"); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid since %q, expected an RFC3339 timestamp such as 2006-01-02T15:04:05Z", value), http.StatusBadRequest)
+				return
+			}
+			since = parsed
+		}
+		stats, err := buildStats(since, crashCollection, restartCollection, healthCollection)
+		if err != nil {
+			http.Error(w, "Failed to compute stats", http.StatusInternalServerError)
+			slog.Error("Stats error", "error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			slog.Error("Failed to encode stats response", "error", err)
+		}
+	})
+
+	http.HandleFunc("/uptime", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		until := time.Now()
+		since := until.Add(-defaultUptimeWindow)
+		for param, t := range map[string]*time.Time{"since": &since, "until": &until} {
+			value := r.URL.Query().Get(param)
+			if value == "" {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s %q, expected an RFC3339 timestamp such as 2006-01-02T15:04:05Z", param, value), http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+		if !since.Before(until) {
+			http.Error(w, "since must be before until", http.StatusBadRequest)
+			return
+		}
+		uptimes, err := buildUptime(currentServers(), since, until, healthCollection)
+		if err != nil {
+			http.Error(w, "Failed to compute uptime", http.StatusInternalServerError)
+			slog.Error("Uptime error", "error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(uptimes); err != nil {
+			slog.Error("Failed to encode uptime response", "error", err)
+		}
+	})
+
+	http.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(certStatuses(time.Duration(config.CertExpiryWarning))); err != nil {
+			slog.Error("Failed to encode certs response", "error", err)
+		}
+	})
+
+	http.HandleFunc("/breakers", breakersHandler(config.MaxRestartsPerHour))
+	http.HandleFunc("/test/notify", testNotifyHandler)
+	http.HandleFunc("/reload", reloadHandler)
+	http.HandleFunc("/grafana/crashes", grafanaCrashesHandler(crashCollection))
+	http.HandleFunc("/grafana/latency", grafanaLatencyHandler)
+
+	http.HandleFunc("/healthz", healthzHandler(mongoClient, time.Duration(config.MongoUnavailableGrace)))
+	http.HandleFunc("/health", mongoHealthHandler(mongoClient))
+	http.HandleFunc("/metrics", metricsHandler)
+
+	// /servers/ paths carry an escaped URL that ServeMux would clean and redirect, so route them first
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/servers/") {
+			lastResponseHandler(w, r)
+			return
+		}
+		http.DefaultServeMux.ServeHTTP(w, r)
+	})
+	var apiHandler http.Handler = handler
+	if config.APIToken != "" {
+		apiHandler = requireToken(handler, config.APIToken, config.APIOpenReads)
 	}
-}
\ No newline at end of file
+	if len(config.AllowedOrigins) > 0 {
+		apiHandler = allowCORS(apiHandler, config.AllowedOrigins)
+	}
+
+	server := newAPIServer(":8080", apiHandler, config)
+	go func() {
+		slog.Info("Starting REST API server", "addr", ":8080")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Failed to start server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Shut down without cutting off running checks, restarts or inserts
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	slog.Info("Shutting down", "signal", sig.String())
+	if !scheduler.stop(shutdownGrace) {
+		slog.Warn("Checks still running, shutting down anyway", "grace", shutdownGrace.String())
+	}
+	if !recoveries.stop(shutdownGrace) {
+		slog.Warn("Recovery verifications still running, shutting down anyway", "grace", shutdownGrace.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shut down REST API server", "error", err)
+	}
+	if err := mongoClient.Disconnect(ctx); err != nil {
+		slog.Error("Failed to disconnect from MongoDB", "error", err)
+	}
+	slog.Info("Shutdown complete")
+}
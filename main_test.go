@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/exp/slog"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    int
+		jitter   float64
+		min, max time.Duration
+	}{
+		{"first retry", 0, 0, time.Second, time.Second},
+		{"doubled", 3, 0, 8 * time.Second, 8 * time.Second},
+		{"shift capped", 70, 0, time.Second << maxRetryShift, time.Second << maxRetryShift},
+		{"jittered", 2, 0.25, 3 * time.Second, 5 * time.Second},
+		{"jittered and capped", 100, 0.5, (time.Second << maxRetryShift) / 2, (time.Second << maxRetryShift) * 3 / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(1)).Float64
+			for i := 0; i < 100; i++ {
+				got := retryDelay(time.Second, tt.retry, tt.jitter, random)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay(1s, %d, %v) = %v, want within [%v, %v]", tt.retry, tt.jitter, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelayJitterIsSeeded(t *testing.T) {
+	first := rand.New(rand.NewSource(42)).Float64
+	second := rand.New(rand.NewSource(42)).Float64
+	varied := false
+	for i := 0; i < 10; i++ {
+		a := retryDelay(time.Second, 1, 0.5, first)
+		b := retryDelay(time.Second, 1, 0.5, second)
+		if a != b {
+			t.Fatalf("same seed gave %v and %v", a, b)
+		}
+		if a != 2*time.Second {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Error("jitter never moved the delay")
+	}
+}
+
+func TestTickDeadlineDefersChecksWithoutSlot(t *testing.T) {
+	var requests int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(`{"response":"ok","done":true}`))
+	}))
+	defer slow.Close()
+
+	config := &Config{MaxConcurrency: 1, TickDeadline: Duration(50 * time.Millisecond)}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	server := Server{URL: slow.URL + "/a", Model: "llama3", Endpoints: []string{slow.URL + "/b", slow.URL + "/c", slow.URL + "/d"}}
+
+	start := time.Now()
+	crashes := checkEndpoints(server, config, start.Add(time.Duration(config.TickDeadline)), nil, nil)
+	if len(crashes) != 0 {
+		t.Errorf("deferred checks reported crashes: %+v", crashes)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("%d slow servers probed with one slot and a deadline shorter than a probe, want 1", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("tick took %v, deferred checks should not wait for a slot", elapsed)
+	}
+}
+
+func TestRestartFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    bson.M
+		wantErr bool
+	}{
+		{query: "", want: bson.M{}},
+		{query: "status=success", want: bson.M{"status": "success"}},
+		{query: "status=fail", want: bson.M{"status": "fail"}},
+		{query: "status=skipped", wantErr: true},
+		{query: "status=FAIL", wantErr: true},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := restartFilter(query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("restartFilter(%q) error = %v, want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("restartFilter(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestNewProbeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		server     Server
+		wantURL    string
+		wantFields []string
+	}{
+		{
+			name:       "current",
+			server:     Server{URL: "http://gpu-1:11434/api/chat", Model: "llama3"},
+			wantURL:    "http://gpu-1:11434/api/chat",
+			wantFields: []string{"messages", "model"},
+		},
+		{
+			name:       "legacy",
+			server:     Server{URL: "http://gpu-1:11434/api/chat", Model: "llama3", OllamaAPIVersion: "legacy"},
+			wantURL:    "http://gpu-1:11434/api/generate",
+			wantFields: []string{"model", "prompt", "stream"},
+		},
+		{
+			name:       "legacy behind a path prefix",
+			server:     Server{URL: "https://proxy/ollama/api/chat/", Model: "llama3", OllamaAPIVersion: "legacy"},
+			wantURL:    "https://proxy/ollama/api/generate",
+			wantFields: []string{"model", "prompt", "stream"},
+		},
+		{
+			name:       "legacy already at generate",
+			server:     Server{URL: "http://gpu-1:11434/api/generate", Model: "llama3", OllamaAPIVersion: "legacy"},
+			wantURL:    "http://gpu-1:11434/api/generate",
+			wantFields: []string{"model", "prompt", "stream"},
+		},
+		{
+			name:       "openai",
+			server:     Server{URL: "http://vllm:8000/v1/chat/completions", Model: "llama3", API: "openai"},
+			wantURL:    "http://vllm:8000/v1/chat/completions",
+			wantFields: []string{"messages", "model", "stream"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newProbeRequest(tt.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Method != http.MethodPost || req.URL.String() != tt.wantURL {
+				t.Errorf("request = %s %s, want POST %s", req.Method, req.URL, tt.wantURL)
+			}
+			var payload map[string]interface{}
+			if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for field := range payload {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("payload fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestCheckServerRecordsIntoGivenStore(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+	}))
+	defer healthy.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	server := Server{URL: healthy.URL + "/api/chat", Model: "verify-probe"}
+
+	scratch := newStateStore()
+	passed, failure := checkServer(server, config, time.Time{}, scratch, nil, nil)
+	if !passed || failure != nil {
+		t.Fatalf("checkServer() = %v, %+v, want a pass", passed, failure)
+	}
+	if got := scratch.get(server); got.SuccessStreak != 1 {
+		t.Errorf("scratch store success streak = %d, want 1", got.SuccessStreak)
+	}
+	for _, state := range serverStates.all() {
+		if state.URL == server.URL {
+			t.Errorf("recovery probe recorded in serverStates: %+v", state)
+		}
+	}
+}
+
+func TestLogResponseContentTruncatesOnRuneBoundary(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	tests := []struct {
+		name  string
+		body  string
+		limit int
+		want  string
+	}{
+		{"short", "héllo", 10, "héllo"},
+		{"ascii cut", "hello world", 5, "hello...(truncated)"},
+		{"cut inside a rune", "héllo", 2, "h...(truncated)"},
+		{"cut after a rune", "héllo", 3, "hé...(truncated)"},
+		{"cut inside an emoji", "ok 👍", 5, "ok ...(truncated)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			logResponseContent(Server{URL: "http://a", CheckMode: "httpget"}, http.StatusOK, []byte(tt.body), tt.limit)
+			var entry struct {
+				Content string `json:"content"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("log %q: %v", logs.String(), err)
+			}
+			if entry.Content != tt.want {
+				t.Errorf("content = %q, want %q", entry.Content, tt.want)
+			}
+			if !utf8.ValidString(entry.Content) {
+				t.Errorf("content %q is not valid UTF-8", entry.Content)
+			}
+		})
+	}
+}
+
+func TestCheckServerReleasesSlotsWhileWaitingToRetry(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL := down.URL
+	down.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+	}))
+	defer healthy.Close()
+
+	config := &Config{MaxConcurrency: 1, Retries: 1, RetryDelay: Duration(500 * time.Millisecond)}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	failing := make(chan *crash, 1)
+	go func() {
+		_, failure := checkServer(Server{URL: downURL + "/api/chat", Model: "llama3"}, config, time.Time{}, newStateStore(), nil, nil)
+		failing <- failure
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The failing check is waiting to retry, its slot must be free for this one well before the retry
+	start := time.Now()
+	passed, _ := checkServer(Server{URL: healthy.URL + "/api/chat", Model: "llama3"}, config, start.Add(200*time.Millisecond), newStateStore(), nil, nil)
+	if !passed {
+		t.Error("healthy server not checked while the failing one waited to retry")
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("check waited %v for the slot held by a check waiting to retry", elapsed)
+	}
+	if failure := <-failing; failure == nil || failure.event.Retries != 1 {
+		t.Errorf("failing check = %+v, want a crash after one retry", failure)
+	}
+}
+
+func TestContinuesOngoingCrash(t *testing.T) {
+	tests := []struct {
+		name  string
+		state serverState
+		crash string
+		want  bool
+	}{
+		{"no ongoing crash", serverState{}, "timeout", false},
+		{"same type", serverState{OngoingCrashType: "timeout"}, "timeout", true},
+		{"other type", serverState{OngoingCrashType: "timeout"}, "http_500", false},
+	}
+	for _, tt := range tests {
+		if got := continuesOngoingCrash(tt.state, CrashEvent{CrashType: tt.crash}); got != tt.want {
+			t.Errorf("%s: continuesOngoingCrash() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOngoingCrashUpdate(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	id := primitive.NewObjectID()
+	update, err := ongoingCrashUpdate(CrashEvent{ID: id, Timestamp: at, URL: "http://a", Model: "llama3", CrashType: "timeout", RemoteAddr: "10.0.0.1:11434", Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert, _ := update["$setOnInsert"].(bson.M)
+	for _, key := range []string{"timestamp", "url", "model", "crash_type", "last_seen", "count"} {
+		if _, ok := insert[key]; ok {
+			t.Errorf("$setOnInsert sets %s, which the filter, $set or $inc set", key)
+		}
+	}
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{"remote_addr", "10.0.0.1:11434"},
+		{"retries", int32(2)},
+		{"first_seen", at},
+		{"_id", id}, // of the crash starting it, its alert is keyed on it
+	}
+	for _, tt := range tests {
+		if got := insert[tt.key]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("$setOnInsert %s = %#v, want %#v", tt.key, got, tt.want)
+		}
+	}
+	if !reflect.DeepEqual(update["$set"], bson.M{"timestamp": at, "last_seen": at}) {
+		t.Errorf("$set = %v, want timestamp and last_seen", update["$set"])
+	}
+	if !reflect.DeepEqual(update["$inc"], bson.M{"count": 1}) {
+		t.Errorf("$inc = %v, want count 1", update["$inc"])
+	}
+}
+
+func TestStateStoreGetDoesNotTrack(t *testing.T) {
+	store := newStateStore()
+	server := Server{URL: "http://a", Model: "llama3"}
+	if got := store.get(server); got.URL != server.URL || got.Model != server.Model || got.FailureStreak != 0 {
+		t.Errorf("get() of an unknown server = %+v, want its zero state", got)
+	}
+	if states := store.all(); len(states) != 0 {
+		t.Errorf("get() started tracking the server: %+v", states)
+	}
+	store.recordCheck(server, 10, false, time.Second)
+	if got := store.get(server); got.FailureStreak != 1 {
+		t.Errorf("failure streak = %d, want 1", got.FailureStreak)
+	}
+}
+
+func TestRequestErrorType(t *testing.T) {
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "http://gpu-1:11434/api/chat", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"dns", urlErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "gpu-1", IsNotFound: true}}), "dnsFailure"},
+		{"dns timeout", urlErr(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", Name: "gpu-1", IsTimeout: true}}), "dnsFailure"},
+		{"overall timeout", urlErr(context.DeadlineExceeded), "timeout"},
+		{"read timeout", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), "timeout"},
+		{"refused", urlErr(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), "connectionRefused"},
+		{"reset", urlErr(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), "other"},
+		{"other", urlErr(io.ErrUnexpectedEOF), "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestErrorType(tt.err); got != tt.want {
+				t.Errorf("requestErrorType(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestErrorTypeRefusedDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	_, err = http.Get("http://" + addr + "/api/chat")
+	if err == nil {
+		t.Fatal("request to a closed port succeeded")
+	}
+	if got := requestErrorType(err); got != "connectionRefused" {
+		t.Errorf("requestErrorType(%v) = %q, want connectionRefused", err, got)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		addr      string
+		wantErr   bool
+	}{
+		{"overridden host", map[string]string{"llm.invalid": "127.0.0.1"}, "llm.invalid:" + port, false},
+		{"other host resolved", map[string]string{"other.invalid": "10.255.255.1"}, "127.0.0.1:" + port, false},
+		{"no overrides", nil, "127.0.0.1:" + port, false},
+		{"unresolvable host", map[string]string{"other.invalid": "127.0.0.1"}, "llm.invalid:" + port, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := dialContext(&net.Dialer{Timeout: time.Second}, tt.overrides)
+			conn, err := dial(context.Background(), "tcp", tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dial(%s) error = %v, want error %v", tt.addr, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if got := conn.RemoteAddr().String(); got != listener.Addr().String() {
+				t.Errorf("connected to %s, want %s", got, listener.Addr())
+			}
+		})
+	}
+}
+
+func TestCheckServerStatusFailureThreshold(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	server := Server{URL: failing.URL + "/api/chat", Model: "llama3", StatusFailureThreshold: 3}
+	states := newStateStore()
+
+	// The returned crash is what handleCrash restarts the server for
+	for i := 1; i <= 2*server.StatusFailureThreshold; i++ {
+		passed, failure := checkServer(server, config, time.Time{}, states, nil, nil)
+		if passed {
+			t.Fatalf("check %d passed", i)
+		}
+		atThreshold := i%server.StatusFailureThreshold == 0
+		if atThreshold && (failure == nil || failure.event.CrashType != "unhealthyStatus") {
+			t.Errorf("check %d = %+v, want an unhealthyStatus crash at the threshold", i, failure)
+		}
+		if !atThreshold && failure != nil {
+			t.Errorf("check %d = %+v crashed below the threshold", i, failure)
+		}
+	}
+}
+
+func TestCheckLoadedModels(t *testing.T) {
+	tests := []struct {
+		name           string
+		ps             string // /api/ps response, "" for a 500
+		noLoadedModels string
+		wantProbed     []string
+		wantCrash      string // crash type, "" for none
+	}{
+		{
+			name:       "every loaded model probed",
+			ps:         `{"models":[{"name":"llama3:latest","model":"llama3:latest"},{"name":"mistral:latest"}]}`,
+			wantProbed: []string{"llama3:latest", "mistral:latest"},
+		},
+		{
+			name:       "broken loaded model",
+			ps:         `{"models":[{"model":"llama3:latest"},{"model":"broken:latest"},{"model":"mistral:latest"}]}`,
+			wantProbed: []string{"llama3:latest", "broken:latest"},
+			wantCrash:  "invalidResponse",
+		},
+		{name: "none loaded", ps: `{"models":[]}`},
+		{name: "none loaded, crash", ps: `{"models":[]}`, noLoadedModels: "crash", wantCrash: "noModelsLoaded"},
+		{name: "discovery failing", wantCrash: "discoveryFailed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var probed []string
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/ps":
+					if tt.ps == "" {
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					w.Write([]byte(tt.ps))
+				case "/api/chat":
+					var req struct {
+						Model string `json:"model"`
+					}
+					json.NewDecoder(r.Body).Decode(&req)
+					mu.Lock()
+					probed = append(probed, req.Model)
+					mu.Unlock()
+					if req.Model == "broken:latest" {
+						w.Write([]byte(`{"message":{"content":""},"done":true}`))
+						return
+					}
+					w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+				}
+			}))
+			defer backend.Close()
+			config := &Config{}
+			if err := validateConfig(config); err != nil {
+				t.Fatal(err)
+			}
+			oldStates := serverStates
+			serverStates = newStateStore()
+			t.Cleanup(func() { serverStates = oldStates })
+
+			server := Server{URL: backend.URL + "/api/chat", CheckMode: "loaded", NoLoadedModels: tt.noLoadedModels}
+			crashes := checkLoadedModels(server, config, time.Time{}, nil, nil)
+			got := ""
+			if len(crashes) > 0 {
+				got = crashes[0].event.CrashType
+			}
+			if len(crashes) > 1 || got != tt.wantCrash {
+				t.Errorf("crashes = %+v, want %q", crashes, tt.wantCrash)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(probed, tt.wantProbed) {
+				t.Errorf("probed %v, want %v", probed, tt.wantProbed)
+			}
+		})
+	}
+}
+
+func TestCheckEndpointsRestartsOnce(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":""},"done":true}`))
+	}))
+	defer broken.Close()
+	var restarts int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/restart") {
+			atomic.AddInt32(&restarts, 1)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer daemon.Close()
+
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	oldStates, oldRecoveries := serverStates, recoveries
+	serverStates, recoveries = newStateStore(), newRecoveryTracker()
+	t.Cleanup(func() {
+		recoveries.stop(time.Second)
+		serverStates, recoveries = oldStates, oldRecoveries
+	})
+	server := Server{
+		URL:              healthy.URL + "/api/chat",
+		Endpoints:        []string{broken.URL + "/api/chat", broken.URL + "/v2/api/chat"},
+		Model:            "llama3",
+		ContainerName:    "multi-endpoint",
+		DockerHost:       "tcp://" + strings.TrimPrefix(daemon.URL, "http://"),
+		PostRestartDelay: Duration(time.Hour),
+	}
+
+	crashes := checkEndpoints(server, config, time.Time{}, nil, nil)
+	if len(crashes) != 2 {
+		t.Fatalf("got %d crashes, want one per failing endpoint: %+v", len(crashes), crashes)
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("restart", func(mt *mtest.T) {
+		for i := 0; i < 3; i++ {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+		}
+		handleCrash(server, config, crashes, mt.Coll, mt.Coll)
+	})
+	if got := atomic.LoadInt32(&restarts); got != 1 {
+		t.Errorf("container restarted %d times, want once", got)
+	}
+}
+
+func TestCheckServerRecordsRemoteAddr(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"message":{"content":""},"done":true}`))
+	}))
+	defer broken.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(broken.Listener.Addr().String())
+	tests := []struct {
+		name   string
+		server Server
+	}{
+		{"direct", Server{URL: broken.URL + "/api/chat", Model: "llama3"}},
+		{"dns override", Server{URL: "http://llm.invalid:" + port + "/api/chat", Model: "llama3", DNSOverrides: map[string]string{"llm.invalid": "127.0.0.1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, failure := checkServer(tt.server, config, time.Time{}, newStateStore(), nil, nil)
+			if failure == nil {
+				t.Fatal("check passed")
+			}
+			if got := failure.event.RemoteAddr; got != broken.Listener.Addr().String() {
+				t.Errorf("crash remote address = %q, want %q", got, broken.Listener.Addr())
+			}
+		})
+	}
+}
+
+func TestStartSchedulerSkipsStartupChecks(t *testing.T) {
+	var mu sync.Mutex
+	probed := make(map[string]int)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		probed[req.Model]++
+		mu.Unlock()
+		w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+	}))
+	defer backend.Close()
+	config := &Config{Servers: []Server{
+		{URL: backend.URL + "/api/chat", Model: "checked-on-boot"},
+		{URL: backend.URL + "/api/chat", Model: "skipped-on-boot", SkipStartupCheck: true},
+	}}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	oldScheduler, oldStates := scheduler, serverStates
+	scheduler, serverStates = newCheckScheduler(), newStateStore()
+	t.Cleanup(func() {
+		scheduler.stop(time.Second)
+		scheduler, serverStates = oldScheduler, oldStates
+	})
+
+	startScheduler(config, nil, nil, nil, nil)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if entries := scheduler.entries(); len(entries) == 2 && entries[0].Runs+entries[1].Runs == 1 {
+			break
+		}
+	}
+	// Give a startup check of the skipped server the time to show up too
+	time.Sleep(50 * time.Millisecond)
+	scheduler.stop(time.Second)
+	mu.Lock()
+	defer mu.Unlock()
+	if probed["checked-on-boot"] != 1 || probed["skipped-on-boot"] != 0 {
+		t.Errorf("probed on startup %v, want only checked-on-boot", probed)
+	}
+	if entries := scheduler.entries(); len(entries) != 2 {
+		t.Errorf("%d servers scheduled, want both", len(entries))
+	}
+}
+
+func TestNewTransportKeepAlive(t *testing.T) {
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, disabled := range []bool{false, true} {
+		var conns int32
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+		}))
+		backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns, 1)
+			}
+		}
+		backend.Start()
+
+		transport := newTransport(Server{DisableKeepAlive: disabled}, config)
+		if transport.DisableKeepAlives != disabled {
+			t.Errorf("disable_keep_alive %v: DisableKeepAlives = %v", disabled, transport.DisableKeepAlives)
+		}
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 3; i++ {
+			resp, err := client.Get(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		transport.CloseIdleConnections()
+		backend.Close()
+
+		want := int32(1)
+		if disabled {
+			want = 3
+		}
+		if got := atomic.LoadInt32(&conns); got != want {
+			t.Errorf("disable_keep_alive %v: 3 requests opened %d connections, want %d", disabled, got, want)
+		}
+	}
+}
+
+func TestFetchEventsWithTotal(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	ns := func(mt *mtest.T) string { return mt.Coll.Database().Name() + "." + mt.Coll.Name() }
+	events := []bson.D{
+		{{Key: "url", Value: "http://a"}, {Key: "crash_type", Value: "timeout"}},
+		{{Key: "url", Value: "http://a"}, {Key: "crash_type", Value: "unhealthyStatus"}},
+	}
+
+	mt.Run("with total", func(mt *mtest.T) {
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, bson.D{{Key: "n", Value: int32(5)}}),
+			mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, events...),
+		)
+		rec := httptest.NewRecorder()
+		fetchEvents(rec, httptest.NewRequest(http.MethodGet, "/crashes?withTotal=true&url=http://a&limit=2", nil), mt.Coll, bson.M{}, "crash events")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		count := mt.GetStartedEvent()
+		if count == nil || count.CommandName != "aggregate" {
+			t.Fatalf("first command %v, want the count", count)
+		}
+		if match := count.Command.Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match").Document(); match.Lookup("url").StringValue() != "http://a" {
+			t.Errorf("counted %s, want the filtered events", match)
+		}
+		var page EventPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 5 || len(page.Events) != 2 {
+			t.Errorf("page = %d events of %d, want 2 of 5", len(page.Events), page.Total)
+		}
+		if got := rec.Header().Get("X-Total-Count"); got != "5" {
+			t.Errorf("X-Total-Count = %q, want 5", got)
+		}
+	})
+
+	mt.Run("without total", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, events...))
+		rec := httptest.NewRecorder()
+		fetchEvents(rec, httptest.NewRequest(http.MethodGet, "/crashes", nil), mt.Coll, bson.M{}, "crash events")
+		var got []bson.M
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatalf("body is not an array of events: %v", err)
+		}
+		if len(got) != 2 || rec.Header().Get("X-Total-Count") != "" {
+			t.Errorf("got %d events, X-Total-Count %q, want 2 and none", len(got), rec.Header().Get("X-Total-Count"))
+		}
+		if started := mt.GetAllStartedEvents(); len(started) != 1 || started[0].CommandName != "find" {
+			t.Errorf("ran %d commands, want only the find", len(started))
+		}
+	})
+}
+
+func TestAPIServerTimeouts(t *testing.T) {
+	config := &Config{APIReadTimeout: Duration(100 * time.Millisecond)}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.APIWriteTimeout != Duration(30*time.Second) {
+		t.Errorf("api_write_timeout defaults to %v, want 30s", time.Duration(config.APIWriteTimeout))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newAPIServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config)
+	go server.Serve(listener)
+	defer server.Close()
+
+	// A client trickling its request is cut off after api_read_timeout
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Write([]byte("GET /status HTTP/1.1\r\nHost: watcher\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	io.Copy(io.Discard, conn)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("incomplete request kept open for %v, want it closed after api_read_timeout", elapsed)
+	}
+}
+
+func TestScheduleSpec(t *testing.T) {
+	config := &Config{Interval: Duration(30 * time.Minute)}
+	tests := []struct {
+		name   string
+		server Server
+		want   string
+	}{
+		{"global interval", Server{}, "@every 30m0s"},
+		{"own interval", Server{Interval: Duration(90 * time.Second)}, "@every 1m30s"},
+		{"cron schedule", Server{Schedule: "*/5 * * * *"}, "*/5 * * * *"},
+		{"schedule over interval", Server{Schedule: "@hourly", Interval: Duration(time.Minute)}, "@hourly"},
+	}
+	for _, tt := range tests {
+		if got := scheduleSpec(tt.server, config); got != tt.want {
+			t.Errorf("%s: scheduleSpec() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProbePrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  Server
+		wantLen int
+	}{
+		{"default", Server{}, len(defaultPrompt)},
+		{"own prompt", Server{Prompt: "say ok"}, len("say ok")},
+		{"padding shorter than the prompt", Server{Prompt: "say ok", PromptPadding: 3}, len("say ok")},
+		{"no room for padding", Server{Prompt: "say ok", PromptPadding: 7}, len("say ok")},
+		{"one character of padding", Server{Prompt: "say ok", PromptPadding: 8}, 8},
+		{"padded", Server{Prompt: "say ok", PromptPadding: 4096}, 4096},
+		{"padded default", Server{PromptPadding: 1000}, 1000},
+	}
+	for _, tt := range tests {
+		got := probePrompt(tt.server)
+		if len(got) != tt.wantLen {
+			t.Errorf("%s: probePrompt() is %d characters, want %d", tt.name, len(got), tt.wantLen)
+		}
+		prompt := tt.server.Prompt
+		if prompt == "" {
+			prompt = defaultPrompt
+		}
+		if !strings.HasSuffix(got, prompt) {
+			t.Errorf("%s: probePrompt() = %q, want it to end with the instruction", tt.name, got)
+		}
+	}
+}
+
+func TestCheckServerRecordsSLAViolations(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		if r.URL.Query().Get("broken") != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+	}))
+	defer slow.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query string
+		sla   time.Duration
+		want  bool
+	}{
+		{"within the sla", "", 50 * time.Millisecond, false},
+		{"slower than the sla", "?slow=1", 50 * time.Millisecond, true},
+		{"no sla", "?slow=1", 0, false},
+		{"slow failure", "?slow=1&broken=1", 50 * time.Millisecond, false},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			server := Server{URL: slow.URL + "/api/chat" + tt.query, Model: "llama3", LatencySLA: Duration(tt.sla)}
+			checkServer(server, config, time.Time{}, newStateStore(), mt.Coll, nil)
+			started := mt.GetStartedEvent()
+			if (started != nil) != tt.want {
+				t.Fatalf("recorded %v, want an SLA violation %v", started, tt.want)
+			}
+			if started == nil {
+				return
+			}
+			doc := started.Command.Lookup("documents").Array().Index(0).Value().Document()
+			if sla := doc.Lookup("sla_ms").Int64(); sla != 50 {
+				t.Errorf("sla_ms = %d, want 50", sla)
+			}
+			if latency := doc.Lookup("latency_ms").Int64(); latency < 60 {
+				t.Errorf("latency_ms = %d, want at least 60", latency)
+			}
+		})
+	}
+}
+
+func TestCheckServerHTTPGet(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.URL.Path {
+		case "/health":
+			w.Write([]byte("OK"))
+		case "/warming":
+			w.Write([]byte("loading model"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		server     Server
+		wantPassed bool
+		wantCrash  string
+	}{
+		{"plain text", Server{URL: backend.URL + "/api/chat", HealthPath: "/health"}, true, ""},
+		{"url as the health path", Server{URL: backend.URL + "/health"}, true, ""},
+		{"expected substring", Server{URL: backend.URL, HealthPath: "/health", ExpectedSubstring: "OK"}, true, ""},
+		{"expected substring missing", Server{URL: backend.URL, HealthPath: "/warming", ExpectedSubstring: "OK"}, false, "criterionFailed"},
+		{"not found", Server{URL: backend.URL, HealthPath: "/missing", StatusFailureThreshold: 1}, false, "unhealthyStatus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.server.CheckMode = "httpget"
+			passed, failure := checkServer(tt.server, config, time.Time{}, newStateStore(), nil, nil)
+			got := ""
+			if failure != nil {
+				got = failure.event.CrashType
+			}
+			if passed != tt.wantPassed || got != tt.wantCrash {
+				t.Errorf("checkServer() = %v, %q, want %v, %q", passed, got, tt.wantPassed, tt.wantCrash)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Prometheus metrics served on /metrics, incremented alongside the events stored in MongoDB
+var (
+	crashesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llm_watcher_crashes_total",
+		Help: "Crash events recorded, by server, model and crash type.",
+	}, []string{"url", "model", "crash_type"})
+
+	restartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "llm_watcher_restarts_total",
+		Help: "Container restarts attempted, by container and status.",
+	}, []string{"container", "status"})
+
+	restartDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "llm_watcher_restart_duration_seconds",
+		Help:    "Duration of restart commands, by status. Slow restarts point at an unhealthy Docker daemon.",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+	}, []string{"status"})
+
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "llm_watcher_check_duration_seconds",
+		Help:    "Duration of probe requests, including retried attempts, by server.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"url"})
+)
+
+// urlGatherer gathers only the series of gatherer labelled with url, dropping families without such series
+func urlGatherer(gatherer prometheus.Gatherer, url string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := gatherer.Gather()
+		filtered := make([]*dto.MetricFamily, 0, len(families))
+		for _, family := range families {
+			var metrics []*dto.Metric
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "url" && label.GetValue() == url {
+						metrics = append(metrics, metric)
+						break
+					}
+				}
+			}
+			if len(metrics) > 0 {
+				family.Metric = metrics
+				filtered = append(filtered, family)
+			}
+		}
+		return filtered, err
+	})
+}
+
+// metricsHandler serves /metrics, limited to the series of one server with ?url=. Scrapers sending
+// Accept: application/openmetrics-text get the OpenMetrics format, others the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	gatherer := prometheus.DefaultGatherer
+	if url := r.URL.Query().Get("url"); url != "" {
+		gatherer = urlGatherer(gatherer, url)
+	}
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(w, r)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerFiltersByURL(t *testing.T) {
+	crashesTotal.WithLabelValues("http://gpu-1:11434", "llama3", "timeout").Inc()
+	crashesTotal.WithLabelValues("http://gpu-2:11434", "llama3", "timeout").Inc()
+	checkDuration.WithLabelValues("http://gpu-1:11434").Observe(1)
+	restartsTotal.WithLabelValues("ollama-1", "success").Inc()
+
+	tests := []struct {
+		name     string
+		query    string
+		want     []string
+		unwanted []string
+	}{
+		{
+			name:  "unfiltered",
+			query: "",
+			want:  []string{`url="http://gpu-1:11434"`, `url="http://gpu-2:11434"`, "llm_watcher_restarts_total"},
+		},
+		{
+			name:     "one server",
+			query:    "?url=http://gpu-1:11434",
+			want:     []string{`llm_watcher_crashes_total{crash_type="timeout",model="llama3",url="http://gpu-1:11434"}`, "llm_watcher_check_duration_seconds_count"},
+			unwanted: []string{"gpu-2", "llm_watcher_restarts_total", "go_goroutines"},
+		},
+		{
+			name:     "unknown server",
+			query:    "?url=http://nowhere",
+			unwanted: []string{"llm_watcher_", "go_goroutines"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d", rec.Code)
+			}
+			body := rec.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("output lacks %s", s)
+				}
+			}
+			for _, s := range tt.unwanted {
+				if strings.Contains(body, s) {
+					t.Errorf("output contains %s", s)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerNegotiatesFormat(t *testing.T) {
+	crashesTotal.WithLabelValues("http://gpu-1:11434", "llama3", "timeout").Inc()
+	tests := []struct {
+		accept      string
+		contentType string
+		eof         bool // OpenMetrics ends with "# EOF"
+	}{
+		{accept: "", contentType: "text/plain; version=0.0.4"},
+		{accept: "text/plain", contentType: "text/plain; version=0.0.4"},
+		{accept: "application/openmetrics-text; version=1.0.0", contentType: "application/openmetrics-text; version=1.0.0", eof: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		metricsHandler(rec, req)
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Errorf("Accept %q: Content-Type %q, want %q", tt.accept, got, tt.contentType)
+		}
+		if eof := strings.HasSuffix(rec.Body.String(), "# EOF\n"); eof != tt.eof {
+			t.Errorf("Accept %q: ends with # EOF = %v, want %v", tt.accept, eof, tt.eof)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/exp/slog"
+)
+
+// NotifierResult is the outcome of sending a test message through one notifier, as reported by
+// POST /test/notify and -test-notifiers
+type NotifierResult struct {
+	Channel string `json:"channel"` // "slack" or "webhook <url>"
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// TestEvent is the event webhooks receive from a notifier test, with kind "test"
+type TestEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+}
+
+// testMessage is the text of notifier tests
+const testMessage = "llm-watcher notifier test, alerts are delivered to this channel"
+
+// testNotifiers sends a test message through Slack and every webhook concurrently and waits for each
+// delivery, so a misconfigured notifier shows up before a real crash depends on it
+func testNotifiers() []NotifierResult {
+	var channels []string
+	var sends []func() error
+	if slackWebhookURL != "" {
+		webhookURL := slackWebhookURL
+		channels = append(channels, "slack")
+		sends = append(sends, func() error { return sendSlack(webhookURL, ":white_check_mark: "+testMessage) })
+	}
+	event := TestEvent{Timestamp: time.Now(), Message: testMessage}
+	for _, webhook := range webhooks {
+		webhook := webhook
+		channels = append(channels, "webhook "+webhook.URL)
+		sends = append(sends, func() error { return deliverWebhook(webhook, "test", "", event) })
+	}
+
+	results := make([]NotifierResult, len(sends))
+	var wg sync.WaitGroup
+	for i, send := range sends {
+		wg.Add(1)
+		go func(i int, send func() error) {
+			defer wg.Done()
+			results[i] = NotifierResult{Channel: channels[i], OK: true}
+			if err := send(); err != nil {
+				results[i].OK = false
+				results[i].Error = err.Error()
+			}
+		}(i, send)
+	}
+	wg.Wait()
+	return results
+}
+
+// testNotifyHandler serves POST /test/notify, sending a test message through every notifier and reporting the
+// outcome per channel. It answers 502 if any delivery failed.
+func testNotifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	results := testNotifiers()
+	w.Header().Set("Content-Type", "application/json")
+	for _, result := range results {
+		if !result.OK {
+			w.WriteHeader(http.StatusBadGateway)
+			break
+		}
+	}
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		slog.Error("Failed to encode notifier test response", "error", err)
+	}
+}
+
+// severities ranks alert severities, see QuietHoursConfig.MinSeverity and CrashRule.Severity
+var severities = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+// QuietHoursConfig holds back alerts below a severity during a daily time range, such as overnight. Held back
+// alerts are logged, and sent as one summary when the quiet hours end.
+type QuietHoursConfig struct {
+	Start       string `yaml:"start"`        // "22:00", empty disables quiet hours
+	End         string `yaml:"end"`          // "07:00", before start for a range spanning midnight
+	Timezone    string `yaml:"timezone"`     // IANA name such as "Europe/Amsterdam", default UTC
+	MinSeverity string `yaml:"min_severity"` // alerts of this severity or above are still sent, "warning" or "critical" (default)
+
+	start, end int            // minutes into the day, set by validateConfig
+	location   *time.Location // loaded Timezone, set by validateConfig
+}
+
+// compileQuietHours checks the quiet hours settings and parses their times
+func compileQuietHours(quiet *QuietHoursConfig) error {
+	if quiet.Start == "" && quiet.End == "" {
+		return nil
+	}
+	var err error
+	if quiet.start, err = parseClock(quiet.Start); err != nil {
+		return fmt.Errorf("start: %v", err)
+	}
+	if quiet.end, err = parseClock(quiet.End); err != nil {
+		return fmt.Errorf("end: %v", err)
+	}
+	if quiet.start == quiet.end {
+		return fmt.Errorf("start and end must differ")
+	}
+	if quiet.location, err = time.LoadLocation(quiet.Timezone); err != nil {
+		return fmt.Errorf("timezone: %v", err)
+	}
+	if quiet.MinSeverity == "" {
+		quiet.MinSeverity = "critical"
+	}
+	if _, ok := severities[quiet.MinSeverity]; !ok || quiet.MinSeverity == "info" {
+		return fmt.Errorf("min_severity must be \"warning\" or \"critical\"")
+	}
+	return nil
+}
+
+// parseClock parses a time of day such as "07:30" into minutes into the day
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day such as \"07:30\"", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// holds reports whether an alert of severity is held back at now
+func (q QuietHoursConfig) holds(severity string, now time.Time) bool {
+	if q.location == nil || severities[severity] >= severities[q.MinSeverity] {
+		return false
+	}
+	local := now.In(q.location)
+	minute := local.Hour()*60 + local.Minute()
+	if q.start < q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// nextEnd returns the first end of the quiet hours after now
+func (q QuietHoursConfig) nextEnd(now time.Time) time.Time {
+	local := now.In(q.location)
+	end := time.Date(local.Year(), local.Month(), local.Day(), q.end/60, q.end%60, 0, 0, q.location)
+	if !end.After(local) {
+		end = time.Date(local.Year(), local.Month(), local.Day()+1, q.end/60, q.end%60, 0, 0, q.location)
+	}
+	return end
+}
+
+// quietHours are the quiet hours alerts are held back in, set by main from Config.QuietHours
+var quietHours QuietHoursConfig
+
+// heldAlerts are the alerts held back during the current quiet hours, sent by sendHeldAlerts when they end
+var heldAlerts = struct {
+	sync.Mutex
+	alerts []string
+	timer  *time.Timer
+}{}
+
+// QuietHoursSummary is the event webhooks receive with kind "quiet_hours_summary" when quiet hours end
+type QuietHoursSummary struct {
+	Timestamp time.Time `json:"timestamp"`
+	Alerts    []string  `json:"alerts"` // the Slack text of each held back alert, oldest first
+}
+
+// alertKey derives the idempotency key of an alert of kind from the ID of the event it is about: re-sends of
+// the alert share it, alerts about other events, even identical crashes, don't
+func alertKey(kind string, id primitive.ObjectID) string {
+	return kind + "|" + id.Hex()
+}
+
+// alertDedup remembers when alerts were sent by idempotency key, to suppress re-sends within its window
+type alertDedup struct {
+	sync.Mutex
+	window time.Duration
+	sent   map[string]time.Time
+}
+
+// sentAlerts are the alerts sent within the last notify_dedup_window, its window set by main
+var sentAlerts = &alertDedup{window: 10 * time.Minute, sent: make(map[string]time.Time)}
+
+// setWindow sets the window re-sends are suppressed in
+func (d *alertDedup) setWindow(window time.Duration) {
+	d.Lock()
+	d.window = window
+	d.Unlock()
+}
+
+// first reports whether no alert with the key was sent within the window before now and, if so,
+// records it as sent now. Expired keys are dropped on the way.
+func (d *alertDedup) first(key string, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+	for k, sent := range d.sent {
+		if now.Sub(sent) >= d.window {
+			delete(d.sent, k)
+		}
+	}
+	if _, ok := d.sent[key]; ok {
+		return false
+	}
+	d.sent[key] = now
+	return true
+}
+
+// notify sends an alert to Slack and every webhook, unless quiet hours hold back alerts of its severity
+// or an alert with the same idempotency key was sent within notify_dedup_window.
+// msg is the Slack text, kind and event what webhooks receive, key the idempotency key, empty for none.
+func notify(severity, msg, kind, key string, event interface{}) {
+	now := time.Now()
+	if key != "" && !sentAlerts.first(key, now) {
+		slog.Debug("Suppressing repeated alert", "kind", kind, "key", key)
+		return
+	}
+	if quietHours.holds(severity, now) {
+		slog.Info("Holding back alert during quiet hours", "kind", kind, "severity", severity, "alert", msg)
+		heldAlerts.Lock()
+		heldAlerts.alerts = append(heldAlerts.alerts, msg)
+		if heldAlerts.timer == nil {
+			heldAlerts.timer = time.AfterFunc(quietHours.nextEnd(now).Sub(now), sendHeldAlerts)
+		}
+		heldAlerts.Unlock()
+		return
+	}
+	notifySlack(msg)
+	notifyWebhooks(kind, key, event)
+}
+
+// sendHeldAlerts sends the alerts held back during quiet hours as one summary
+func sendHeldAlerts() {
+	heldAlerts.Lock()
+	alerts := heldAlerts.alerts
+	heldAlerts.alerts = nil
+	if heldAlerts.timer != nil {
+		heldAlerts.timer.Stop()
+		heldAlerts.timer = nil
+	}
+	heldAlerts.Unlock()
+	if len(alerts) == 0 {
+		return
+	}
+	slog.Info("Quiet hours over, sending held back alerts", "alerts", len(alerts))
+	notifySlack(fmt.Sprintf(":sunrise: %d alerts were held back during quiet hours:\n%s", len(alerts), strings.Join(alerts, "\n")))
+	notifyWebhooks("quiet_hours_summary", "", QuietHoursSummary{Timestamp: time.Now(), Alerts: alerts})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// withNotifiers sets the Slack webhook and webhooks for the duration of a test
+func withNotifiers(t *testing.T, slack string, hooks []WebhookConfig) {
+	t.Helper()
+	oldSlack, oldWebhooks := slackWebhookURL, webhooks
+	slackWebhookURL, webhooks = slack, hooks
+	t.Cleanup(func() { slackWebhookURL, webhooks = oldSlack, oldWebhooks })
+}
+
+// receiver is an httptest server answering status and counting the requests it got
+func receiver(t *testing.T, status int, hits *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTestNotifiers(t *testing.T) {
+	tests := []struct {
+		name          string
+		slackStatus   int // 0 for no Slack webhook
+		webhookStatus []int
+		wantOK        []bool
+	}{
+		{name: "nothing configured"},
+		{name: "slack ok", slackStatus: http.StatusOK, wantOK: []bool{true}},
+		{name: "slack failing", slackStatus: http.StatusForbidden, wantOK: []bool{false}},
+		{name: "webhooks", webhookStatus: []int{http.StatusNoContent, http.StatusInternalServerError}, wantOK: []bool{true, false}},
+		{name: "all channels", slackStatus: http.StatusOK, webhookStatus: []int{http.StatusOK}, wantOK: []bool{true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slackHits, webhookHits int32
+			slack := ""
+			if tt.slackStatus != 0 {
+				slack = receiver(t, tt.slackStatus, &slackHits).URL
+			}
+			var hooks []WebhookConfig
+			for _, status := range tt.webhookStatus {
+				hook := WebhookConfig{URL: receiver(t, status, &webhookHits).URL}
+				if err := compileWebhook(&hook); err != nil {
+					t.Fatal(err)
+				}
+				hooks = append(hooks, hook)
+			}
+			withNotifiers(t, slack, hooks)
+
+			results := testNotifiers()
+			if len(results) != len(tt.wantOK) {
+				t.Fatalf("got %d results, want %d: %+v", len(results), len(tt.wantOK), results)
+			}
+			for i, result := range results {
+				if result.OK != tt.wantOK[i] {
+					t.Errorf("%s: ok = %v, want %v (error %q)", result.Channel, result.OK, tt.wantOK[i], result.Error)
+				}
+				if !result.OK && result.Error == "" {
+					t.Errorf("%s: failure without an error", result.Channel)
+				}
+			}
+			if tt.slackStatus != 0 && slackHits != 1 {
+				t.Errorf("Slack got %d requests, want 1", slackHits)
+			}
+			if int(webhookHits) != len(tt.webhookStatus) {
+				t.Errorf("webhooks got %d requests, want %d", webhookHits, len(tt.webhookStatus))
+			}
+		})
+	}
+}
+
+func TestTestNotifyHandler(t *testing.T) {
+	var hits int32
+	withNotifiers(t, "", []WebhookConfig{{URL: receiver(t, http.StatusBadGateway, &hits).URL, Method: http.MethodPost}})
+
+	rec := httptest.NewRecorder()
+	testNotifyHandler(rec, httptest.NewRequest(http.MethodGet, "/test/notify", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	rec = httptest.NewRecorder()
+	testNotifyHandler(rec, httptest.NewRequest(http.MethodPost, "/test/notify", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("POST with a failing webhook: status %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	var results []NotifierResult
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].OK || !strings.HasPrefix(results[0].Channel, "webhook ") {
+		t.Errorf("results = %+v, want one failed webhook", results)
+	}
+}
+
+func TestQuietHoursHolds(t *testing.T) {
+	amsterdam, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	tests := []struct {
+		name     string
+		quiet    QuietHoursConfig
+		severity string
+		now      time.Time
+		want     bool
+	}{
+		{"disabled", QuietHoursConfig{}, "info", time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), false},
+		{"overnight, late", QuietHoursConfig{Start: "22:00", End: "07:00"}, "warning", time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), true},
+		{"overnight, early", QuietHoursConfig{Start: "22:00", End: "07:00"}, "warning", time.Date(2024, 5, 1, 6, 59, 0, 0, time.UTC), true},
+		{"overnight, at end", QuietHoursConfig{Start: "22:00", End: "07:00"}, "warning", time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC), false},
+		{"overnight, daytime", QuietHoursConfig{Start: "22:00", End: "07:00"}, "warning", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+		{"critical is sent", QuietHoursConfig{Start: "22:00", End: "07:00"}, "critical", time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), false},
+		{"min severity warning", QuietHoursConfig{Start: "22:00", End: "07:00", MinSeverity: "warning"}, "warning", time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), false},
+		{"min severity warning holds info", QuietHoursConfig{Start: "22:00", End: "07:00", MinSeverity: "warning"}, "info", time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), true},
+		{"same day range", QuietHoursConfig{Start: "12:00", End: "13:00"}, "info", time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), true},
+		// 21:30 UTC is 23:30 in Amsterdam in summer
+		{"timezone", QuietHoursConfig{Start: "22:00", End: "07:00", Timezone: "Europe/Amsterdam"}, "warning", time.Date(2024, 7, 1, 21, 30, 0, 0, time.UTC), true},
+		{"timezone, daytime", QuietHoursConfig{Start: "22:00", End: "07:00", Timezone: "Europe/Amsterdam"}, "warning", time.Date(2024, 7, 1, 5, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quiet := tt.quiet
+			if err := compileQuietHours(&quiet); err != nil {
+				t.Fatal(err)
+			}
+			if got := quiet.holds(tt.severity, tt.now); got != tt.want {
+				t.Errorf("holds(%q, %v) = %v, want %v", tt.severity, tt.now.In(amsterdam), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileQuietHoursRejects(t *testing.T) {
+	tests := []QuietHoursConfig{
+		{Start: "22:00"},
+		{Start: "25:00", End: "07:00"},
+		{Start: "22:00", End: "22:00"},
+		{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"},
+		{Start: "22:00", End: "07:00", MinSeverity: "info"},
+	}
+	for _, quiet := range tests {
+		if err := compileQuietHours(&quiet); err == nil {
+			t.Errorf("compileQuietHours(%+v) accepted an invalid config", quiet)
+		}
+	}
+}
+
+func TestQuietHoursNextEnd(t *testing.T) {
+	quiet := QuietHoursConfig{Start: "22:00", End: "07:00"}
+	if err := compileQuietHours(&quiet); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		now, want time.Time
+	}{
+		{time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 7, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 5, 31, 22, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := quiet.nextEnd(tt.now); !got.Equal(tt.want) {
+			t.Errorf("nextEnd(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyHoldsAlertsUntilQuietHoursEnd(t *testing.T) {
+	received := make(chan webhookData, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data webhookData
+		json.NewDecoder(r.Body).Decode(&data)
+		received <- data
+	}))
+	defer hook.Close()
+	hooks := []WebhookConfig{{URL: hook.URL}}
+	if err := compileWebhook(&hooks[0]); err != nil {
+		t.Fatal(err)
+	}
+	withNotifiers(t, "", hooks)
+
+	// Quiet hours around now, whatever time the test runs at
+	now := time.Now().UTC()
+	quiet := QuietHoursConfig{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}
+	if err := compileQuietHours(&quiet); err != nil {
+		t.Fatal(err)
+	}
+	oldQuiet := quietHours
+	quietHours = quiet
+	t.Cleanup(func() { quietHours = oldQuiet })
+
+	notify("warning", "crash on a", "crash", "", CrashEvent{URL: "http://a"})
+	notify("critical", "restart failed on b", "restart_failed", "", RestartEvent{URL: "http://b"})
+	select {
+	case data := <-received:
+		if data.Kind != "restart_failed" {
+			t.Errorf("received %q during quiet hours, want only the critical restart_failed", data.Kind)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("critical alert not delivered during quiet hours")
+	}
+	select {
+	case data := <-received:
+		t.Fatalf("received %q during quiet hours, want it held back", data.Kind)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The end of the quiet hours
+	sendHeldAlerts()
+	select {
+	case data := <-received:
+		if data.Kind != "quiet_hours_summary" {
+			t.Fatalf("received %q after quiet hours, want quiet_hours_summary", data.Kind)
+		}
+		event, _ := data.Event.(map[string]interface{})
+		alerts, _ := event["alerts"].([]interface{})
+		if len(alerts) != 1 || alerts[0] != "crash on a" {
+			t.Errorf("summary alerts = %v, want the held back crash", event["alerts"])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("held back alerts not delivered after quiet hours")
+	}
+}
+
+func TestAlertDedupSuppressesRepeatedKeys(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		key   string
+		after time.Duration
+		want  bool
+	}{
+		{"first alert", "crash|http://a|llama3|timeout", 0, true},
+		{"repeated within the window", "crash|http://a|llama3|timeout", time.Minute, false},
+		{"other crash type", "crash|http://a|llama3|http_500", time.Minute, true},
+		{"other server", "crash|http://b|llama3|timeout", time.Minute, true},
+		{"still within the window", "crash|http://a|llama3|timeout", 9 * time.Minute, false},
+		{"window over", "crash|http://a|llama3|timeout", 10 * time.Minute, true},
+	}
+	dedup := &alertDedup{window: 10 * time.Minute, sent: make(map[string]time.Time)}
+	for _, tt := range tests {
+		if got := dedup.first(tt.key, base.Add(tt.after)); got != tt.want {
+			t.Errorf("%s: first(%q) = %v, want %v", tt.name, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNotifySendsIdempotencyKeyOnce(t *testing.T) {
+	keys := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get("Idempotency-Key")
+	}))
+	defer hook.Close()
+	hooks := []WebhookConfig{{URL: hook.URL}}
+	if err := compileWebhook(&hooks[0]); err != nil {
+		t.Fatal(err)
+	}
+	withNotifiers(t, "", hooks)
+	oldSent := sentAlerts
+	sentAlerts = &alertDedup{window: time.Minute, sent: make(map[string]time.Time)}
+	t.Cleanup(func() { sentAlerts = oldSent })
+
+	event := CrashEvent{ID: primitive.NewObjectID(), URL: "http://a", Model: "llama3", CrashType: "timeout"}
+	key := alertKey("crash", event.ID)
+	notify("critical", crashAlert(event), "crash", key, event)
+	notify("critical", crashAlert(event), "crash", key, event)
+	select {
+	case got := <-keys:
+		if got != key {
+			t.Errorf("Idempotency-Key = %q, want %q", got, key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("alert not delivered")
+	}
+	select {
+	case <-keys:
+		t.Fatal("repeated alert with the same key delivered again")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// An identical crash is another event with its own ID, so it is alerted too
+	next := event
+	next.ID = primitive.NewObjectID()
+	notify("critical", crashAlert(next), "crash", alertKey("crash", next.ID), next)
+	select {
+	case got := <-keys:
+		if want := alertKey("crash", next.ID); got != want {
+			t.Errorf("Idempotency-Key = %q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("alert about another event not delivered")
+	}
+}
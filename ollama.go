@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// modelTagKeys lists the /api/show details copied onto events as tags
+var modelTagKeys = []string{"format", "family", "parameter_size", "quantization_level"}
+
+// showResponse is the part of an Ollama /api/show response used to tag events
+type showResponse struct {
+	Details   map[string]interface{} `json:"details"`
+	ModelInfo map[string]interface{} `json:"model_info"`
+}
+
+// psResponse is the part of an Ollama /api/ps response listing loaded models
+type psResponse struct {
+	Models []struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	} `json:"models"`
+}
+
+// tagsResponse is the part of an Ollama /api/tags response listing the pulled models
+type tagsResponse struct {
+	Models []struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	} `json:"models"`
+}
+
+// openAIModelsResponse is the part of an OpenAI-compatible /v1/models response listing the served models
+type openAIModelsResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// apiPath returns path under the prefix the server's API is served at, taken from the path of its url, e.g.
+// /proxy/api/tags for a url of http://gpu-1/proxy/api/chat. OpenAI-compatible servers mounted without /v1, e.g.
+// at /openai/chat/completions, get path without its /v1. Unknown url paths leave path as is.
+func apiPath(api, urlPath, path string) string {
+	trimmed := strings.TrimSuffix(urlPath, "/")
+	if api == "openai" {
+		if prefix := strings.TrimSuffix(trimmed, "/v1/chat/completions"); prefix != trimmed {
+			return prefix + path
+		}
+		if prefix := strings.TrimSuffix(trimmed, "/chat/completions"); prefix != trimmed {
+			return prefix + strings.TrimPrefix(path, "/v1")
+		}
+		return path
+	}
+	for _, endpoint := range []string{"/api/chat", "/api/generate"} {
+		if prefix := strings.TrimSuffix(trimmed, endpoint); prefix != trimmed {
+			return prefix + path
+		}
+	}
+	return path
+}
+
+// ollamaAPI calls an Ollama API path on the server, see apiPath, and decodes the JSON response into out.
+// A nil payload sends a GET request, otherwise the payload is POSTed as JSON. The request counts towards
+// the host's max_requests_per_host.
+func ollamaAPI(server Server, config *Config, path string, payload, out interface{}) error {
+	apiURL, err := url.Parse(server.URL)
+	if err != nil {
+		return err
+	}
+	apiURL.Path = apiPath(server.API, apiURL.Path, path)
+	apiURL.RawQuery = ""
+
+	method := http.MethodGet
+	var body io.Reader
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		method = http.MethodPost
+		body = bytes.NewReader(payloadBytes)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, apiURL.String(), body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	release := hostRequests.acquire(apiURL.Host, config.MaxRequestsPerHost)
+	defer release()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialContext(&net.Dialer{Timeout: 5 * time.Second}, server.DNSOverrides),
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fetchModelTags queries the server's /api/show endpoint and returns the model's metadata as tags
+func fetchModelTags(server Server, config *Config) (map[string]string, error) {
+	var show showResponse
+	if err := ollamaAPI(server, config, "/api/show", map[string]string{"model": server.Model}, &show); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for _, key := range modelTagKeys {
+		if value, ok := show.Details[key].(string); ok && value != "" {
+			tags[key] = value
+		}
+	}
+	// model_info keys are prefixed with the architecture, e.g. "llama.context_length"
+	for key, value := range show.ModelInfo {
+		if strings.HasSuffix(key, ".context_length") {
+			tags["context_length"] = fmt.Sprint(value)
+		}
+	}
+	return tags, nil
+}
+
+// fetchLoadedModels queries the server's /api/ps endpoint and returns the names of the loaded models
+func fetchLoadedModels(server Server, config *Config) ([]string, error) {
+	var ps psResponse
+	if err := ollamaAPI(server, config, "/api/ps", nil, &ps); err != nil {
+		return nil, err
+	}
+
+	models := make([]string, 0, len(ps.Models))
+	for _, m := range ps.Models {
+		if m.Model != "" {
+			models = append(models, m.Model)
+		} else {
+			models = append(models, m.Name)
+		}
+	}
+	return models, nil
+}
+
+// fetchAvailableModels returns the models the server can serve: those pulled according to /api/tags, or with
+// api "openai" those listed by /v1/models
+func fetchAvailableModels(server Server, config *Config) ([]string, error) {
+	var models []string
+	if server.API == "openai" {
+		var list openAIModelsResponse
+		if err := ollamaAPI(server, config, "/v1/models", nil, &list); err != nil {
+			return nil, err
+		}
+		for _, m := range list.Data {
+			models = append(models, m.ID)
+		}
+		return models, nil
+	}
+
+	var tags tagsResponse
+	if err := ollamaAPI(server, config, "/api/tags", nil, &tags); err != nil {
+		return nil, err
+	}
+	for _, m := range tags.Models {
+		if m.Model != "" {
+			models = append(models, m.Model)
+		} else {
+			models = append(models, m.Name)
+		}
+	}
+	return models, nil
+}
+
+// modelListed reports whether model is among models. Ollama lists models with their tag, so a model
+// configured without one matches its ":latest" tag.
+func modelListed(models []string, model, api string) bool {
+	if api != "openai" && !strings.Contains(model, ":") {
+		model += ":latest"
+	}
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAPIPath(t *testing.T) {
+	tests := []struct {
+		api     string
+		urlPath string
+		path    string
+		want    string
+	}{
+		{"ollama", "/api/chat", "/api/tags", "/api/tags"},
+		{"ollama", "/proxy/api/chat", "/api/tags", "/proxy/api/tags"},
+		{"ollama", "/proxy/api/generate/", "/api/ps", "/proxy/api/ps"},
+		{"ollama", "", "/api/tags", "/api/tags"},
+		{"openai", "/v1/chat/completions", "/v1/models", "/v1/models"},
+		{"openai", "/gpu-1/v1/chat/completions", "/v1/models", "/gpu-1/v1/models"},
+		{"openai", "/openai/chat/completions", "/v1/models", "/openai/models"},
+		{"openai", "/custom", "/v1/models", "/v1/models"},
+	}
+	for _, tt := range tests {
+		if got := apiPath(tt.api, tt.urlPath, tt.path); got != tt.want {
+			t.Errorf("apiPath(%q, %q, %q) = %q, want %q", tt.api, tt.urlPath, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestModelListed(t *testing.T) {
+	tests := []struct {
+		models []string
+		model  string
+		api    string
+		want   bool
+	}{
+		{[]string{"llama3:latest"}, "llama3", "ollama", true},
+		{[]string{"llama3:8b"}, "llama3", "ollama", false},
+		{[]string{"llama3:8b"}, "llama3:8b", "ollama", true},
+		{nil, "llama3", "ollama", false},
+		{[]string{"meta-llama/Llama-3-8B"}, "meta-llama/Llama-3-8B", "openai", true},
+		{[]string{"llama3:latest"}, "llama3", "openai", false},
+	}
+	for _, tt := range tests {
+		if got := modelListed(tt.models, tt.model, tt.api); got != tt.want {
+			t.Errorf("modelListed(%v, %q, %q) = %v, want %v", tt.models, tt.model, tt.api, got, tt.want)
+		}
+	}
+}
+
+func TestFetchModelTags(t *testing.T) {
+	var requested string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/proxy/api/show" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		requested = req.Model
+		w.Write([]byte(`{
+			"details": {"format": "gguf", "family": "llama", "parameter_size": "8.0B", "quantization_level": "Q4_0", "parent_model": ""},
+			"model_info": {"general.architecture": "llama", "llama.context_length": 8192, "llama.embedding_length": 4096}
+		}`))
+	}))
+	defer backend.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := fetchModelTags(Server{URL: backend.URL + "/proxy/api/chat", Model: "llama3"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != "llama3" {
+		t.Errorf("requested metadata of %q, want llama3", requested)
+	}
+	want := map[string]string{"format": "gguf", "family": "llama", "parameter_size": "8.0B", "quantization_level": "Q4_0", "context_length": "8192"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("fetchModelTags() = %v, want %v", tags, want)
+	}
+
+	if _, err := fetchModelTags(Server{URL: backend.URL + "/api/chat", Model: "llama3"}, config); err == nil {
+		t.Error("fetchModelTags() succeeded on a 404")
+	}
+}
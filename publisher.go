@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/exp/slog"
+)
+
+// publishQueueSize is how many events may wait to be published before new ones are dropped
+const publishQueueSize = 256
+
+// EventPublisher forwards watcher events to a message bus for downstream processing
+type EventPublisher interface {
+	// Publish queues an event of the given kind ("crash", "restart", "pull", "degrading", "sla_violation", "recovered", "digest", "cert_expiring") without blocking
+	Publish(kind string, event interface{})
+}
+
+// noopPublisher is used when no message bus is configured
+type noopPublisher struct{}
+
+// Publish implements EventPublisher
+func (noopPublisher) Publish(string, interface{}) {}
+
+// publisher receives every event the watcher produces (crashes, restarts, digests, ...), set up by main from Config.Publisher
+var publisher EventPublisher = noopPublisher{}
+
+// publishedEvent is an event waiting in the NATS publish queue
+type publishedEvent struct {
+	subject string
+	event   interface{}
+}
+
+// natsPublisher publishes events as JSON to NATS subjects named <subject>.<kind>
+type natsPublisher struct {
+	send    func(subject string, data []byte) error // the connection's Publish
+	subject string
+	queue   chan publishedEvent
+}
+
+// newNATSPublisher connects to NATS and starts publishing queued events in the background
+func newNATSPublisher(cfg PublisherConfig) (*natsPublisher, error) {
+	conn, err := nats.Connect(cfg.NATSURL, nats.Name("llm-watcher"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	p := &natsPublisher{
+		send:    conn.Publish,
+		subject: cfg.Subject,
+		queue:   make(chan publishedEvent, publishQueueSize),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Publish implements EventPublisher. Events are dropped when the queue is full.
+func (p *natsPublisher) Publish(kind string, event interface{}) {
+	select {
+	case p.queue <- publishedEvent{subject: p.subject + "." + kind, event: event}:
+	default:
+		slog.Warn("Publish queue full, dropping event", "kind", kind)
+	}
+}
+
+// run publishes queued events until the queue is closed
+func (p *natsPublisher) run() {
+	for e := range p.queue {
+		data, err := json.Marshal(e.event)
+		if err != nil {
+			slog.Error("Failed to marshal event", "subject", e.subject, "error", err)
+			continue
+		}
+		if err := p.send(e.subject, data); err != nil {
+			slog.Error("Failed to publish event", "subject", e.subject, "error", err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSPublisher(t *testing.T) {
+	type message struct {
+		subject string
+		data    string
+	}
+	sent := make(chan message, 10)
+	p := &natsPublisher{
+		send: func(subject string, data []byte) error {
+			sent <- message{subject, string(data)}
+			if subject == "llm-watcher.restart" {
+				return errors.New("nats: connection closed")
+			}
+			return nil
+		},
+		subject: "llm-watcher",
+		queue:   make(chan publishedEvent, publishQueueSize),
+	}
+	go p.run()
+	defer close(p.queue)
+
+	p.Publish("restart", RestartEvent{URL: "http://a", Status: "fail"})
+	p.Publish("crash", CrashEvent{URL: "http://a", Model: "llama3", CrashType: "timeout"})
+	p.Publish("unmarshalable", func() {})
+	p.Publish("recovered", RecoveryEvent{URL: "http://a", Successes: 2})
+	want := []message{
+		{"llm-watcher.restart", `"status":"fail"`},
+		// A failed publish doesn't stop the ones after it, an event that can't be marshalled is skipped
+		{"llm-watcher.crash", `"crash_type":"timeout"`},
+		{"llm-watcher.recovered", `"successes":2`},
+	}
+	for _, w := range want {
+		select {
+		case got := <-sent:
+			if got.subject != w.subject || !strings.Contains(got.data, w.data) {
+				t.Errorf("published %s %s, want %s with %s", got.subject, got.data, w.subject, w.data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not published", w.subject)
+		}
+	}
+}
+
+func TestNATSPublisherDropsWhenFull(t *testing.T) {
+	p := &natsPublisher{subject: "llm-watcher", queue: make(chan publishedEvent, 2)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			p.Publish("crash", CrashEvent{URL: "http://a"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a full queue")
+	}
+	if len(p.queue) != 2 {
+		t.Errorf("%d events queued, want the queue's 2", len(p.queue))
+	}
+}
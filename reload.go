@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// ServerRef identifies a server in a ReloadDiff
+type ServerRef struct {
+	URL   string `json:"url"`
+	Model string `json:"model"`
+}
+
+// ReloadDiff is how a config reload changed the scheduled servers, as served by GET /reload
+type ReloadDiff struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Added     []ServerRef `json:"added"`
+	Removed   []ServerRef `json:"removed"`
+	Modified  []ServerRef `json:"modified"` // rescheduled with their new settings
+}
+
+// diffServers compares the scheduled servers with those a reloaded config wants scheduled, matching them by
+// serverKey. Each list is sorted by URL and model.
+func diffServers(scheduled, wanted []Server) ReloadDiff {
+	diff := ReloadDiff{Timestamp: time.Now(), Added: []ServerRef{}, Removed: []ServerRef{}, Modified: []ServerRef{}}
+	wantedByKey := make(map[string]Server, len(wanted))
+	for _, server := range wanted {
+		wantedByKey[serverKey(server)] = server
+	}
+	scheduledKeys := make(map[string]bool, len(scheduled))
+	for _, server := range scheduled {
+		key := serverKey(server)
+		scheduledKeys[key] = true
+		ref := ServerRef{URL: server.URL, Model: server.Model}
+		want, ok := wantedByKey[key]
+		switch {
+		case !ok:
+			diff.Removed = append(diff.Removed, ref)
+		case !sameServer(want, server):
+			diff.Modified = append(diff.Modified, ref)
+		}
+	}
+	for _, server := range wanted {
+		if !scheduledKeys[serverKey(server)] {
+			diff.Added = append(diff.Added, ServerRef{URL: server.URL, Model: server.Model})
+		}
+	}
+	for _, refs := range [][]ServerRef{diff.Added, diff.Removed, diff.Modified} {
+		sort.Slice(refs, func(i, j int) bool {
+			if refs[i].URL != refs[j].URL {
+				return refs[i].URL < refs[j].URL
+			}
+			return refs[i].Model < refs[j].Model
+		})
+	}
+	return diff
+}
+
+// lastReload is the diff of the latest config reload, nil until the config is reloaded
+var lastReload = struct {
+	sync.Mutex
+	diff *ReloadDiff
+}{}
+
+// configuredServers holds this shard's configured servers, enabled or not, from the startup config until a
+// reload replaces them. The digest and uptime report on them.
+var configuredServers = struct {
+	sync.Mutex
+	servers []Server
+}{}
+
+// setConfiguredServers replaces the configured servers
+func setConfiguredServers(servers []Server) {
+	configuredServers.Lock()
+	configuredServers.servers = servers
+	configuredServers.Unlock()
+}
+
+// currentServers returns the configured servers, see configuredServers
+func currentServers() []Server {
+	configuredServers.Lock()
+	defer configuredServers.Unlock()
+	return configuredServers.servers
+}
+
+// reloadHandler serves GET /reload, the diff of the latest config reload, null if there was none
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lastReload.Lock()
+	diff := lastReload.diff
+	lastReload.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		slog.Error("Failed to encode reload response", "error", err)
+	}
+}
+
+// addedServer reports whether the diff adds the server
+func addedServer(diff ReloadDiff, server Server) bool {
+	for _, ref := range diff.Added {
+		if ref.URL == server.URL && ref.Model == server.Model {
+			return true
+		}
+	}
+	return false
+}
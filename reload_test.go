@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffServers(t *testing.T) {
+	a := Server{URL: "http://a", Model: "llama3"}
+	b := Server{URL: "http://b", Model: "llama3"}
+	c := Server{URL: "http://c", Model: "llama3"}
+	bSlower := b
+	bSlower.Timeout = Duration(time.Minute)
+	aOtherModel := Server{URL: "http://a", Model: "mistral"}
+
+	ref := func(s Server) ServerRef { return ServerRef{URL: s.URL, Model: s.Model} }
+	tests := []struct {
+		name                     string
+		scheduled, wanted        []Server
+		added, removed, modified []ServerRef
+	}{
+		{"unchanged", []Server{a, b}, []Server{b, a}, nil, nil, nil},
+		{"added", []Server{a}, []Server{a, c}, []ServerRef{ref(c)}, nil, nil},
+		{"removed", []Server{a, b}, []Server{a}, nil, []ServerRef{ref(b)}, nil},
+		{"modified", []Server{a, b}, []Server{a, bSlower}, nil, nil, []ServerRef{ref(b)}},
+		{"model changed is a new server", []Server{a}, []Server{aOtherModel}, []ServerRef{ref(aOtherModel)}, []ServerRef{ref(a)}, nil},
+		{"everything", []Server{a, b}, []Server{bSlower, c}, []ServerRef{ref(c)}, []ServerRef{ref(a)}, []ServerRef{ref(b)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffServers(tt.scheduled, tt.wanted)
+			for _, check := range []struct {
+				kind      string
+				got, want []ServerRef
+			}{{"added", diff.Added, tt.added}, {"removed", diff.Removed, tt.removed}, {"modified", diff.Modified, tt.modified}} {
+				if len(check.got) == 0 && len(check.want) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(check.got, check.want) {
+					t.Errorf("%s = %v, want %v", check.kind, check.got, check.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	lastReload.Lock()
+	previous := lastReload.diff
+	lastReload.diff = nil
+	lastReload.Unlock()
+	t.Cleanup(func() {
+		lastReload.Lock()
+		lastReload.diff = previous
+		lastReload.Unlock()
+	})
+
+	rec := httptest.NewRecorder()
+	reloadHandler(rec, httptest.NewRequest(http.MethodGet, "/reload", nil))
+	if body := rec.Body.String(); body != "null\n" {
+		t.Errorf("before any reload: %q, want null", body)
+	}
+
+	diff := diffServers([]Server{{URL: "http://a", Model: "llama3"}}, []Server{{URL: "http://b", Model: "llama3"}})
+	lastReload.Lock()
+	lastReload.diff = &diff
+	lastReload.Unlock()
+	rec = httptest.NewRecorder()
+	reloadHandler(rec, httptest.NewRequest(http.MethodGet, "/reload", nil))
+	var got ReloadDiff
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Added) != 1 || got.Added[0].URL != "http://b" || len(got.Removed) != 1 || got.Removed[0].URL != "http://a" {
+		t.Errorf("reload = %+v, want b added and a removed", got)
+	}
+
+	rec = httptest.NewRecorder()
+	reloadHandler(rec, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSameServer(t *testing.T) {
+	enabled, disabled := true, false
+	compiled := func(server Server) Server {
+		if err := compileSuccessExpr(&server); err != nil {
+			t.Fatal(err)
+		}
+		return server
+	}
+	base := Server{URL: "http://a", Model: "llama3", Timeout: Duration(time.Second), DNSOverrides: map[string]string{"a": "10.0.0.1"}}
+	tests := []struct {
+		name string
+		a, b Server
+		want bool
+	}{
+		{"identical", base, base, true},
+		{"timeout changed", base, Server{URL: "http://a", Model: "llama3", Timeout: Duration(2 * time.Second), DNSOverrides: map[string]string{"a": "10.0.0.1"}}, false},
+		{"dns override changed", base, Server{URL: "http://a", Model: "llama3", Timeout: Duration(time.Second), DNSOverrides: map[string]string{"a": "10.0.0.2"}}, false},
+		{"enabled pointers to the same value", Server{URL: "http://a", Enabled: &enabled}, Server{URL: "http://a", Enabled: func() *bool { b := true; return &b }()}, true},
+		{"enabled changed", Server{URL: "http://a", Enabled: &enabled}, Server{URL: "http://a", Enabled: &disabled}, false},
+		{"success_expr compiled on each load", compiled(Server{URL: "http://a", SuccessExpr: "status == 200"}), compiled(Server{URL: "http://a", SuccessExpr: "status == 200"}), true},
+		{"success_expr changed", compiled(Server{URL: "http://a", SuccessExpr: "status == 200"}), compiled(Server{URL: "http://a", SuccessExpr: "status == 204"}), false},
+	}
+	for _, tt := range tests {
+		if got := sameServer(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: sameServer() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAddedServer(t *testing.T) {
+	diff := ReloadDiff{Added: []ServerRef{{URL: "http://a", Model: "llama3"}}}
+	tests := []struct {
+		server Server
+		want   bool
+	}{
+		{Server{URL: "http://a", Model: "llama3"}, true},
+		{Server{URL: "http://a", Model: "mistral"}, false},
+		{Server{URL: "http://b", Model: "llama3"}, false},
+	}
+	for _, tt := range tests {
+		if got := addedServer(diff, tt.server); got != tt.want {
+			t.Errorf("addedServer(%s %s) = %v, want %v", tt.server.URL, tt.server.Model, got, tt.want)
+		}
+	}
+}
+
+func TestReloadServersReplacesConfiguredServers(t *testing.T) {
+	previous := currentServers()
+	t.Cleanup(func() { setConfiguredServers(previous) })
+	lastReload.Lock()
+	previousDiff := lastReload.diff
+	lastReload.Unlock()
+	t.Cleanup(func() {
+		lastReload.Lock()
+		lastReload.diff = previousDiff
+		lastReload.Unlock()
+	})
+
+	disabled := false
+	startup := &Config{Shard: ShardConfig{Count: 1}}
+	setConfiguredServers([]Server{{URL: "http://old:11434/api/chat", Model: "llama3"}})
+	reloaded := &Config{SkipDockerCheck: true, Servers: []Server{{URL: "http://new:11434/api/chat", Model: "llama3", Enabled: &disabled}}}
+	reloadServers(reloaded, startup, nil, nil, nil, nil)
+
+	got := currentServers()
+	if len(got) != 1 || got[0].URL != "http://new:11434/api/chat" {
+		t.Errorf("configured servers after reload = %+v, want the reloaded one", got)
+	}
+}
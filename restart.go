@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/exp/slog"
+)
+
+// keyedLimiter bounds the number of concurrent operations per key, such as restarts within each server group
+type keyedLimiter struct {
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+// groupRestarts limits restarts per group so a group never loses all replicas at once
+var groupRestarts = &keyedLimiter{sems: make(map[string]chan struct{})}
+
+// fleetRestarts limits restarts across all servers so a mass outage can't spawn unbounded docker calls
+var fleetRestarts = &keyedLimiter{sems: make(map[string]chan struct{})}
+
+// acquire blocks until one of limit slots for key is free and returns a func releasing it
+func (l *keyedLimiter) acquire(key string, limit int) func() {
+	release, _ := l.acquireBefore(key, limit, time.Time{})
+	return release
+}
+
+// acquireBefore is acquire giving up at deadline, if not zero. It reports whether a slot was acquired,
+// the func returned releases it.
+func (l *keyedLimiter) acquireBefore(key string, limit int, deadline time.Time) (func(), bool) {
+	if limit <= 0 {
+		return func() {}, true
+	}
+	l.mu.Lock()
+	sem, ok := l.sems[key]
+	if !ok || cap(sem) != limit {
+		sem = make(chan struct{}, limit)
+		l.sems[key] = sem
+	}
+	l.mu.Unlock()
+
+	if deadline.IsZero() {
+		sem <- struct{}{}
+		return func() { <-sem }, true
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// restartGroup returns the group a server's restarts are limited within
+func restartGroup(server Server) string {
+	if server.Group != "" {
+		return server.Group
+	}
+	return server.Model
+}
+
+// groupRestartLimit returns how many servers of the server's restart group may restart at once under
+// group_restart_limit, resolving a percentage against the number of configured servers in the group
+func groupRestartLimit(server Server, config *Config) int {
+	group, size := restartGroup(server), 0
+	for _, s := range config.Servers {
+		if restartGroup(s) == group {
+			size++
+		}
+	}
+	return config.GroupRestartLimit.limit(size)
+}
+
+// dockerCommand builds a docker CLI invocation against the server's daemon
+func dockerCommand(ctx context.Context, server Server, args ...string) *exec.Cmd {
+	switch {
+	case server.DockerHost != "":
+		args = append([]string{"--host", server.DockerHost}, args...)
+	case server.DockerContext != "":
+		args = append([]string{"--context", server.DockerContext}, args...)
+	}
+	return exec.CommandContext(ctx, "docker", args...)
+}
+
+// checkDockerAccess asks every daemon servers are restarted on for its version and warns about unreachable ones,
+// so a missing socket mount or permission problem shows up at startup rather than at the first crash. The
+// known_hosts file of servers restarted over SSH is checked too.
+func checkDockerAccess(config *Config) {
+	if err := checkKnownHosts(config); err != nil {
+		slog.Warn("SSH known hosts are unusable, restarts over SSH will fail", "ssh_known_hosts", config.SSHKnownHosts, "error", err)
+	}
+	checked := make(map[string]bool)
+	for _, server := range config.Servers {
+		if server.RestartMode != "docker" || server.ContainerName == "" {
+			continue
+		}
+		target := server.DockerHost + "|" + server.DockerContext + "|" + server.Host
+		if checked[target] {
+			continue
+		}
+		checked[target] = true
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		version, err := restarterFor(server, config).Version(ctx, server)
+		cancel()
+		if err != nil {
+			slog.Warn("Docker is not reachable, container restarts will fail", "url", server.URL, "docker_host", server.DockerHost,
+				"docker_context", server.DockerContext, "error", err)
+			continue
+		}
+		slog.Info("Docker reachable", "url", server.URL, "version", version)
+	}
+}
+
+// restartCooldowns remembers when each container's last restart was attempted, and its attempts within the
+// last hour, keyed by daemon and container name. It starts empty when the watcher starts.
+var restartCooldowns = struct {
+	sync.Mutex
+	last   map[string]time.Time
+	recent map[string][]time.Time // oldest first
+	open   map[string]bool        // restart circuit open, i.e. refusing restarts because of max_restarts_per_hour
+}{last: make(map[string]time.Time), recent: make(map[string][]time.Time), open: make(map[string]bool)}
+
+// startRestart reports whether the server's container may be restarted now, i.e. it had fewer than maxPerHour
+// restart attempts within the last hour and its last one is longer than restart_cooldown ago, and if so records
+// now as its last attempt. Recording it up front keeps overlapping checks of the same container from both
+// restarting it. circuitOpen reports a refusal because of maxPerHour, opened that it is the first refusal since
+// the circuit last closed, recent the attempts within the hour.
+func startRestart(server Server, maxPerHour int) (ok bool, last time.Time, circuitOpen, opened bool, recent int) {
+	key := restartKey(server)
+	restartCooldowns.Lock()
+	defer restartCooldowns.Unlock()
+	now := time.Now()
+	attempts := restartCooldowns.recent[key]
+	for len(attempts) > 0 && now.Sub(attempts[0]) >= time.Hour {
+		attempts = attempts[1:]
+	}
+	restartCooldowns.recent[key] = attempts
+	last = restartCooldowns.last[key]
+	if maxPerHour > 0 && len(attempts) >= maxPerHour {
+		opened = !restartCooldowns.open[key]
+		restartCooldowns.open[key] = true
+		return false, last, true, opened, len(attempts)
+	}
+	delete(restartCooldowns.open, key)
+	if server.RestartCooldown > 0 && now.Sub(last) < time.Duration(server.RestartCooldown) {
+		return false, last, false, false, len(attempts)
+	}
+	restartCooldowns.last[key] = now
+	restartCooldowns.recent[key] = append(attempts, now)
+	return true, last, false, false, len(attempts) + 1
+}
+
+// restartKey identifies what restarting the server restarts across servers sharing it, see restartCooldowns
+func restartKey(server Server) string {
+	return server.DockerHost + "|" + server.DockerContext + "|" + restartTarget(server)
+}
+
+// BreakerStatus is an entry in the /breakers response, the state of the restart circuit of a server's restart target
+type BreakerStatus struct {
+	URL              string     `json:"url"`
+	Model            string     `json:"model"`
+	Target           string     `json:"target"`
+	State            string     `json:"state"`    // "closed", "open" while refusing restarts, "half-open" once the next restart may be attempted again
+	Failures         int        `json:"failures"` // consecutive failed checks
+	RestartsLastHour int        `json:"restarts_last_hour"`
+	NextProbe        *time.Time `json:"next_probe,omitempty"` // while open, when a restart may be attempted again
+}
+
+// breakerStatuses returns the restart circuit of every server given max_restarts_per_hour. A circuit stays open
+// until enough of its restarts are an hour old, then it is half-open until the next restart attempt closes it.
+func breakerStatuses(servers []Server, maxPerHour int, now time.Time) []BreakerStatus {
+	statuses := []BreakerStatus{}
+	for _, server := range servers {
+		restartCooldowns.Lock()
+		var attempts []time.Time
+		for _, attempt := range restartCooldowns.recent[restartKey(server)] {
+			if now.Sub(attempt) < time.Hour {
+				attempts = append(attempts, attempt)
+			}
+		}
+		open := restartCooldowns.open[restartKey(server)]
+		restartCooldowns.Unlock()
+
+		status := BreakerStatus{
+			URL:              server.URL,
+			Model:            server.Model,
+			Target:           restartTarget(server),
+			State:            "closed",
+			Failures:         serverStates.get(server).FailureStreak,
+			RestartsLastHour: len(attempts),
+		}
+		switch {
+		case maxPerHour > 0 && len(attempts) >= maxPerHour:
+			status.State = "open"
+			// Once this attempt is an hour old fewer than maxPerHour remain
+			next := attempts[len(attempts)-maxPerHour].Add(time.Hour)
+			status.NextProbe = &next
+		case open:
+			status.State = "half-open"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// breakersHandler serves GET /breakers, the restart circuits of the configured servers
+func breakersHandler(maxPerHour int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(breakerStatuses(currentServers(), maxPerHour, time.Now())); err != nil {
+			slog.Error("Failed to encode breakers response", "error", err)
+		}
+	}
+}
+
+// recordCircuitOpen records a restart refused by max_restarts_per_hour as a "restartCircuitOpen" crash event. When
+// the refusal opened the circuit it also alerts, as the server is left down until someone looks into it.
+// The event is a marker, stats leave it out of crash counts and MTTR.
+func recordCircuitOpen(server Server, target string, restarts int, opened bool, crashCollection *mongo.Collection) {
+	event := CrashEvent{
+		ID:        primitive.NewObjectID(),
+		Timestamp: time.Now(),
+		URL:       server.URL,
+		Model:     server.Model,
+		CrashType: "restartCircuitOpen",
+	}
+	slog.Warn("Skipping restart, restart circuit open", "url", server.URL, "model", server.Model, "container", target,
+		"restarts_last_hour", restarts)
+	if _, err := crashCollection.InsertOne(context.Background(), event); err != nil {
+		slog.Error("Failed to insert restart circuit event", "url", server.URL, "error", err)
+	}
+	crashesTotal.WithLabelValues(event.URL, event.Model, event.CrashType).Inc()
+	publisher.Publish("crash", event)
+	if opened {
+		slog.Error("Restart circuit opened, manual intervention needed", "url", server.URL, "model", server.Model, "container", target)
+		notify("critical", circuitOpenAlert(event, target, restarts), "restart_circuit_open", alertKey("restart_circuit_open", event.ID), event)
+	}
+}
+
+// restartTarget names what restarting the server restarts, for logs and metrics: its container, its
+// deployment or pods with restart_mode "k8s", or its unit with restart_mode "systemd"
+func restartTarget(server Server) string {
+	switch {
+	case server.RestartMode == "systemd" && server.Host != "":
+		return server.Host + "/" + server.ServiceName
+	case server.RestartMode == "systemd":
+		return server.ServiceName
+	case server.RestartMode != "k8s" && server.Host != "":
+		return server.Host + "/" + server.ContainerName
+	case server.RestartMode != "k8s":
+		return server.ContainerName
+	case server.Deployment != "":
+		return "deployment/" + server.Namespace + "/" + server.Deployment
+	default:
+		return "pods/" + server.Namespace + "/" + server.PodSelector
+	}
+}
+
+// target names what the restart event restarted, see restartTarget
+func (e RestartEvent) target() string {
+	switch {
+	case e.ServiceName != "" && e.Host != "":
+		return "unit " + e.ServiceName + " on " + e.Host
+	case e.ServiceName != "":
+		return "unit " + e.ServiceName
+	case e.Deployment != "":
+		return "deployment/" + e.Namespace + "/" + e.Deployment
+	case e.PodSelector != "":
+		return "pods/" + e.Namespace + "/" + e.PodSelector
+	case e.Host != "":
+		return "container " + e.ContainerName + " on " + e.Host
+	default:
+		return "container " + e.ContainerName
+	}
+}
+
+// restartContainer restarts the server's container, or pods or unit depending on its restart_mode, and records the attempt
+// as a RestartEvent
+func restartContainer(server Server, config *Config, crashCollection, restartCollection *mongo.Collection) {
+	if server.RestartMode == "none" {
+		slog.Info("Restarts are disabled (restart_mode none), skipping restart", "url", server.URL)
+		return
+	}
+	target := restartTarget(server)
+	if target == "" {
+		slog.Warn("No container_name specified, skipping restart", "url", server.URL)
+		return
+	}
+	ok, last, circuitOpen, opened, recent := startRestart(server, config.MaxRestartsPerHour)
+	if circuitOpen {
+		recordCircuitOpen(server, target, recent, opened, crashCollection)
+		return
+	}
+	if !ok {
+		slog.Warn("Skipping restart, in cooldown", "url", server.URL, "model", server.Model, "container", target,
+			"last_restart", last, "cooldown", time.Duration(server.RestartCooldown).String())
+		return
+	}
+
+	group := restartGroup(server)
+	// Take the group slot first so waiting on a busy group doesn't hold a fleet-wide slot
+	releaseGroup := groupRestarts.acquire(group, groupRestartLimit(server, config))
+	releaseFleet := fleetRestarts.acquire("", config.MaxConcurrentRestarts)
+
+	restartEvent := RestartEvent{
+		ID:            primitive.NewObjectID(),
+		Timestamp:     time.Now(),
+		ContainerName: server.ContainerName,
+		URL:           server.URL,
+		Model:         server.Model,
+		DockerHost:    server.DockerHost,
+		DockerContext: server.DockerContext,
+		Host:          server.Host,
+	}
+	if server.RestartMode == "k8s" {
+		restartEvent.Namespace = server.Namespace
+		restartEvent.Deployment = server.Deployment
+		restartEvent.PodSelector = server.PodSelector
+	}
+	if server.RestartMode == "systemd" {
+		restartEvent.ServiceName = server.ServiceName
+	}
+	timeout := time.Duration(server.RestartTimeout)
+	if timeout == 0 {
+		timeout = defaultRestartTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := timedRestart(ctx, restarterFor(server, config), server)
+	cancel()
+	// The slots bound the restart commands, waiting for recovery below would keep other restarts queued
+	releaseFleet()
+	releaseGroup()
+	if err != nil {
+		slog.Error("Restart failed", "url", server.URL, "model", server.Model, "container", target, "error", err)
+		restartEvent.Status = "fail"
+		restartEvent.ErrorMessage = err.Error()
+	} else {
+		slog.Info("Restarted container", "url", server.URL, "model", server.Model, "container", target, "group", group)
+		restartEvent.Status = "success"
+	}
+	_, insertErr := restartCollection.InsertOne(context.Background(), restartEvent)
+	restartsTotal.WithLabelValues(target, restartEvent.Status).Inc()
+	if insertErr != nil {
+		slog.Error("Failed to insert restart event", "container", target, "error", insertErr)
+	} else {
+		slog.Debug("Recorded restart event", "container", target, "status", restartEvent.Status)
+	}
+	publisher.Publish("restart", restartEvent)
+	if restartEvent.Status == "fail" {
+		notify("critical", restartFailedAlert(restartEvent), "restart_failed", alertKey("restart_failed", restartEvent.ID), restartEvent)
+	}
+
+	if restartEvent.Status == "success" {
+		var eventID interface{}
+		if insertErr == nil {
+			eventID = restartEvent.ID
+		}
+		// Verifying takes post_restart_delay and up to recovery_grace, too long to hold the check's slot
+		recoveries.start(func(ctx context.Context) {
+			verifyRecovery(ctx, server, config, restartCollection, eventID)
+		})
+	}
+}
+
+// sleepContext waits d, and reports false if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// timedRestart restarts the server with restarter and observes how long that took in restartDuration
+func timedRestart(ctx context.Context, restarter Restarter, server Server) error {
+	start := time.Now()
+	err := restarter.Restart(ctx, server)
+	status := "success"
+	if err != nil {
+		status = "fail"
+	}
+	restartDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// defaultPullTimeout bounds model pulls of servers without pull_timeout
+const defaultPullTimeout = 30 * time.Minute
+
+// defaultRestartTimeout bounds restarts of servers without restart_timeout, a hung daemon or SSH connection
+// would otherwise hold the restart slots forever
+const defaultRestartTimeout = 2 * time.Minute
+
+// pulls holds the containers a pull is running in, so crashes on later ticks don't stack pulls while a
+// large model is still downloading
+var pulls = struct {
+	sync.Mutex
+	running map[string]bool
+}{running: make(map[string]bool)}
+
+// startPull marks a pull as running in the server's container and returns a func marking it done,
+// or false if one already runs there
+func startPull(server Server) (func(), bool) {
+	target := restartTarget(server)
+	pulls.Lock()
+	defer pulls.Unlock()
+	if pulls.running[target] {
+		return nil, false
+	}
+	pulls.running[target] = true
+	return func() {
+		pulls.Lock()
+		delete(pulls.running, target)
+		pulls.Unlock()
+	}, true
+}
+
+// pullModel pulls a missing model inside the server's container with `ollama pull` and records the attempt
+// as a RestartEvent with action "pull". It is skipped while another pull runs in the container.
+func pullModel(server Server, model string, restartCollection *mongo.Collection) {
+	if server.ContainerName == "" {
+		slog.Warn("No container_name specified, skipping pull", "url", server.URL, "model", model)
+		return
+	}
+	done, ok := startPull(server)
+	if !ok {
+		slog.Info("A pull is already running in the container, skipping this one", "url", server.URL, "model", model, "container", server.ContainerName)
+		return
+	}
+	defer done()
+	timeout := time.Duration(server.PullTimeout)
+	if timeout == 0 {
+		timeout = defaultPullTimeout
+	}
+
+	event := RestartEvent{
+		Timestamp:     time.Now(),
+		ContainerName: server.ContainerName,
+		URL:           server.URL,
+		Model:         model,
+		DockerHost:    server.DockerHost,
+		DockerContext: server.DockerContext,
+		Action:        "pull",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	slog.Info("Model not found, pulling it", "url", server.URL, "model", model, "container", server.ContainerName)
+	output, err := dockerCommand(ctx, server, "exec", server.ContainerName, "ollama", "pull", model).CombinedOutput()
+	if err != nil {
+		// The progress output is long, its last line carries the error
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		slog.Error("Pull failed", "url", server.URL, "model", model, "container", server.ContainerName, "error", err.Error()+": "+lines[len(lines)-1])
+		event.Status = "fail"
+		event.ErrorMessage = err.Error() + ": " + lines[len(lines)-1]
+	} else {
+		slog.Info("Pulled model", "url", server.URL, "model", model, "container", server.ContainerName)
+		event.Status = "success"
+	}
+	if _, err := restartCollection.InsertOne(context.Background(), event); err != nil {
+		slog.Error("Failed to insert pull event", "container", server.ContainerName, "error", err)
+	}
+	publisher.Publish("pull", event)
+}
+
+const (
+	defaultPostRestartDelay = 30 * time.Second // how long servers without post_restart_delay get to come back after a restart
+	defaultRecoveryGrace    = time.Minute      // how long servers without recovery_grace keep being retried after that
+)
+
+// recoveryRetryInterval is the pause between recovery probes, a var so tests don't wait it out
+var recoveryRetryInterval = 5 * time.Second
+
+// recoveryTracker runs recovery verifications in the background and cancels them on shutdown
+type recoveryTracker struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped bool
+	running sync.WaitGroup
+}
+
+// recoveries tracks the verifications started after restarts
+var recoveries = newRecoveryTracker()
+
+// newRecoveryTracker returns a tracker ready to start verifications
+func newRecoveryTracker() *recoveryTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &recoveryTracker{ctx: ctx, cancel: cancel}
+}
+
+// start runs fn in the background with a context cancelled by stop, unless stop has been called already
+func (t *recoveryTracker) start(fn func(ctx context.Context)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	t.running.Add(1)
+	go func() {
+		defer t.running.Done()
+		fn(t.ctx)
+	}()
+}
+
+// stop cancels the running verifications and waits up to grace for them to return. It reports whether they all did.
+func (t *recoveryTracker) stop(grace time.Duration) bool {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+	t.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		t.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// verifyRecovery waits the server's post_restart_delay, then probes it until it passes or its recovery_grace
+// runs out, and records on the restart event whether it recovered. Retrying lets a server that answers
+// 503 while warming up still count as recovered once it returns one of its healthy_status_codes. A server with
+// endpoints only counts as recovered once every one of them passed. Cancelling ctx abandons the verification
+// without recording an outcome.
+// The probes keep their outcome to themselves: the server's streaks, quorum and health score only follow
+// its scheduled checks.
+func verifyRecovery(ctx context.Context, server Server, config *Config, restartCollection *mongo.Collection, eventID interface{}) {
+	delay := time.Duration(server.PostRestartDelay)
+	if delay == 0 {
+		delay = defaultPostRestartDelay
+	}
+	grace := time.Duration(server.RecoveryGrace)
+	if grace == 0 {
+		grace = defaultRecoveryGrace
+	}
+	if !sleepContext(ctx, delay) {
+		slog.Info("Recovery verification cancelled", "url", server.URL, "model", server.Model)
+		return
+	}
+
+	deadline := time.Now().Add(grace)
+	attempts := 0
+	pending := append([]string{server.URL}, server.Endpoints...)
+	var recovered bool
+	for {
+		attempts++
+		if server.CheckMode == "loaded" {
+			// A restarted server has no models loaded yet, answering /api/ps is all that can be expected
+			_, err := fetchLoadedModels(server, config)
+			recovered = err == nil
+		} else {
+			var failing []string
+			for _, endpoint := range pending {
+				endpointServer := server
+				endpointServer.URL = endpoint
+				if passed, _ := checkServer(endpointServer, config, time.Time{}, newStateStore(), nil, nil); !passed {
+					failing = append(failing, endpoint)
+				}
+			}
+			pending = failing
+			recovered = len(pending) == 0
+		}
+		if recovered || time.Now().Add(recoveryRetryInterval).After(deadline) {
+			break
+		}
+		if !sleepContext(ctx, recoveryRetryInterval) {
+			slog.Info("Recovery verification cancelled", "url", server.URL, "model", server.Model, "attempts", attempts)
+			return
+		}
+	}
+	if recovered {
+		slog.Info("Recovered after restart", "url", server.URL, "model", server.Model, "container", restartTarget(server), "attempts", attempts)
+	} else {
+		slog.Error("Not recovered after restart", "url", server.URL, "model", server.Model, "container", restartTarget(server), "within", (delay + grace).String(),
+			"attempts", attempts, "failing", pending)
+	}
+
+	if eventID == nil {
+		return
+	}
+	_, err := restartCollection.UpdateOne(context.Background(), bson.M{"_id": eventID}, bson.M{"$set": bson.M{"recovered": recovered}})
+	if err != nil {
+		slog.Error("Failed to record recovery", "container", server.ContainerName, "error", err)
+	}
+}
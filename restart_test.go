@@ -0,0 +1,630 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRestartLimitUnmarshal(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    RestartLimit
+		wantErr bool
+	}{
+		{yaml: "2", want: RestartLimit{Count: 2}},
+		{yaml: "0", want: RestartLimit{}},
+		{yaml: `"50%"`, want: RestartLimit{Fraction: 0.5}},
+		{yaml: `"12.5%"`, want: RestartLimit{Fraction: 0.125}},
+		{yaml: `"half"`, wantErr: true},
+		{yaml: `"x%"`, wantErr: true},
+		{yaml: `"100%"`, want: RestartLimit{Fraction: 1}},
+		{yaml: `"0%"`, wantErr: true},
+		{yaml: `"-10%"`, wantErr: true},
+		{yaml: `"150%"`, wantErr: true},
+		{yaml: `"NaN%"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got RestartLimit
+		err := yaml.Unmarshal([]byte(tt.yaml), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) error = %v, want error %v", tt.yaml, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.yaml, got, tt.want)
+		}
+	}
+}
+
+func TestGroupRestartLimit(t *testing.T) {
+	servers := []Server{
+		{URL: "http://a:11434", Model: "llama3"},
+		{URL: "http://b:11434", Model: "llama3"},
+		{URL: "http://c:11434", Model: "llama3"},
+		{URL: "http://d:11434", Model: "llama3"},
+		{URL: "http://e:11434", Model: "mistral"},
+	}
+	tests := []struct {
+		name   string
+		limit  RestartLimit
+		server Server
+		want   int
+	}{
+		{"unlimited", RestartLimit{}, servers[0], 0},
+		{"count", RestartLimit{Count: 2}, servers[0], 2},
+		{"half of four", RestartLimit{Fraction: 0.5}, servers[0], 2},
+		{"rounded down", RestartLimit{Fraction: 0.6}, servers[0], 2},
+		{"at least one", RestartLimit{Fraction: 0.5}, servers[4], 1},
+		{"explicit group", RestartLimit{Fraction: 0.5}, Server{URL: "http://f:11434", Model: "llama3", Group: "other"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Servers: servers, GroupRestartLimit: tt.limit}
+			if got := groupRestartLimit(tt.server, config); got != tt.want {
+				t.Errorf("groupRestartLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyedLimiterBoundsConcurrency(t *testing.T) {
+	tests := []struct {
+		servers, limit int
+	}{
+		{servers: 5, limit: 1},
+		{servers: 6, limit: 2},
+		{servers: 4, limit: 4},
+	}
+	for _, tt := range tests {
+		limiter := &keyedLimiter{sems: make(map[string]chan struct{})}
+		var running, peak int32
+		var wg sync.WaitGroup
+		for i := 0; i < tt.servers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release := limiter.acquire("group", tt.limit)
+				defer release()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+			}()
+		}
+		wg.Wait()
+		if int(peak) > tt.limit {
+			t.Errorf("%d servers with limit %d: %d restarted at once", tt.servers, tt.limit, peak)
+		}
+	}
+}
+
+func TestKeyedLimiterAcquireBefore(t *testing.T) {
+	limiter := &keyedLimiter{sems: make(map[string]chan struct{})}
+	tests := []struct {
+		name     string
+		limit    int
+		deadline time.Time
+		want     bool
+	}{
+		{"unlimited", 0, time.Now().Add(-time.Second), true},
+		{"free slot", 1, time.Now().Add(time.Second), true},
+		{"busy slot", 1, time.Now().Add(20 * time.Millisecond), false},
+		{"busy slot, deadline passed", 1, time.Now().Add(-time.Second), false},
+	}
+	var held []func()
+	for _, tt := range tests {
+		release, ok := limiter.acquireBefore("key", tt.limit, tt.deadline)
+		if ok != tt.want {
+			t.Errorf("%s: acquired = %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok {
+			held = append(held, release)
+		}
+	}
+	for _, release := range held {
+		release()
+	}
+}
+
+// fakeRestarter is a Restarter whose restarts take delay and fail with err
+type fakeRestarter struct {
+	delay time.Duration
+	err   error
+}
+
+func (r fakeRestarter) Restart(ctx context.Context, server Server) error {
+	select {
+	case <-time.After(r.delay):
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r fakeRestarter) Version(ctx context.Context, server Server) (string, error) {
+	return "fake", nil
+}
+
+// restartDurationSamples returns the number of observations and their sum of the restart duration histogram for status
+func restartDurationSamples(t *testing.T, status string) (uint64, float64) {
+	t.Helper()
+	var metric dto.Metric
+	if err := restartDuration.WithLabelValues(status).(prometheus.Histogram).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+}
+
+func TestTimedRestartObservesDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		restarter  fakeRestarter
+		wantStatus string
+	}{
+		{"success", fakeRestarter{delay: 20 * time.Millisecond}, "success"},
+		{"failure", fakeRestarter{delay: 20 * time.Millisecond, err: errors.New("daemon unreachable")}, "fail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, sum := restartDurationSamples(t, tt.wantStatus)
+			err := timedRestart(context.Background(), tt.restarter, Server{ContainerName: "ollama"})
+			if (err != nil) != (tt.restarter.err != nil) {
+				t.Errorf("timedRestart() error = %v, want %v", err, tt.restarter.err)
+			}
+			newCount, newSum := restartDurationSamples(t, tt.wantStatus)
+			if newCount != count+1 {
+				t.Errorf("%s observations went from %d to %d, want one more", tt.wantStatus, count, newCount)
+			}
+			if newSum-sum < tt.restarter.delay.Seconds() {
+				t.Errorf("observed %vs, want at least %vs", newSum-sum, tt.restarter.delay.Seconds())
+			}
+		})
+	}
+}
+
+func TestMissingModels(t *testing.T) {
+	crashOf := func(crashType, model string) crash {
+		return crash{event: CrashEvent{URL: "http://a", Model: model, CrashType: crashType}}
+	}
+	tests := []struct {
+		name    string
+		crashes []crash
+		want    []string
+	}{
+		{"none", nil, nil},
+		{"timeout", []crash{crashOf("timeout", "llama3")}, nil},
+		{"not found", []crash{crashOf("modelNotFound", "llama3")}, []string{"llama3"}},
+		{"not listed", []crash{crashOf("modelMissing", "llama3")}, []string{"llama3"}},
+		{"mixed", []crash{crashOf("timeout", "llama3"), crashOf("modelNotFound", "mistral")}, []string{"mistral"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingModels(tt.crashes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingModels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartPullDoesNotStack(t *testing.T) {
+	server := Server{URL: "http://a", ContainerName: "ollama"}
+	done, ok := startPull(server)
+	if !ok {
+		t.Fatal("first pull not started")
+	}
+	if _, ok := startPull(server); ok {
+		t.Error("second pull in the same container started while the first runs")
+	}
+	if other, ok := startPull(Server{URL: "http://b", ContainerName: "ollama", Host: "gpu-2"}); !ok {
+		t.Error("pull in another host's container refused")
+	} else {
+		other()
+	}
+	// Skipped before it needs the collection
+	pullModel(server, "llama3", nil)
+	done()
+	if done, ok := startPull(server); !ok {
+		t.Error("pull refused after the previous one finished")
+	} else {
+		done()
+	}
+}
+
+func TestStartRestart(t *testing.T) {
+	type result struct {
+		ok, circuitOpen, opened bool
+		recent                  int
+	}
+	tests := []struct {
+		name       string
+		server     Server
+		maxPerHour int
+		aged       bool // the attempts so far are backdated past the hour before the last call
+		want       []result
+	}{
+		{
+			name:   "no limits",
+			server: Server{ContainerName: "unlimited"},
+			want:   []result{{ok: true, recent: 1}, {ok: true, recent: 2}, {ok: true, recent: 3}},
+		},
+		{
+			name:   "cooldown",
+			server: Server{ContainerName: "cooling", RestartCooldown: Duration(time.Hour)},
+			want:   []result{{ok: true, recent: 1}, {recent: 1}},
+		},
+		{
+			name:       "circuit opens once",
+			server:     Server{ContainerName: "flapping"},
+			maxPerHour: 2,
+			want: []result{
+				{ok: true, recent: 1},
+				{ok: true, recent: 2},
+				{circuitOpen: true, opened: true, recent: 2},
+				{circuitOpen: true, recent: 2},
+			},
+		},
+		{
+			name:       "circuit closes after the hour",
+			server:     Server{ContainerName: "recovered"},
+			maxPerHour: 1,
+			aged:       true,
+			want: []result{
+				{ok: true, recent: 1},
+				{circuitOpen: true, opened: true, recent: 1},
+				{ok: true, recent: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := "||" + tt.server.ContainerName
+			for i, want := range tt.want {
+				if tt.aged && i == len(tt.want)-1 {
+					restartCooldowns.Lock()
+					restartCooldowns.recent[key] = []time.Time{time.Now().Add(-2 * time.Hour)}
+					restartCooldowns.last[key] = time.Now().Add(-2 * time.Hour)
+					restartCooldowns.Unlock()
+				}
+				ok, _, circuitOpen, opened, recent := startRestart(tt.server, tt.maxPerHour)
+				if got := (result{ok, circuitOpen, opened, recent}); got != want {
+					t.Errorf("call %d = %+v, want %+v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoveryFor(t *testing.T) {
+	crashOf := func(crashType string) crash {
+		return crash{event: CrashEvent{URL: "http://a", Model: "llama3", CrashType: crashType}}
+	}
+	tests := []struct {
+		name        string
+		server      Server
+		crashes     []crash
+		restart     bool
+		wantPulls   []string
+		wantRestart bool
+	}{
+		{"timeout", Server{}, []crash{crashOf("timeout")}, true, nil, true},
+		{"rules disable restart", Server{}, []crash{crashOf("timeout")}, false, nil, false},
+		{"model missing", Server{}, []crash{crashOf("modelMissing")}, true, nil, false},
+		{"model not found", Server{}, []crash{crashOf("modelNotFound")}, true, nil, false},
+		{"model missing, pulled", Server{PullMissingModel: true}, []crash{crashOf("modelMissing")}, true, []string{"llama3"}, false},
+		{"model missing with timeout", Server{}, []crash{crashOf("timeout"), crashOf("modelMissing")}, true, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pulls, restart := recoveryFor(tt.server, tt.crashes, tt.restart)
+			if !reflect.DeepEqual(pulls, tt.wantPulls) || restart != tt.wantRestart {
+				t.Errorf("recoveryFor() = %v, %v, want %v, %v", pulls, restart, tt.wantPulls, tt.wantRestart)
+			}
+		})
+	}
+}
+
+// statusSequence is an httptest handler answering a chat probe with each of its statuses in turn, the last
+// one from then on
+type statusSequence struct {
+	statuses []int
+	calls    int32
+}
+
+func (s *statusSequence) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := int(atomic.AddInt32(&s.calls, 1)) - 1
+	if n >= len(s.statuses) {
+		n = len(s.statuses) - 1
+	}
+	w.WriteHeader(s.statuses[n])
+	w.Write([]byte(`{"message":{"content":"ok"},"done":true}`))
+}
+
+// recordedRecovery returns the recovered flag verifyRecovery set on the restart event, and whether it set one
+func recordedRecovery(mt *mtest.T) (recovered, ok bool) {
+	started := mt.GetStartedEvent()
+	if started == nil || started.CommandName != "update" {
+		return false, false
+	}
+	update := started.Command.Lookup("updates").Array().Index(0).Value().Document()
+	value, err := update.LookupErr("u", "$set", "recovered")
+	if err != nil {
+		return false, false
+	}
+	return value.Boolean(), true
+}
+
+func TestVerifyRecoveryRequiresEveryEndpoint(t *testing.T) {
+	interval := recoveryRetryInterval
+	recoveryRetryInterval = 10 * time.Millisecond
+	defer func() { recoveryRetryInterval = interval }()
+	healthy := httptest.NewServer(&statusSequence{statuses: []int{http.StatusOK}})
+	defer healthy.Close()
+	unavailable := httptest.NewServer(&statusSequence{statuses: []int{http.StatusServiceUnavailable}})
+	defer unavailable.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		want      bool
+	}{
+		{"every endpoint passes", []string{healthy.URL + "/v2/api/chat"}, true},
+		{"an endpoint still fails", []string{unavailable.URL + "/api/chat"}, false},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			server := Server{URL: healthy.URL + "/api/chat", Model: "llama3", Endpoints: tt.endpoints,
+				PostRestartDelay: Duration(time.Millisecond), RecoveryGrace: Duration(50 * time.Millisecond)}
+			verifyRecovery(context.Background(), server, config, mt.Coll, "restart-1")
+			if recovered, ok := recordedRecovery(mt); !ok || recovered != tt.want {
+				t.Errorf("recorded recovered = %v (set %v), want %v", recovered, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryTrackerStopCancelsVerifications(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("stop", func(mt *mtest.T) {
+		tracker := newRecoveryTracker()
+		server := Server{URL: "http://recovery-test:11434/api/chat", Model: "llama3", PostRestartDelay: Duration(time.Hour)}
+		tracker.start(func(ctx context.Context) {
+			verifyRecovery(ctx, server, &Config{}, mt.Coll, "restart-1")
+		})
+		if !tracker.stop(time.Second) {
+			t.Fatal("verification still running after stop")
+		}
+		if _, ok := recordedRecovery(mt); ok {
+			t.Error("cancelled verification recorded an outcome")
+		}
+		started := false
+		tracker.start(func(ctx context.Context) { started = true })
+		tracker.stop(time.Second)
+		if started {
+			t.Error("verification started after stop")
+		}
+	})
+}
+
+func TestVerifyRecoveryRetriesWhileWarmingUp(t *testing.T) {
+	interval := recoveryRetryInterval
+	recoveryRetryInterval = 10 * time.Millisecond
+	defer func() { recoveryRetryInterval = interval }()
+	warming := &statusSequence{statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK}}
+	backend := httptest.NewServer(warming)
+	defer backend.Close()
+	config := &Config{}
+	if err := validateConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("503 then 200", func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		server := Server{URL: backend.URL + "/api/chat", Model: "llama3",
+			PostRestartDelay: Duration(time.Millisecond), RecoveryGrace: Duration(time.Second)}
+		verifyRecovery(context.Background(), server, config, mt.Coll, "restart-1")
+		if recovered, ok := recordedRecovery(mt); !ok || !recovered {
+			t.Errorf("recorded recovered = %v (set %v), want true", recovered, ok)
+		}
+		if calls := atomic.LoadInt32(&warming.calls); calls != 3 {
+			t.Errorf("server probed %d times, want 3", calls)
+		}
+	})
+}
+
+func TestRecordCircuitOpenAlertsOnOpening(t *testing.T) {
+	alerts := make(chan struct{}, 10)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alerts <- struct{}{}
+	}))
+	defer slack.Close()
+	withNotifiers(t, slack.URL, nil)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("refusals", func(mt *mtest.T) {
+		server := Server{URL: "http://circuit-test:11434/api/chat", Model: "llama3", ContainerName: "ollama"}
+		for _, opened := range []bool{true, false, false} {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+			recordCircuitOpen(server, "ollama", 3, opened, mt.Coll)
+		}
+		inserts := 0
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName == "insert" {
+				inserts++
+			}
+		}
+		if inserts != 3 {
+			t.Errorf("%d restartCircuitOpen markers recorded, want one per refusal", inserts)
+		}
+		select {
+		case <-alerts:
+		case <-time.After(2 * time.Second):
+			t.Fatal("no alert when the circuit opened")
+		}
+		select {
+		case <-alerts:
+			t.Error("alerted again on a refusal while the circuit stayed open")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestBreakersHandler(t *testing.T) {
+	now := time.Now()
+	closed := Server{URL: "http://breaker-closed", Model: "llama3", ContainerName: "breaker-closed"}
+	open := Server{URL: "http://breaker-open", Model: "llama3", ContainerName: "breaker-open"}
+	halfOpen := Server{URL: "http://breaker-half-open", Model: "llama3", ContainerName: "breaker-half-open"}
+	restartCooldowns.Lock()
+	restartCooldowns.recent[restartKey(closed)] = []time.Time{now.Add(-10 * time.Minute)}
+	restartCooldowns.recent[restartKey(open)] = []time.Time{now.Add(-50 * time.Minute), now.Add(-40 * time.Minute), now.Add(-5 * time.Minute)}
+	restartCooldowns.open[restartKey(open)] = true
+	restartCooldowns.recent[restartKey(halfOpen)] = []time.Time{now.Add(-90 * time.Minute), now.Add(-30 * time.Minute)}
+	restartCooldowns.open[restartKey(halfOpen)] = true
+	restartCooldowns.Unlock()
+	t.Cleanup(func() {
+		restartCooldowns.Lock()
+		defer restartCooldowns.Unlock()
+		for _, server := range []Server{closed, open, halfOpen} {
+			delete(restartCooldowns.recent, restartKey(server))
+			delete(restartCooldowns.open, restartKey(server))
+		}
+	})
+	oldStates := serverStates
+	serverStates = newStateStore()
+	t.Cleanup(func() { serverStates = oldStates })
+	serverStates.recordCheck(open, 10, false, 0)
+	serverStates.recordCheck(open, 10, false, 0)
+	setConfiguredServers([]Server{closed, open, halfOpen})
+	t.Cleanup(func() { setConfiguredServers(nil) })
+
+	rec := httptest.NewRecorder()
+	breakersHandler(2)(rec, httptest.NewRequest(http.MethodGet, "/breakers", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var got []BreakerStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		state     string
+		failures  int
+		restarts  int
+		nextProbe time.Time
+	}{
+		{"closed", 0, 1, time.Time{}},
+		// Down to one restart within the hour once the one 40 minutes ago is an hour old
+		{"open", 2, 3, now.Add(20 * time.Minute)},
+		{"half-open", 0, 1, time.Time{}},
+	}
+	if len(got) != len(tests) {
+		t.Fatalf("got %d breakers, want %d: %+v", len(got), len(tests), got)
+	}
+	for i, tt := range tests {
+		var nextProbe time.Time
+		if got[i].NextProbe != nil {
+			nextProbe = *got[i].NextProbe
+		}
+		if got[i].State != tt.state || got[i].Failures != tt.failures || got[i].RestartsLastHour != tt.restarts || !nextProbe.Equal(tt.nextProbe) {
+			t.Errorf("%s = %+v, want state %s, %d failures, %d restarts, next probe %v", got[i].URL, got[i], tt.state, tt.failures, tt.restarts, tt.nextProbe)
+		}
+	}
+}
+
+func TestFleetRestartLimitSpansGroups(t *testing.T) {
+	var running, peak, restarts int32
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&restarts, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer daemon.Close()
+	oldGroups, oldFleet, oldRecoveries := groupRestarts, fleetRestarts, recoveries
+	groupRestarts = &keyedLimiter{sems: make(map[string]chan struct{})}
+	fleetRestarts = &keyedLimiter{sems: make(map[string]chan struct{})}
+	recoveries = newRecoveryTracker()
+	t.Cleanup(func() {
+		recoveries.stop(time.Second)
+		groupRestarts, fleetRestarts, recoveries = oldGroups, oldFleet, oldRecoveries
+	})
+
+	host := "tcp://" + strings.TrimPrefix(daemon.URL, "http://")
+	var servers []Server
+	for _, model := range []string{"llama3", "mistral", "qwen2", "phi3"} {
+		servers = append(servers, Server{URL: "http://fleet-" + model + ":11434/api/chat", Model: model,
+			ContainerName: "fleet-" + model, DockerHost: host, PostRestartDelay: Duration(time.Hour)})
+	}
+	config := &Config{Servers: servers, MaxConcurrentRestarts: 1}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("mass failure", func(mt *mtest.T) {
+		for range servers {
+			mt.AddMockResponses(mtest.CreateSuccessResponse())
+		}
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server Server) {
+				defer wg.Done()
+				restartContainer(server, config, mt.Coll, mt.Coll)
+			}(server)
+		}
+		wg.Wait()
+	})
+	if restarts != int32(len(servers)) {
+		t.Errorf("%d of %d servers restarted", restarts, len(servers))
+	}
+	if peak != 1 {
+		t.Errorf("%d restarts ran at once across groups, want max_concurrent_restarts 1", peak)
+	}
+}
+
+func TestDockerCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		server Server
+		want   []string
+	}{
+		{"local daemon", Server{ContainerName: "ollama"}, []string{"docker", "restart", "ollama"}},
+		{"remote host", Server{ContainerName: "ollama", DockerHost: "ssh://gpu-1"}, []string{"docker", "--host", "ssh://gpu-1", "restart", "ollama"}},
+		{"context", Server{ContainerName: "ollama", DockerContext: "gpu-1"}, []string{"docker", "--context", "gpu-1", "restart", "ollama"}},
+		{"host over context", Server{ContainerName: "ollama", DockerHost: "tcp://gpu-1:2376", DockerContext: "gpu-1"}, []string{"docker", "--host", "tcp://gpu-1:2376", "restart", "ollama"}},
+	}
+	for _, tt := range tests {
+		cmd := dockerCommand(context.Background(), tt.server, "restart", tt.server.ContainerName)
+		if !reflect.DeepEqual(cmd.Args, tt.want) {
+			t.Errorf("%s: dockerCommand() = %q, want %q", tt.name, cmd.Args, tt.want)
+		}
+	}
+}
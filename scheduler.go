@@ -0,0 +1,252 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"golang.org/x/exp/slog"
+)
+
+// scheduledCheck is a server's cron entry and the outcome of its latest run
+type scheduledCheck struct {
+	entryID      cron.EntryID
+	server       Server
+	spec         string
+	lastStart    time.Time
+	lastTick     time.Time // tick of the last completed run, see checkScheduler.run
+	lastDuration time.Duration
+	lastCrashes  int
+	lastError    string    // of the latest run that found crashes
+	lastErrorAt  time.Time // when that run started
+	running      bool
+	runs         int
+	skipped      int // runs skipped because a canary failed
+}
+
+// checkFunc runs a server's check given its tick's deadline, zero without one, and returns the number of
+// crashes found and an error describing them
+type checkFunc func(deadline time.Time) (int, error)
+
+// checkScheduler tracks the cron instance running the checks, for GET /scheduler
+type checkScheduler struct {
+	mu           sync.Mutex
+	cron         *cron.Cron
+	checks       []*scheduledCheck
+	inflight     sync.WaitGroup // scheduled and startup checks currently running
+	tickDone     *sync.Cond     // signalled on mu whenever a check completes a run
+	startup      time.Time      // tick of the startup checks
+	canaryPolicy string         // "continue" or "skip", see Config.CanaryPolicy
+	tickDeadline time.Duration  // see Config.TickDeadline
+}
+
+// scheduler is the check scheduler, set up by startScheduler
+var scheduler = newCheckScheduler()
+
+// newCheckScheduler returns an empty scheduler, startScheduler gives it its cron instance
+func newCheckScheduler() *checkScheduler {
+	s := &checkScheduler{}
+	s.tickDone = sync.NewCond(&s.mu)
+	return s
+}
+
+// add registers a server's checks on spec, wrapping fn so each run is tracked
+func (s *checkScheduler) add(server Server, spec string, fn checkFunc) (*scheduledCheck, error) {
+	check := &scheduledCheck{server: server, spec: spec}
+	s.mu.Lock()
+	c := s.cron
+	s.mu.Unlock()
+	id, err := c.AddFunc(spec, func() { s.run(check, s.tickOf(check), fn) })
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	check.entryID = id
+	s.checks = append(s.checks, check)
+	s.mu.Unlock()
+	return check, nil
+}
+
+// remove unschedules a check, a run in progress finishes
+func (s *checkScheduler) remove(check *scheduledCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cron.Remove(check.entryID)
+	for i, c := range s.checks {
+		if c == check {
+			s.checks = append(s.checks[:i], s.checks[i+1:]...)
+			break
+		}
+	}
+}
+
+// list returns the registered checks
+func (s *checkScheduler) list() []*scheduledCheck {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*scheduledCheck(nil), s.checks...)
+}
+
+// tickOf returns the time of the cron tick that started the check's current run. Cron advances an entry's
+// Prev on the goroutine that answers Entry, so a run always sees the tick it was started by.
+func (s *checkScheduler) tickOf(check *scheduledCheck) time.Time {
+	s.mu.Lock()
+	id, c := check.entryID, s.cron
+	s.mu.Unlock()
+	return c.Entry(id).Prev
+}
+
+// inTick reports whether the check has a run started by tick. Must be called with mu held.
+func (s *checkScheduler) inTick(check *scheduledCheck, tick time.Time) bool {
+	if tick.Equal(s.startup) {
+		return !check.server.SkipStartupCheck
+	}
+	return s.cron.Entry(check.entryID).Prev.Equal(tick)
+}
+
+// awaitCanaries waits for the canary checks started by tick to finish and returns the URLs of those that
+// found crashes. Canaries on another schedule than the waiting check are not part of its ticks.
+func (s *checkScheduler) awaitCanaries(tick time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		var failed []string
+		pending := false
+		for _, check := range s.checks {
+			if !check.server.Canary || !s.inTick(check, tick) {
+				continue
+			}
+			if check.lastTick.Before(tick) {
+				pending = true
+				break
+			}
+			if check.lastCrashes > 0 {
+				failed = append(failed, check.server.URL)
+			}
+		}
+		if !pending {
+			return failed
+		}
+		s.tickDone.Wait()
+	}
+}
+
+// run runs fn and records its timing and outcome on check.
+// tick identifies the cron tick or startup burst the run belongs to: other servers wait for the canaries
+// of their tick, and skip their run if one failed and the canary policy is "skip". fn is passed the
+// tick's deadline, zero without a tick deadline.
+func (s *checkScheduler) run(check *scheduledCheck, tick time.Time, fn checkFunc) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+	if !check.server.Canary {
+		if failed := s.awaitCanaries(tick); len(failed) > 0 && s.canaryPolicy == "skip" {
+			slog.Warn("Skipping check, canary failed", "url", check.server.URL, "model", check.server.Model, "canaries", failed)
+			s.mu.Lock()
+			check.skipped++
+			s.mu.Unlock()
+			return
+		}
+	}
+	start := time.Now()
+	s.mu.Lock()
+	check.running = true
+	check.lastStart = start
+	var deadline time.Time
+	if s.tickDeadline > 0 {
+		deadline = tick.Add(s.tickDeadline)
+	}
+	s.mu.Unlock()
+
+	crashes, err := fn(deadline)
+
+	s.mu.Lock()
+	check.running = false
+	if tick.After(check.lastTick) {
+		check.lastTick = tick
+	}
+	check.lastDuration = time.Since(start)
+	check.lastCrashes = crashes
+	if err != nil {
+		check.lastError = err.Error()
+		check.lastErrorAt = start
+	}
+	check.runs++
+	s.mu.Unlock()
+	s.tickDone.Broadcast()
+}
+
+// stop stops scheduling checks and waits up to grace for running ones, including startup checks,
+// to finish. It reports whether they all did.
+func (s *checkScheduler) stop(grace time.Duration) bool {
+	s.mu.Lock()
+	c := s.cron
+	s.mu.Unlock()
+	if c != nil {
+		// The context returned only covers cron's own jobs, inflight also covers startup checks
+		c.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// SchedulerEntry is a server's entry in the /scheduler response
+type SchedulerEntry struct {
+	URL            string     `json:"url"`
+	Model          string     `json:"model"`
+	Schedule       string     `json:"schedule"`
+	Canary         bool       `json:"canary"`
+	NextRun        time.Time  `json:"next_run"`
+	Running        bool       `json:"running"`
+	Runs           int        `json:"runs"`                       // including the startup check
+	Skipped        int        `json:"skipped"`                    // runs skipped because a canary of the same tick failed
+	LastRun        *time.Time `json:"last_run,omitempty"`         // null until the first run
+	LastDurationMs int64      `json:"last_duration_ms,omitempty"` // including crash handling and restarts
+	LastCrashes    int        `json:"last_crashes"`               // crashes recorded by the last completed run
+	LastError      string     `json:"last_error,omitempty"`       // crashes of the latest run that found any
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`    // when that run started
+}
+
+// entries returns the scheduler's view of every registered check
+func (s *checkScheduler) entries() []SchedulerEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]SchedulerEntry, 0, len(s.checks))
+	if s.cron == nil {
+		return entries
+	}
+	for _, check := range s.checks {
+		entry := SchedulerEntry{
+			URL:            check.server.URL,
+			Model:          check.server.Model,
+			Schedule:       check.spec,
+			Canary:         check.server.Canary,
+			NextRun:        s.cron.Entry(check.entryID).Next,
+			Running:        check.running,
+			Runs:           check.runs,
+			Skipped:        check.skipped,
+			LastDurationMs: check.lastDuration.Milliseconds(),
+			LastCrashes:    check.lastCrashes,
+		}
+		if !check.lastStart.IsZero() {
+			lastRun := check.lastStart
+			entry.LastRun = &lastRun
+		}
+		if check.lastError != "" {
+			lastErrorAt := check.lastErrorAt
+			entry.LastError = check.lastError
+			entry.LastErrorAt = &lastErrorAt
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
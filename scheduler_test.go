@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+func TestSchedulerRecordsLastError(t *testing.T) {
+	s := newCheckScheduler()
+	s.cron = cron.New()
+	s.startup = time.Now()
+	server := Server{URL: "http://a", Model: "llama3"}
+
+	results := []struct {
+		crashes int
+		err     error
+	}{
+		{0, nil},
+		{1, errors.New("timeout on http://a: context deadline exceeded")},
+		{0, nil},
+	}
+	check, err := s.add(server, "@every 1h", func(time.Time) (int, error) { return 0, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErrors := []string{"", "timeout on http://a: context deadline exceeded", "timeout on http://a: context deadline exceeded"}
+	for i, result := range results {
+		result := result
+		s.run(check, s.startup, func(time.Time) (int, error) { return result.crashes, result.err })
+		entries := s.entries()
+		if len(entries) != 1 {
+			t.Fatalf("%d entries, want 1", len(entries))
+		}
+		entry := entries[0]
+		if entry.LastError != wantErrors[i] {
+			t.Errorf("run %d: last error %q, want %q", i, entry.LastError, wantErrors[i])
+		}
+		if (entry.LastErrorAt != nil) != (wantErrors[i] != "") {
+			t.Errorf("run %d: last error at %v", i, entry.LastErrorAt)
+		}
+		if entry.LastCrashes != result.crashes {
+			t.Errorf("run %d: last crashes %d, want %d", i, entry.LastCrashes, result.crashes)
+		}
+	}
+}
+
+func TestCrashesError(t *testing.T) {
+	long := ""
+	for len(long) < 2*maxCrashDetail {
+		long += "é"
+	}
+	tests := []struct {
+		name    string
+		crashes []crash
+		want    string
+	}{
+		{"none", nil, ""},
+		{"one", []crash{{CrashEvent{URL: "http://a", CrashType: "timeout"}, "context deadline exceeded"}}, "timeout on http://a: context deadline exceeded"},
+		{"no detail", []crash{{CrashEvent{URL: "http://a", CrashType: "noModelsLoaded"}, ""}}, "noModelsLoaded on http://a"},
+		{"several", []crash{
+			{CrashEvent{URL: "http://a", CrashType: "timeout"}, "x"},
+			{CrashEvent{URL: "http://b", CrashType: "unhealthyStatus"}, "503"},
+		}, "timeout on http://a: x; unhealthyStatus on http://b: 503"},
+		{"long detail", []crash{{CrashEvent{URL: "http://a", CrashType: "criterionFailed"}, long}}, "criterionFailed on http://a: " + long[:maxCrashDetail] + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := crashesError(tt.crashes)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("crashesError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWaitsForCanaries(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		canaryCrashes int
+		wantRun       bool
+	}{
+		{"canary passed", "skip", 0, true},
+		{"canary failed, continue", "continue", 1, true},
+		{"canary failed, skip", "skip", 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newCheckScheduler()
+			s.cron = cron.New()
+			s.startup = time.Now()
+			s.canaryPolicy = tt.policy
+			noop := func(time.Time) (int, error) { return 0, nil }
+			canary, err := s.add(Server{URL: "http://canary", Model: "llama3", Canary: true}, "@every 1h", noop)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := s.add(Server{URL: "http://other", Model: "llama3"}, "@every 1h", noop)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			releaseCanary := make(chan struct{})
+			var canaryDone, otherRan int32
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.run(other, s.startup, func(time.Time) (int, error) {
+					if atomic.LoadInt32(&canaryDone) == 0 {
+						t.Error("checked before the canary finished")
+					}
+					atomic.StoreInt32(&otherRan, 1)
+					return 0, nil
+				})
+			}()
+			go s.run(canary, s.startup, func(time.Time) (int, error) {
+				<-releaseCanary
+				atomic.StoreInt32(&canaryDone, 1)
+				return tt.canaryCrashes, nil
+			})
+
+			select {
+			case <-done:
+				t.Fatal("finished while the canary was still running")
+			case <-time.After(50 * time.Millisecond):
+			}
+			close(releaseCanary)
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("still waiting after the canary finished")
+			}
+			if ran := atomic.LoadInt32(&otherRan) == 1; ran != tt.wantRun {
+				t.Errorf("checked = %v, want %v", ran, tt.wantRun)
+			}
+			s.mu.Lock()
+			skipped := other.skipped
+			s.mu.Unlock()
+			if (skipped == 1) == tt.wantRun {
+				t.Errorf("skipped %d runs, want the run skipped %v", skipped, !tt.wantRun)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// ShardConfig splits the servers between several watcher instances sharing a config
+type ShardConfig struct {
+	Index int `yaml:"index"` // this instance's shard, 0 to count-1, overridden by SHARD_INDEX
+	Count int `yaml:"count"` // number of instances, default 1, overridden by SHARD_COUNT
+}
+
+// shardOf returns the shard a server belongs to out of count, by rendezvous hashing its URL and model:
+// every instance computes the same assignment without coordinating, and changing count only moves the
+// servers of the added or removed shards
+func shardOf(server Server, count int) int {
+	best, bestWeight := 0, uint64(0)
+	for shard := 0; shard < count; shard++ {
+		h := fnv.New64a()
+		h.Write([]byte(server.URL + "|" + server.Model + "|" + strconv.Itoa(shard)))
+		if weight := h.Sum64(); shard == 0 || weight > bestWeight {
+			best, bestWeight = shard, weight
+		}
+	}
+	return best
+}
+
+// shardServers returns the servers of the config's shard, all of them without sharding
+func shardServers(servers []Server, shard ShardConfig) []Server {
+	if shard.Count <= 1 {
+		return servers
+	}
+	var owned []Server
+	for _, server := range servers {
+		if shardOf(server, shard.Count) == shard.Index {
+			owned = append(owned, server)
+		}
+	}
+	return owned
+}
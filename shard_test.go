@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardServersPartition(t *testing.T) {
+	var servers []Server
+	for i := 0; i < 200; i++ {
+		servers = append(servers, Server{URL: fmt.Sprintf("http://gpu-%d:11434/api/chat", i/2), Model: []string{"llama3", "mistral"}[i%2]})
+	}
+	for _, count := range []int{1, 2, 3, 7} {
+		owners := make(map[string]int)
+		for index := 0; index < count; index++ {
+			owned := shardServers(servers, ShardConfig{Index: index, Count: count})
+			if count > 1 && len(owned) == 0 {
+				t.Errorf("%d shards: shard %d owns no servers", count, index)
+			}
+			for _, server := range owned {
+				if previous, ok := owners[serverKey(server)]; ok {
+					t.Errorf("%d shards: %s owned by shards %d and %d", count, serverKey(server), previous, index)
+				}
+				owners[serverKey(server)] = index
+			}
+		}
+		if len(owners) != len(servers) {
+			t.Errorf("%d shards own %d of %d servers", count, len(owners), len(servers))
+		}
+	}
+}
+
+func TestShardOfMovesOnlyAddedShardsServers(t *testing.T) {
+	moved := 0
+	const servers = 300
+	for i := 0; i < servers; i++ {
+		server := Server{URL: fmt.Sprintf("http://gpu-%d:11434/api/chat", i), Model: "llama3"}
+		before, after := shardOf(server, 3), shardOf(server, 4)
+		if before != after {
+			moved++
+			if after != 3 {
+				t.Errorf("%s moved from shard %d to %d, not to the added shard", server.URL, before, after)
+			}
+		}
+	}
+	if moved == 0 || moved > servers/2 {
+		t.Errorf("adding a fourth shard moved %d of %d servers", moved, servers)
+	}
+}
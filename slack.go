@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// slackWebhookURL is the Slack incoming webhook alerts are posted to, set by main from Config.SlackWebhookURL
+var slackWebhookURL string
+
+// slackClient posts Slack alerts, bounded so an unreachable Slack doesn't pile up goroutines
+var slackClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifySlack posts msg to the Slack webhook, if configured, in the background.
+// Delivery failures are only logged, alerts never hold up a check.
+func notifySlack(msg string) {
+	if slackWebhookURL == "" {
+		return
+	}
+	go func() {
+		if err := sendSlack(slackWebhookURL, msg); err != nil {
+			slog.Error("Failed to send Slack alert", "error", err)
+		}
+	}()
+}
+
+// sendSlack posts msg to the Slack webhook at webhookURL
+func sendSlack(webhookURL, msg string) error {
+	payload, err := json.Marshal(map[string]string{"text": msg})
+	if err != nil {
+		return err
+	}
+	resp, err := slackClient.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// crashAlert formats a crash event as a Slack message
+func crashAlert(event CrashEvent) string {
+	return fmt.Sprintf(":rotating_light: Crash on %s (model: %s, type: %s)", event.URL, event.Model, event.CrashType)
+}
+
+// circuitOpenAlert formats a restart refused by max_restarts_per_hour as a Slack message
+func circuitOpenAlert(event CrashEvent, target string, restarts int) string {
+	return fmt.Sprintf(":octagonal_sign: %s for %s (model: %s) was restarted %d times in the last hour, not restarting it again. Manual intervention needed.",
+		target, event.URL, event.Model, restarts)
+}
+
+// recoveredAlert formats a recovery as a Slack message
+func recoveredAlert(event RecoveryEvent) string {
+	return fmt.Sprintf(":white_check_mark: %s (model: %s) recovered after %d passed checks", event.URL, event.Model, event.Successes)
+}
+
+// digestAlert formats a digest's headline numbers and its flakiest servers as a Slack message
+func digestAlert(digest Digest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, ":bar_chart: Digest %s to %s: %d crashes, %d restarts (%d failed)",
+		digest.From.Format(time.RFC3339), digest.To.Format(time.RFC3339), digest.Crashes, digest.Restarts, digest.FailedRestarts)
+	for _, server := range digest.FlakiestServers {
+		fmt.Fprintf(&b, "\n• %s (model: %s): %d crashes", server.URL, server.Model, server.Crashes)
+		if server.UptimePercent != nil {
+			fmt.Fprintf(&b, ", %.2f%% uptime", *server.UptimePercent)
+		}
+	}
+	return b.String()
+}
+
+// restartFailedAlert formats a failed restart as a Slack message
+func restartFailedAlert(event RestartEvent) string {
+	return fmt.Sprintf(":x: Failed to restart %s for %s (model: %s): %s", event.target(), event.URL, event.Model, event.ErrorMessage)
+}
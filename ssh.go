@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialTimeout bounds connecting to and authenticating with a server's host
+const sshDialTimeout = 10 * time.Second
+
+// defaultSSHKeys are the private keys tried, in order, for servers without ssh_key_path
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshTarget splits a server's host, "[user@]host[:port]", into the user to log in as and the address to dial.
+// ssh_user takes precedence over a user in host.
+func sshTarget(server Server) (user, addr string) {
+	addr = server.Host
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		user, addr = addr[:i], addr[i+1:]
+	}
+	if server.SSHUser != "" {
+		user = server.SSHUser
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return user, addr
+}
+
+// sshSigner loads the server's ssh_key_path, or the first of the default keys in ~/.ssh that exists
+func sshSigner(server Server) (ssh.Signer, error) {
+	paths := []string{server.SSHKeyPath}
+	if server.SSHKeyPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("no ssh_key_path and no home directory: %v", err)
+		}
+		paths = paths[:0]
+		for _, name := range defaultSSHKeys {
+			paths = append(paths, filepath.Join(home, ".ssh", name))
+		}
+	}
+	for _, path := range paths {
+		key, err := os.ReadFile(path)
+		if os.IsNotExist(err) && server.SSHKeyPath == "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key %s: %v", path, err)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("no ssh_key_path and none of %s found in ~/.ssh", strings.Join(defaultSSHKeys, ", "))
+}
+
+// sshKnownHostsFile returns the known_hosts file host keys are verified against, ~/.ssh/known_hosts unless configured
+func sshKnownHostsFile(configured string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("no ssh_known_hosts and no home directory: %v", err)
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// checkKnownHosts loads the known_hosts file if any server is restarted over SSH, so a missing or malformed file
+// shows up at startup rather than at the first restart
+func checkKnownHosts(config *Config) error {
+	for _, server := range config.Servers {
+		if server.Host == "" || (server.RestartMode != "docker" && server.RestartMode != "systemd") {
+			continue
+		}
+		path, err := sshKnownHostsFile(config.SSHKnownHosts)
+		if err != nil {
+			return err
+		}
+		if _, err := knownhosts.New(path); err != nil {
+			return fmt.Errorf("failed to load known hosts: %v", err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// shellQuote quotes an argument for the POSIX shell the SSH server runs commands in
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// sshRun runs a command on the server's host over SSH and returns its output, or its stderr on failure.
+// The host key must be listed in knownHostsFile, see sshKnownHostsFile. Without a deadline on ctx the command is
+// bounded by defaultRestartTimeout, a hung host never holds a restart forever.
+func sshRun(ctx context.Context, server Server, knownHostsFile string, args ...string) (string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRestartTimeout)
+		defer cancel()
+	}
+	user, addr := sshTarget(server)
+	signer, err := sshSigner(server)
+	if err != nil {
+		return "", err
+	}
+	knownHostsFile, err = sshKnownHostsFile(knownHostsFile)
+	if err != nil {
+		return "", err
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to load known hosts: %v", err)
+	}
+
+	dialer := &net.Dialer{Timeout: sshDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	// The handshake has no context of its own, closing the connection aborts it and a running command
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	})
+	if err != nil {
+		conn.Close()
+		return "", fmt.Errorf("ssh %s@%s: %v", user, addr, err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err := session.Run(strings.Join(quoted, " ")); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// sshDockerRestarter restarts containers with the docker CLI of the server's host, reached over SSH, for hosts
+// whose Docker daemon isn't exposed to the watcher
+type sshDockerRestarter struct {
+	knownHostsFile string
+}
+
+// Restart implements Restarter
+func (r sshDockerRestarter) Restart(ctx context.Context, server Server) error {
+	_, err := sshRun(ctx, server, r.knownHostsFile, "docker", "restart", server.ContainerName)
+	return err
+}
+
+// Version implements Restarter
+func (r sshDockerRestarter) Version(ctx context.Context, server Server) (string, error) {
+	output, err := sshRun(ctx, server, r.knownHostsFile, "docker", "version", "--format", "{{.Server.Version}}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSHTarget(t *testing.T) {
+	tests := []struct {
+		server   Server
+		wantUser string
+		wantAddr string
+	}{
+		{Server{Host: "gpu1"}, "", "gpu1:22"},
+		{Server{Host: "root@gpu1"}, "root", "gpu1:22"},
+		{Server{Host: "root@gpu1:2222"}, "root", "gpu1:2222"},
+		{Server{Host: "root@gpu1", SSHUser: "ops"}, "ops", "gpu1:22"},
+		{Server{Host: "fe80::1"}, "", "[fe80::1]:22"},
+		{Server{Host: "[fe80::1]:2222"}, "", "[fe80::1]:2222"},
+	}
+	for _, tt := range tests {
+		user, addr := sshTarget(tt.server)
+		if user != tt.wantUser || addr != tt.wantAddr {
+			t.Errorf("sshTarget(%q) = %q, %q, want %q, %q", tt.server.Host, user, addr, tt.wantUser, tt.wantAddr)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"ollama", "'ollama'"},
+		{"", "''"},
+		{"{{.Server.Version}}", "'{{.Server.Version}}'"},
+		{"it's; rm -rf /", `'it'\''s; rm -rf /'`},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.arg); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestCheckKnownHosts(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "known_hosts")
+	line := "gpu1 ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"
+	if err := os.WriteFile(valid, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	malformed := filepath.Join(dir, "malformed")
+	if err := os.WriteFile(malformed, []byte("gpu1 ssh-ed25519 not-base64!\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		servers    []Server
+		wantErr    bool
+	}{
+		{"valid file", valid, []Server{{Host: "gpu1", RestartMode: "docker"}}, false},
+		{"missing file", filepath.Join(dir, "missing"), []Server{{Host: "gpu1", RestartMode: "systemd"}}, true},
+		{"malformed file", malformed, []Server{{Host: "gpu1", RestartMode: "docker"}}, true},
+		{"no server over SSH", filepath.Join(dir, "missing"), []Server{{RestartMode: "docker"}, {Host: "gpu1", RestartMode: "k8s"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkKnownHosts(&Config{SSHKnownHosts: tt.knownHosts, Servers: tt.servers})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkKnownHosts() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
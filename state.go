@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slog"
+)
+
+// checkSample is the outcome of a single check
+type checkSample struct {
+	Time    time.Time
+	Healthy bool
+	Latency time.Duration
+}
+
+// serverState tracks a server's results across checks
+type serverState struct {
+	URL            string
+	Model          string
+	StatusFailures int           // consecutive checks that returned a non-healthy status
+	FailureStreak  int           // consecutive failed checks of any kind
+	SuccessStreak  int           // consecutive passed checks
+	Down           bool          // failed and not yet passed recovery_quorum checks in a row since
+	Recent         []checkSample // most recent checks, oldest first, bounded by the health score window
+	LastResponse   *lastResponse `bson:"-"` // only kept for servers with store_last_response, never persisted
+	ResolvedAddrs  []string      // addresses the host last resolved to
+	Degrading      bool          // latency is rising faster than latency_trend.max_slope
+	LatencySlope   time.Duration // fitted latency change per hour over recent successful checks
+	CertSubject    string        // common name, or first DNS name, of the certificate presented over HTTPS
+	CertNotAfter   time.Time     // expiry of that certificate, zero for plain HTTP
+	CertWarnedFor  time.Time     // expiry of the certificate last warned about, so each is warned about once
+
+	OngoingCrashType string // with dedupe_crashes, the crash type of the open OngoingCrash further identical crashes are counted on
+}
+
+// DegradationEvent is published when a server's latency starts rising faster than the configured slope
+type DegradationEvent struct {
+	Timestamp         time.Time `json:"timestamp"`
+	URL               string    `json:"url"`
+	Model             string    `json:"model"`
+	SlopeMsPerHour    int64     `json:"slope_ms_per_hour"`
+	AvgLatencyMs      int64     `json:"avg_latency_ms"`
+	MaxSlopeMsPerHour int64     `json:"max_slope_ms_per_hour"`
+	SuccessfulSamples int       `json:"successful_samples"`
+}
+
+// lastResponse is the most recent response body received from a server, possibly truncated
+type lastResponse struct {
+	Time      time.Time
+	Status    int
+	Body      string
+	Truncated bool
+}
+
+// newLastResponse captures a response, keeping at most limit bytes of its body
+func newLastResponse(status int, body []byte, limit int) *lastResponse {
+	resp := &lastResponse{Time: time.Now(), Status: status}
+	if len(body) > limit {
+		body = body[:limit]
+		resp.Truncated = true
+	}
+	resp.Body = string(body)
+	return resp
+}
+
+// stateStore holds the state of every checked server
+type stateStore struct {
+	mu         sync.Mutex
+	states     map[string]*serverState
+	collection *mongo.Collection // where states are persisted after each check, set by restore
+}
+
+// persistedState is a server's state as stored in MongoDB
+type persistedState struct {
+	Key   string      `bson:"_id"`
+	State serverState `bson:"state"`
+}
+
+// serverStates is the state of all servers, keyed by serverKey
+var serverStates = newStateStore()
+
+// newStateStore returns an empty state store that isn't persisted
+func newStateStore() *stateStore {
+	return &stateStore{states: make(map[string]*serverState)}
+}
+
+// serverKey identifies a server in the state store
+func serverKey(server Server) string {
+	return server.URL + "|" + server.Model
+}
+
+// update applies fn to the server's state under lock and returns a copy of the result
+func (s *stateStore) update(server Server, fn func(*serverState)) serverState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[serverKey(server)]
+	if !ok {
+		state = &serverState{URL: server.URL, Model: server.Model}
+		s.states[serverKey(server)] = state
+	}
+	fn(state)
+	return state.snapshot()
+}
+
+// get returns a copy of the server's state, its zero state if it has none yet
+func (s *stateStore) get(server Server) serverState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[serverKey(server)]
+	if !ok {
+		return serverState{URL: server.URL, Model: server.Model}
+	}
+	return state.snapshot()
+}
+
+// recordCheck appends a check outcome to the server's recent history, keeping at most window samples
+func (s *stateStore) recordCheck(server Server, window int, healthy bool, latency time.Duration) {
+	s.update(server, func(state *serverState) {
+		state.Recent = append(state.Recent, checkSample{Time: time.Now(), Healthy: healthy, Latency: latency})
+		if len(state.Recent) > window {
+			state.Recent = state.Recent[len(state.Recent)-window:]
+		}
+		if healthy {
+			state.FailureStreak = 0
+			state.SuccessStreak++
+			// A passed check ends the run of crashes, the next one starts a new OngoingCrash
+			state.OngoingCrashType = ""
+		} else {
+			state.FailureStreak++
+			state.SuccessStreak = 0
+			state.Down = true
+		}
+	})
+}
+
+// RecoveryEvent is published when a server that was down has passed its recovery quorum
+type RecoveryEvent struct {
+	ID        primitive.ObjectID `json:"id"` // its alert's idempotency key derives from it
+	Timestamp time.Time          `json:"timestamp"`
+	URL       string             `json:"url"`
+	Model     string             `json:"model"`
+	Successes int                `json:"successes"` // consecutive passed checks that closed the incident
+}
+
+// detectRecovery marks a down server as up again once it has passed recovery_quorum checks in a row,
+// so a single lucky check after a run of failures doesn't close the incident. The recovery is logged, published
+// and alerted on.
+func (s *stateStore) detectRecovery(server Server) {
+	quorum := server.RecoveryQuorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	recovered := false
+	state := s.update(server, func(state *serverState) {
+		if state.Down && state.SuccessStreak >= quorum {
+			state.Down = false
+			recovered = true
+		}
+	})
+	if !recovered {
+		if state.Down && state.SuccessStreak > 0 {
+			slog.Debug("Passed check towards recovery", "url", server.URL, "model", server.Model, "success_streak", state.SuccessStreak, "quorum", quorum)
+		}
+		return
+	}
+
+	slog.Info("Recovered", "url", server.URL, "model", server.Model, "passed_checks", state.SuccessStreak)
+	event := RecoveryEvent{
+		ID:        primitive.NewObjectID(),
+		Timestamp: time.Now(),
+		URL:       server.URL,
+		Model:     server.Model,
+		Successes: state.SuccessStreak,
+	}
+	publisher.Publish("recovered", event)
+	notify("info", recoveredAlert(event), "recovered", alertKey("recovered", event.ID), event)
+}
+
+// detectDegradation fits the server's recent latencies and flags it as degrading when they rise
+// faster than the configured slope. Entering the degrading state is logged and published once.
+func (s *stateStore) detectDegradation(server Server, trend LatencyTrendConfig) {
+	if trend.MaxSlope <= 0 {
+		return
+	}
+	started := false
+	var samples int
+	state := s.update(server, func(state *serverState) {
+		state.LatencySlope, samples = latencySlope(state.Recent)
+		degrading := samples >= trend.MinSamples && state.LatencySlope > time.Duration(trend.MaxSlope)
+		started = degrading && !state.Degrading
+		state.Degrading = degrading
+	})
+	if !started {
+		return
+	}
+
+	slog.Warn("Degrading, latency rising", "url", server.URL, "model", server.Model, "slope_per_hour", state.LatencySlope.String())
+	publisher.Publish("degrading", DegradationEvent{
+		Timestamp:         time.Now(),
+		URL:               server.URL,
+		Model:             server.Model,
+		SlopeMsPerHour:    state.LatencySlope.Milliseconds(),
+		AvgLatencyMs:      avgLatency(state.Recent).Milliseconds(),
+		MaxSlopeMsPerHour: time.Duration(trend.MaxSlope).Milliseconds(),
+		SuccessfulSamples: samples,
+	})
+}
+
+// latencySlope fits a least-squares line through the latencies of the successful samples over time.
+// It returns the slope as latency change per hour and the number of samples used.
+func latencySlope(samples []checkSample) (time.Duration, int) {
+	var xs, ys []float64
+	for _, sample := range samples {
+		if !sample.Healthy {
+			continue
+		}
+		xs = append(xs, sample.Time.Sub(samples[0].Time).Hours())
+		ys = append(ys, float64(sample.Latency))
+	}
+	n := float64(len(xs))
+	if len(xs) < 2 {
+		return 0, len(xs)
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, len(xs)
+	}
+	return time.Duration((n*sumXY - sumX*sumY) / denominator), len(xs)
+}
+
+// restore loads the persisted states of the configured servers from collection, so streaks and recent
+// checks carry over a watcher restart. States are persisted to collection from then on, even if loading fails.
+func (s *stateStore) restore(collection *mongo.Collection, config *Config) error {
+	s.mu.Lock()
+	s.collection = collection
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var persisted []persistedState
+	if err := cursor.All(ctx, &persisted); err != nil {
+		return err
+	}
+
+	// Skip servers that have been removed from the config since the state was saved
+	configured := make(map[string]bool)
+	for _, server := range config.Servers {
+		configured[server.URL] = true
+		for _, endpoint := range server.Endpoints {
+			configured[endpoint] = true
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := 0
+	for _, p := range persisted {
+		if !configured[p.State.URL] {
+			continue
+		}
+		state := p.State
+		s.states[p.Key] = &state
+		restored++
+	}
+	slog.Info("Restored server state", "servers", restored)
+	return nil
+}
+
+// persist saves the server's current state, if a collection has been set up by restore
+func (s *stateStore) persist(server Server) {
+	s.mu.Lock()
+	collection := s.collection
+	state, ok := s.states[serverKey(server)]
+	var snapshot serverState
+	if ok {
+		snapshot = state.snapshot()
+	}
+	s.mu.Unlock()
+	if collection == nil || !ok {
+		return
+	}
+
+	key := serverKey(server)
+	_, err := collection.ReplaceOne(context.Background(), bson.M{"_id": key}, persistedState{Key: key, State: snapshot}, options.Replace().SetUpsert(true))
+	if err != nil {
+		slog.Error("Failed to persist state", "url", server.URL, "error", err)
+	}
+}
+
+// recordResolution stores the addresses the server's host resolved to and logs when they change
+func (s *stateStore) recordResolution(server Server, addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+	s.update(server, func(state *serverState) {
+		previous := strings.Join(state.ResolvedAddrs, ",")
+		current := strings.Join(sorted, ",")
+		if previous != "" && previous != current {
+			slog.Info("DNS changed", "url", server.URL, "previous", state.ResolvedAddrs, "current", sorted)
+		}
+		state.ResolvedAddrs = sorted
+	})
+}
+
+// all returns a copy of every tracked server's state, sorted by URL and model
+func (s *stateStore) all() []serverState {
+	s.mu.Lock()
+	states := make([]serverState, 0, len(s.states))
+	for _, state := range s.states {
+		states = append(states, state.snapshot())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].URL != states[j].URL {
+			return states[i].URL < states[j].URL
+		}
+		return states[i].Model < states[j].Model
+	})
+	return states
+}
+
+// snapshot returns a copy of the state that does not share its history with the store
+func (state *serverState) snapshot() serverState {
+	c := *state
+	c.Recent = append([]checkSample(nil), state.Recent...)
+	c.ResolvedAddrs = append([]string(nil), state.ResolvedAddrs...)
+	return c
+}
+
+// ServerStatus is a server's entry in the /status response
+type ServerStatus struct {
+	URL           string    `json:"url"`
+	Model         string    `json:"model"`
+	Score         *int      `json:"score"`   // 0-100, null until the server has been checked
+	Healthy       bool      `json:"healthy"` // false from a failed check until recovery_quorum checks in a row have passed
+	FailureStreak int       `json:"failure_streak"`
+	AvgLatencyMs  int64     `json:"avg_latency_ms"`
+	Checks        int       `json:"checks"`
+	LastCheck     time.Time `json:"last_check"`
+	ResolvedAddrs []string  `json:"resolved_addrs,omitempty"`
+	Degrading     bool      `json:"degrading"`
+	SlopeMsPerHr  int64     `json:"latency_slope_ms_per_hour"`
+}
+
+// serverStatuses summarizes the state of every checked server
+func serverStatuses(weights HealthScoreConfig) []ServerStatus {
+	states := serverStates.all()
+	statuses := make([]ServerStatus, 0, len(states))
+	for _, state := range states {
+		status := ServerStatus{
+			URL:           state.URL,
+			Model:         state.Model,
+			FailureStreak: state.FailureStreak,
+			AvgLatencyMs:  avgLatency(state.Recent).Milliseconds(),
+			Checks:        len(state.Recent),
+			ResolvedAddrs: state.ResolvedAddrs,
+			Degrading:     state.Degrading,
+			SlopeMsPerHr:  state.LatencySlope.Milliseconds(),
+		}
+		if n := len(state.Recent); n > 0 {
+			score := healthScore(state, weights)
+			status.Score = &score
+			status.Healthy = !state.Down
+			status.LastCheck = state.Recent[n-1].Time
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// healthScore rates a server from 0 to 100 as a weighted mean of three components, each in [0, 1]:
+//   - errors:  the fraction of recent checks that succeeded
+//   - latency: 1 - avg latency of successful checks / slow_latency, floored at 0
+//   - streak:  1 / (1 + consecutive failures)
+func healthScore(state serverState, weights HealthScoreConfig) int {
+	if len(state.Recent) == 0 {
+		return 0
+	}
+
+	successes := 0
+	for _, sample := range state.Recent {
+		if sample.Healthy {
+			successes++
+		}
+	}
+	errorScore := float64(successes) / float64(len(state.Recent))
+
+	latencyScore := 0.0
+	if successes > 0 {
+		latencyScore = math.Max(0, 1-float64(avgLatency(state.Recent))/float64(weights.SlowLatency))
+	}
+
+	streakScore := 1 / float64(1+state.FailureStreak)
+
+	total := weights.ErrorWeight + weights.LatencyWeight + weights.StreakWeight
+	score := (weights.ErrorWeight*errorScore + weights.LatencyWeight*latencyScore + weights.StreakWeight*streakScore) / total
+	return int(math.Round(100 * score))
+}
+
+// avgLatency returns the mean latency of the successful samples
+func avgLatency(samples []checkSample) time.Duration {
+	var sum time.Duration
+	n := 0
+	for _, sample := range samples {
+		if sample.Healthy {
+			sum += sample.Latency
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / time.Duration(n)
+}
+
+// LastResponse is an entry in the /servers/{url}/lastresponse response
+type LastResponse struct {
+	URL       string    `json:"url"`
+	Model     string    `json:"model"`
+	Timestamp time.Time `json:"timestamp"`
+	Status    int       `json:"status"`
+	Body      string    `json:"body"`
+	Truncated bool      `json:"truncated"`
+}
+
+// lastResponses returns the stored last response of every model checked at serverURL
+func lastResponses(serverURL string) []LastResponse {
+	var responses []LastResponse
+	for _, state := range serverStates.all() {
+		if state.URL != serverURL || state.LastResponse == nil {
+			continue
+		}
+		responses = append(responses, LastResponse{
+			URL:       state.URL,
+			Model:     state.Model,
+			Timestamp: state.LastResponse.Time,
+			Status:    state.LastResponse.Status,
+			Body:      state.LastResponse.Body,
+			Truncated: state.LastResponse.Truncated,
+		})
+	}
+	return responses
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"golang.org/x/exp/slog"
+)
+
+func TestStatePersistRestoreRoundTrip(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("round trip", func(mt *mtest.T) {
+		server := Server{URL: "http://a", Model: "llama3"}
+		saved := newStateStore()
+		saved.collection = mt.Coll
+		saved.recordCheck(server, 5, false, 0)
+		saved.recordCheck(server, 5, true, 2*time.Second)
+		saved.recordResolution(server, []string{"10.0.0.2", "10.0.0.1"})
+		saved.update(server, func(state *serverState) {
+			state.LastResponse = newLastResponse(200, []byte("patient record 1234"), 100)
+		})
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		saved.persist(server)
+		started := mt.GetStartedEvent()
+		if started == nil || started.CommandName != "update" {
+			t.Fatalf("persist sent %v, want an update", started)
+		}
+		replacement := started.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("u").Document()
+		if strings.Contains(replacement.String(), "patient record") {
+			t.Errorf("persisted state contains the last response: %s", replacement)
+		}
+
+		var doc bson.D
+		if err := bson.Unmarshal(replacement, &doc); err != nil {
+			t.Fatal(err)
+		}
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.Coll.Database().Name()+"."+mt.Coll.Name(), mtest.FirstBatch, doc))
+		restored := newStateStore()
+		if err := restored.restore(mt.Coll, &Config{Servers: []Server{server}}); err != nil {
+			t.Fatal(err)
+		}
+		got, want := restored.get(server), saved.get(server)
+		if got.SuccessStreak != want.SuccessStreak || got.Down != want.Down || len(got.Recent) != len(want.Recent) ||
+			strings.Join(got.ResolvedAddrs, ",") != strings.Join(want.ResolvedAddrs, ",") {
+			t.Errorf("restored state = %+v, want %+v", got, want)
+		}
+		if got.LastResponse != nil {
+			t.Errorf("restored last response = %+v, want none", got.LastResponse)
+		}
+	})
+}
+
+func TestNewLastResponse(t *testing.T) {
+	tests := []struct {
+		body          string
+		limit         int
+		want          string
+		wantTruncated bool
+	}{
+		{"", 10, "", false},
+		{"short", 10, "short", false},
+		{"exactly10!", 10, "exactly10!", false},
+		{"longer than the limit", 10, "longer tha", true},
+	}
+	for _, tt := range tests {
+		got := newLastResponse(200, []byte(tt.body), tt.limit)
+		if got.Body != tt.want || got.Truncated != tt.wantTruncated || got.Status != 200 {
+			t.Errorf("newLastResponse(%q, %d) = %+v, want body %q, truncated %v", tt.body, tt.limit, got, tt.want, tt.wantTruncated)
+		}
+	}
+}
+
+func TestDetectRecoveryWaitsForQuorum(t *testing.T) {
+	alerts := make(chan string, 10)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		alerts <- string(body)
+	}))
+	defer slack.Close()
+	withNotifiers(t, slack.URL, nil)
+
+	server := Server{URL: "http://a", Model: "llama3", RecoveryQuorum: 3}
+	store := newStateStore()
+	store.recordCheck(server, 10, false, 0)
+	for i := 1; i < server.RecoveryQuorum; i++ {
+		store.recordCheck(server, 10, true, time.Second)
+		store.detectRecovery(server)
+		if !store.get(server).Down {
+			t.Fatalf("recovered after %d passed checks, want %d", i, server.RecoveryQuorum)
+		}
+	}
+	select {
+	case alert := <-alerts:
+		t.Fatalf("alerted %q before the quorum was met", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	store.recordCheck(server, 10, true, time.Second)
+	store.detectRecovery(server)
+	if store.get(server).Down {
+		t.Fatalf("still down after %d passed checks", server.RecoveryQuorum)
+	}
+	select {
+	case alert := <-alerts:
+		if !strings.Contains(alert, "recovered after 3 passed checks") {
+			t.Errorf("recovery alert = %s", alert)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert when the quorum was met")
+	}
+
+	// Further passed checks don't recover it again
+	store.recordCheck(server, 10, true, time.Second)
+	store.detectRecovery(server)
+	select {
+	case alert := <-alerts:
+		t.Errorf("alerted %q again after recovering", alert)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRecordResolutionLogsChanges(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	server := Server{URL: "http://llm.internal:11434", Model: "llama3"}
+	store := newStateStore()
+	tests := []struct {
+		name    string
+		addrs   []string
+		wantLog bool
+	}{
+		{"first resolution", []string{"10.0.0.2", "10.0.0.1"}, false},
+		{"same addresses reordered", []string{"10.0.0.1", "10.0.0.2"}, false},
+		{"no addresses", nil, false},
+		{"moved", []string{"10.0.0.3"}, true},
+	}
+	for _, tt := range tests {
+		logs.Reset()
+		store.recordResolution(server, tt.addrs)
+		if logged := strings.Contains(logs.String(), "DNS changed"); logged != tt.wantLog {
+			t.Errorf("%s: logged %q, want a DNS change logged %v", tt.name, logs.String(), tt.wantLog)
+		}
+	}
+	if got := store.get(server).ResolvedAddrs; !reflect.DeepEqual(got, []string{"10.0.0.3"}) {
+		t.Errorf("resolved addresses = %v, want the new one", got)
+	}
+	if !strings.Contains(logs.String(), `"previous":["10.0.0.1","10.0.0.2"]`) {
+		t.Errorf("change logged as %s, want the previous addresses", logs.String())
+	}
+}
+
+// trendSamples returns a check every 10 minutes whose latency starts at 1s and changes by perHour
+func trendSamples(n int, perHour time.Duration) []checkSample {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var samples []checkSample
+	for i := 0; i < n; i++ {
+		elapsed := time.Duration(i) * 10 * time.Minute
+		samples = append(samples, checkSample{Time: start.Add(elapsed), Healthy: true,
+			Latency: time.Second + time.Duration(float64(perHour)*elapsed.Hours())})
+	}
+	return samples
+}
+
+func TestLatencySlope(t *testing.T) {
+	rising := trendSamples(6, 360*time.Millisecond)
+	withFailure := append(trendSamples(6, 360*time.Millisecond), checkSample{Time: rising[5].Time.Add(time.Minute), Latency: time.Minute})
+	tests := []struct {
+		name        string
+		samples     []checkSample
+		wantSlope   time.Duration
+		wantSamples int
+	}{
+		{"rising", rising, 360 * time.Millisecond, 6},
+		{"falling", trendSamples(4, -120*time.Millisecond), -120 * time.Millisecond, 4},
+		{"flat", trendSamples(5, 0), 0, 5},
+		{"failed checks left out", withFailure, 360 * time.Millisecond, 6},
+		{"single sample", rising[:1], 0, 1},
+		{"same time", []checkSample{rising[0], rising[0]}, 0, 2},
+		{"none", nil, 0, 0},
+	}
+	for _, tt := range tests {
+		slope, samples := latencySlope(tt.samples)
+		if diff := slope - tt.wantSlope; diff > time.Millisecond || diff < -time.Millisecond || samples != tt.wantSamples {
+			t.Errorf("%s: latencySlope() = %v, %d, want %v, %d", tt.name, slope, samples, tt.wantSlope, tt.wantSamples)
+		}
+	}
+}
+
+func TestDetectDegradation(t *testing.T) {
+	var logs bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	trend := LatencyTrendConfig{MaxSlope: Duration(200 * time.Millisecond), MinSamples: 4}
+	server := Server{URL: "http://a", Model: "llama3"}
+	tests := []struct {
+		name        string
+		samples     []checkSample
+		want        bool
+		wantStarted bool // crossing the threshold is logged and published once
+	}{
+		{"too few samples", trendSamples(3, time.Second), false, false},
+		{"below the threshold", trendSamples(6, 100*time.Millisecond), false, false},
+		{"above the threshold", trendSamples(6, 300*time.Millisecond), true, true},
+		{"still above", trendSamples(7, 300*time.Millisecond), true, false},
+		{"levelled off", trendSamples(6, 0), false, false},
+		{"rising again", trendSamples(6, 300*time.Millisecond), true, true},
+	}
+	store := newStateStore()
+	for _, tt := range tests {
+		logs.Reset()
+		store.update(server, func(state *serverState) { state.Recent = tt.samples })
+		store.detectDegradation(server, trend)
+		if got := store.get(server).Degrading; got != tt.want {
+			t.Errorf("%s: degrading = %v, want %v", tt.name, got, tt.want)
+		}
+		if started := strings.Contains(logs.String(), "Degrading, latency rising"); started != tt.wantStarted {
+			t.Errorf("%s: logged %q, want degradation started %v", tt.name, logs.String(), tt.wantStarted)
+		}
+	}
+
+	disabled := newStateStore()
+	disabled.update(server, func(state *serverState) { state.Recent = trendSamples(6, time.Second) })
+	disabled.detectDegradation(server, LatencyTrendConfig{})
+	if disabled.get(server).Degrading {
+		t.Error("degrading without a max_slope")
+	}
+}
+
+func TestHealthScore(t *testing.T) {
+	defaults := HealthScoreConfig{ErrorWeight: 2, LatencyWeight: 1, StreakWeight: 1, SlowLatency: Duration(10 * time.Second)}
+	samples := func(healthy ...time.Duration) []checkSample {
+		var recent []checkSample
+		for _, latency := range healthy {
+			// A zero latency stands for a failed check
+			recent = append(recent, checkSample{Healthy: latency > 0, Latency: latency})
+		}
+		return recent
+	}
+	tests := []struct {
+		name    string
+		state   serverState
+		weights HealthScoreConfig
+		want    int
+	}{
+		{"no checks yet", serverState{}, defaults, 0},
+		{"healthy", serverState{Recent: samples(2*time.Second, 2*time.Second)}, defaults, 95},
+		{"slower than slow_latency", serverState{Recent: samples(20*time.Second, 20*time.Second)}, defaults, 75},
+		{"half failing", serverState{Recent: samples(5*time.Second, 5*time.Second, 0, 0), FailureStreak: 2}, defaults, 46},
+		{"all failing", serverState{Recent: samples(0, 0, 0, 0), FailureStreak: 4}, defaults, 5},
+		{"latency only", serverState{Recent: samples(2*time.Second, 0), FailureStreak: 1}, HealthScoreConfig{LatencyWeight: 1, SlowLatency: Duration(10 * time.Second)}, 80},
+	}
+	for _, tt := range tests {
+		if got := healthScore(tt.state, tt.weights); got != tt.want {
+			t.Errorf("%s: healthScore() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
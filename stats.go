@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stats is the overview of the stored events served by /stats
+type Stats struct {
+	Since          *time.Time     `json:"since,omitempty"` // start of the window, null for all stored events
+	Crashes        int            `json:"crashes"`
+	CrashesByType  map[string]int `json:"crashes_by_type"`
+	CrashesByURL   map[string]int `json:"crashes_by_url"`
+	CrashesLast24h int            `json:"crashes_last_24h"` // within the window too
+	Restarts       int            `json:"restarts"`
+	FailedRestarts int            `json:"failed_restarts"`
+	RestartSuccess *float64       `json:"restart_success_rate"` // 0-1, null without restarts
+	MTTR           []ServerMTTR   `json:"mttr"`                 // per server with crashes in the window
+}
+
+// ServerMTTR is a server's mean time to recovery: the mean time from the first crash of an outage to the next
+// passed check, which ends it
+type ServerMTTR struct {
+	URL         string     `json:"url"`
+	Model       string     `json:"model"`
+	Recoveries  int        `json:"recoveries"`
+	MeanSeconds *float64   `json:"mean_seconds"`         // null without a recovery in the window
+	DownSince   *time.Time `json:"down_since,omitempty"` // first crash of an outage that hasn't recovered yet
+}
+
+// serverEvent is a crash or health event reduced to what MTTR needs. FirstSeen is set on an OngoingCrash,
+// whose timestamp moves to its latest repeat.
+type serverEvent struct {
+	Timestamp time.Time `bson:"timestamp"`
+	FirstSeen time.Time `bson:"first_seen"`
+	URL       string    `bson:"url"`
+	Model     string    `bson:"model"`
+}
+
+// start returns when the event began
+func (e serverEvent) start() time.Time {
+	if !e.FirstSeen.IsZero() {
+		return e.FirstSeen
+	}
+	return e.Timestamp
+}
+
+// computeMTTR pairs each server's outages with the passed check ending them. An outage starts at a crash and
+// takes in every further crash until the next passed check. Both slices must be sorted by start time.
+func computeMTTR(crashes, passes []serverEvent) []ServerMTTR {
+	passesByServer := make(map[string][]time.Time)
+	for _, pass := range passes {
+		key := pass.URL + "|" + pass.Model
+		passesByServer[key] = append(passesByServer[key], pass.start())
+	}
+
+	perServer := make(map[string]*ServerMTTR)
+	totals := make(map[string]time.Duration)
+	// recoveredAt is when each server's current outage ended, crashes before it belong to that outage
+	recoveredAt := make(map[string]time.Time)
+	var order []string
+	for _, crash := range crashes {
+		key := crash.URL + "|" + crash.Model
+		entry := perServer[key]
+		if entry == nil {
+			entry = &ServerMTTR{URL: crash.URL, Model: crash.Model}
+			perServer[key] = entry
+			order = append(order, key)
+		}
+		start := crash.start()
+		if entry.DownSince != nil || start.Before(recoveredAt[key]) {
+			continue
+		}
+		serverPasses := passesByServer[key]
+		i := sort.Search(len(serverPasses), func(i int) bool { return serverPasses[i].After(start) })
+		if i == len(serverPasses) {
+			entry.DownSince = &start
+			continue
+		}
+		recoveredAt[key] = serverPasses[i]
+		totals[key] += serverPasses[i].Sub(start)
+		entry.Recoveries++
+	}
+
+	mttr := make([]ServerMTTR, 0, len(order))
+	for _, key := range order {
+		entry := perServer[key]
+		if entry.Recoveries > 0 {
+			mean := (totals[key] / time.Duration(entry.Recoveries)).Seconds()
+			entry.MeanSeconds = &mean
+		}
+		mttr = append(mttr, *entry)
+	}
+	sort.Slice(mttr, func(i, j int) bool {
+		if mttr[i].URL != mttr[j].URL {
+			return mttr[i].URL < mttr[j].URL
+		}
+		return mttr[i].Model < mttr[j].Model
+	})
+	return mttr
+}
+
+// findServerEvents returns the events of collection matching filter, oldest first
+func findServerEvents(ctx context.Context, collection *mongo.Collection, filter bson.M) ([]serverEvent, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.M{"timestamp": 1, "first_seen": 1, "url": 1, "model": 1})
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var events []serverEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].start().Before(events[j].start()) })
+	return events, nil
+}
+
+// statsGroup is a count per value of the grouped field, as returned by the stats pipelines
+type statsGroup struct {
+	ID    string `bson:"_id"`
+	Count int    `bson:"count"`
+}
+
+// crashCount sums the crashes a crash_events document stands for: 1, or the count of an OngoingCrash
+var crashCount = bson.M{"$sum": bson.M{"$ifNull": bson.A{"$count", 1}}}
+
+// buildStats aggregates the crash and restart events since since, or all of them if since is zero.
+// Model pulls are not counted as restarts. MTTR pairs the crashes with the health events of passed checks.
+func buildStats(since time.Time, crashCollection, restartCollection, healthCollection *mongo.Collection) (Stats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stats := Stats{CrashesByType: make(map[string]int), CrashesByURL: make(map[string]int)}
+	crashMatch := bson.M{"crash_type": actualCrashes["crash_type"]}
+	restartMatch := bson.M{"action": bson.M{"$ne": "pull"}}
+	if !since.IsZero() {
+		stats.Since = &since
+		crashMatch["timestamp"] = bson.M{"$gte": since}
+		restartMatch["timestamp"] = bson.M{"$gte": since}
+	}
+
+	var crashFacets []struct {
+		ByType  []statsGroup `bson:"by_type"`
+		ByURL   []statsGroup `bson:"by_url"`
+		Last24h []statsGroup `bson:"last_24h"`
+	}
+	cursor, err := crashCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: crashMatch}},
+		{{Key: "$facet", Value: bson.M{
+			"by_type": bson.A{bson.M{"$group": bson.M{"_id": "$crash_type", "count": crashCount}}},
+			"by_url":  bson.A{bson.M{"$group": bson.M{"_id": "$url", "count": crashCount}}},
+			"last_24h": bson.A{
+				bson.M{"$match": bson.M{"timestamp": bson.M{"$gte": time.Now().Add(-24 * time.Hour)}}},
+				bson.M{"$group": bson.M{"_id": nil, "count": crashCount}},
+			},
+		}}},
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	if err := cursor.All(ctx, &crashFacets); err != nil {
+		return Stats{}, err
+	}
+	if len(crashFacets) > 0 {
+		for _, group := range crashFacets[0].ByType {
+			stats.CrashesByType[group.ID] = group.Count
+			stats.Crashes += group.Count
+		}
+		for _, group := range crashFacets[0].ByURL {
+			stats.CrashesByURL[group.ID] = group.Count
+		}
+		for _, group := range crashFacets[0].Last24h {
+			stats.CrashesLast24h += group.Count
+		}
+	}
+
+	var restartGroups []statsGroup
+	cursor, err = restartCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: restartMatch}},
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	if err := cursor.All(ctx, &restartGroups); err != nil {
+		return Stats{}, err
+	}
+	for _, group := range restartGroups {
+		stats.Restarts += group.Count
+		if group.ID != "success" {
+			stats.FailedRestarts += group.Count
+		}
+	}
+	if stats.Restarts > 0 {
+		rate := float64(stats.Restarts-stats.FailedRestarts) / float64(stats.Restarts)
+		stats.RestartSuccess = &rate
+	}
+
+	crashes, err := findServerEvents(ctx, crashCollection, crashMatch)
+	if err != nil {
+		return Stats{}, err
+	}
+	passMatch := bson.M{"failed": passedChecks["failed"]}
+	if !since.IsZero() {
+		passMatch["timestamp"] = bson.M{"$gte": since}
+	}
+	passes, err := findServerEvents(ctx, healthCollection, passMatch)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.MTTR = computeMTTR(crashes, passes)
+	return stats, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeMTTR(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+	event := func(url string, minutes int) serverEvent {
+		return serverEvent{Timestamp: at(minutes), URL: url, Model: "llama3"}
+	}
+	seconds := func(s float64) *float64 { return &s }
+
+	tests := []struct {
+		name    string
+		crashes []serverEvent
+		passes  []serverEvent
+		want    []ServerMTTR
+	}{
+		{
+			name:    "single recovery",
+			crashes: []serverEvent{event("http://a", 0)},
+			passes:  []serverEvent{event("http://a", 5)},
+			want:    []ServerMTTR{{URL: "http://a", Model: "llama3", Recoveries: 1, MeanSeconds: seconds(300)}},
+		},
+		{
+			name:    "mean of two outages",
+			crashes: []serverEvent{event("http://a", 0), event("http://a", 20)},
+			passes:  []serverEvent{event("http://a", 2), event("http://a", 30)},
+			want:    []ServerMTTR{{URL: "http://a", Model: "llama3", Recoveries: 2, MeanSeconds: seconds(360)}},
+		},
+		{
+			name:    "repeated crashes are one outage from the first",
+			crashes: []serverEvent{event("http://a", 0), event("http://a", 1), event("http://a", 2)},
+			passes:  []serverEvent{event("http://a", 4)},
+			want:    []ServerMTTR{{URL: "http://a", Model: "llama3", Recoveries: 1, MeanSeconds: seconds(240)}},
+		},
+		{
+			name:    "ongoing crash starts at first_seen",
+			crashes: []serverEvent{{Timestamp: at(9), FirstSeen: at(1), URL: "http://a", Model: "llama3"}},
+			passes:  []serverEvent{event("http://a", 11)},
+			want:    []ServerMTTR{{URL: "http://a", Model: "llama3", Recoveries: 1, MeanSeconds: seconds(600)}},
+		},
+		{
+			name:    "never recovered",
+			crashes: []serverEvent{event("http://a", 3)},
+			passes:  []serverEvent{event("http://a", 1)},
+			want:    []ServerMTTR{{URL: "http://a", Model: "llama3", DownSince: timePtr(at(3))}},
+		},
+		{
+			name:    "recovered, then down again",
+			crashes: []serverEvent{event("http://a", 0), event("http://a", 10)},
+			passes:  []serverEvent{event("http://a", 1)},
+			want:    []ServerMTTR{{URL: "http://a", Model: "llama3", Recoveries: 1, MeanSeconds: seconds(60), DownSince: timePtr(at(10))}},
+		},
+		{
+			name:    "passes of other servers don't count",
+			crashes: []serverEvent{event("http://a", 0), event("http://b", 0)},
+			passes:  []serverEvent{event("http://b", 2)},
+			want: []ServerMTTR{
+				{URL: "http://a", Model: "llama3", DownSince: timePtr(at(0))},
+				{URL: "http://b", Model: "llama3", Recoveries: 1, MeanSeconds: seconds(120)},
+			},
+		},
+		{
+			name: "no crashes",
+			want: []ServerMTTR{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := computeMTTR(tt.crashes, tt.passes)
+			if len(got) != len(tt.want) {
+				t.Fatalf("computeMTTR() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if g.URL != w.URL || g.Model != w.Model || g.Recoveries != w.Recoveries {
+					t.Errorf("entry %d = %+v, want %+v", i, g, w)
+				}
+				if (g.MeanSeconds == nil) != (w.MeanSeconds == nil) || (g.MeanSeconds != nil && *g.MeanSeconds != *w.MeanSeconds) {
+					t.Errorf("entry %d mean = %v, want %v", i, deref(g.MeanSeconds), deref(w.MeanSeconds))
+				}
+				if (g.DownSince == nil) != (w.DownSince == nil) || (g.DownSince != nil && !g.DownSince.Equal(*w.DownSince)) {
+					t.Errorf("entry %d down since = %v, want %v", i, g.DownSince, w.DownSince)
+				}
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+func deref(f *float64) interface{} {
+	if f == nil {
+		return nil
+	}
+	return *f
+}
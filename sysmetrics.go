@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSystemMetrics are the series attached to crash events when a server sets metrics_url but not metrics:
+// node_exporter load and memory, and DCGM exporter GPU utilisation and framebuffer memory
+var defaultSystemMetrics = []string{
+	"node_load1",
+	"node_memory_MemAvailable_bytes",
+	"node_memory_MemTotal_bytes",
+	"DCGM_FI_DEV_GPU_UTIL",
+	"DCGM_FI_DEV_FB_USED",
+	"DCGM_FI_DEV_FB_FREE",
+}
+
+// SystemMetric is one sample scraped from a server's metrics_url
+type SystemMetric struct {
+	Series string  `bson:"series" json:"series"` // as written on the page, e.g. `DCGM_FI_DEV_GPU_UTIL{gpu="0"}`
+	Value  float64 `bson:"value" json:"value"`
+}
+
+const (
+	systemMetricsTimeout   = 3 * time.Second
+	systemMetricsMaxBytes  = 4 << 20 // node_exporter pages are typically a few hundred KB
+	systemMetricsMaxSeries = 64
+)
+
+// fetchSystemMetrics scrapes the server's metrics_url and returns the current value of every series of the
+// configured metrics, in page order. The scrape is bounded in time, size and number of series,
+// since it runs while a crash is being recorded.
+func fetchSystemMetrics(server Server) ([]SystemMetric, error) {
+	names := server.Metrics
+	if len(names) == 0 {
+		names = defaultSystemMetrics
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), systemMetricsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.MetricsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialContext(&net.Dialer{Timeout: systemMetricsTimeout}, server.DNSOverrides),
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics endpoint returned %s", resp.Status)
+	}
+
+	var metrics []SystemMetric
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, systemMetricsMaxBytes))
+	scanner.Buffer(make([]byte, 64<<10), 64<<10)
+	for scanner.Scan() && len(metrics) < systemMetricsMaxSeries {
+		series, value, ok := parseMetricLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		name := series
+		if i := strings.IndexByte(series, '{'); i >= 0 {
+			name = series[:i]
+		}
+		if wanted[name] {
+			metrics = append(metrics, SystemMetric{Series: series, Value: value})
+		}
+	}
+	return metrics, scanner.Err()
+}
+
+// parseMetricLine splits a Prometheus text format sample line into its series and value.
+// Comments, blank lines and unparsable values are reported as not ok.
+func parseMetricLine(line string) (series string, value float64, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", 0, false
+	}
+	// Label values may contain spaces, so the value starts after the closing brace if there is one
+	rest := line
+	if i := strings.LastIndexByte(line, '}'); i >= 0 {
+		series, rest = line[:i+1], line[i+1:]
+	} else if i := strings.IndexByte(line, ' '); i >= 0 {
+		series, rest = line[:i], line[i:]
+	} else {
+		return "", 0, false
+	}
+	fields := strings.Fields(rest) // value, optionally followed by a timestamp
+	if len(fields) == 0 {
+		return "", 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return series, value, true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseMetricLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		wantSeries string
+		wantValue  float64
+		wantOK     bool
+	}{
+		{"node_load1 0.52", "node_load1", 0.52, true},
+		{`DCGM_FI_DEV_GPU_UTIL{gpu="0",modelName="NVIDIA A100"} 97`, `DCGM_FI_DEV_GPU_UTIL{gpu="0",modelName="NVIDIA A100"}`, 97, true},
+		{"node_memory_MemAvailable_bytes 1.2e+10 1715000000000", "node_memory_MemAvailable_bytes", 1.2e10, true},
+		{"# HELP node_load1 1m load average.", "", 0, false},
+		{"", "", 0, false},
+		{"node_load1", "", 0, false},
+		{"node_load1 high", "", 0, false},
+	}
+	for _, tt := range tests {
+		series, value, ok := parseMetricLine(tt.line)
+		if series != tt.wantSeries || value != tt.wantValue || ok != tt.wantOK {
+			t.Errorf("parseMetricLine(%q) = %q, %v, %v, want %q, %v, %v", tt.line, series, value, ok, tt.wantSeries, tt.wantValue, tt.wantOK)
+		}
+	}
+}
+
+func TestFetchSystemMetrics(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`# HELP node_load1 1m load average.
+# TYPE node_load1 gauge
+node_load1 3.5
+node_load15 1.25
+node_memory_MemAvailable_bytes 2.5e+09
+DCGM_FI_DEV_GPU_UTIL{gpu="0"} 100
+DCGM_FI_DEV_GPU_UTIL{gpu="1"} 12
+`))
+	}))
+	defer exporter.Close()
+
+	tests := []struct {
+		name    string
+		server  Server
+		want    []SystemMetric
+		wantErr bool
+	}{
+		{
+			name:   "default metrics",
+			server: Server{MetricsURL: exporter.URL + "/metrics"},
+			want: []SystemMetric{
+				{"node_load1", 3.5},
+				{"node_memory_MemAvailable_bytes", 2.5e9},
+				{`DCGM_FI_DEV_GPU_UTIL{gpu="0"}`, 100},
+				{`DCGM_FI_DEV_GPU_UTIL{gpu="1"}`, 12},
+			},
+		},
+		{
+			name:   "configured metrics",
+			server: Server{MetricsURL: exporter.URL + "/metrics", Metrics: []string{"node_load15"}},
+			want:   []SystemMetric{{"node_load15", 1.25}},
+		},
+		{name: "not found", server: Server{MetricsURL: exporter.URL + "/missing"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := fetchSystemMetrics(tt.server)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: fetchSystemMetrics() = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// systemdUnitPattern matches the unit names service_name accepts
+var systemdUnitPattern = regexp.MustCompile(`^[A-Za-z0-9:_.@-]+$`)
+
+// systemdRestarter restarts servers installed as systemd units with systemctl, on the watcher's host or over
+// SSH on the server's host. Running systemctl in the watcher's container only works with the host's systemd
+// reachable from it, bare-metal hosts are usually restarted over SSH.
+type systemdRestarter struct {
+	knownHostsFile string
+}
+
+// runSystemctl runs systemctl on the server's host and returns its output, or its stderr on failure
+func (r systemdRestarter) runSystemctl(ctx context.Context, server Server, args ...string) (string, error) {
+	if server.Host != "" {
+		return sshRun(ctx, server, r.knownHostsFile, append([]string{"systemctl"}, args...)...)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "systemctl", args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// Restart implements Restarter
+func (r systemdRestarter) Restart(ctx context.Context, server Server) error {
+	_, err := r.runSystemctl(ctx, server, "restart", server.ServiceName)
+	return err
+}
+
+// Version implements Restarter, returning the version line of systemctl --version, e.g. "systemd 252 (252.22-1)"
+func (r systemdRestarter) Version(ctx context.Context, server Server) (string, error) {
+	output, err := r.runSystemctl(ctx, server, "--version")
+	if err != nil {
+		return "", err
+	}
+	return strings.SplitN(strings.TrimSpace(output), "\n", 2)[0], nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTiming breaks down how long a probe request spent in each phase, to tell slow DNS, connects or
+// TLS handshakes apart from a slow model. Phases skipped because a kept-alive connection was reused are 0.
+type RequestTiming struct {
+	DNSMs     int64 `bson:"dns_ms" json:"dns_ms"`
+	ConnectMs int64 `bson:"connect_ms" json:"connect_ms"`
+	TLSMs     int64 `bson:"tls_ms" json:"tls_ms"`
+	TTFBMs    int64 `bson:"ttfb_ms" json:"ttfb_ms"`   // from starting the request to the first response byte, 0 without a response
+	TotalMs   int64 `bson:"total_ms" json:"total_ms"` // the check's recorded latency
+}
+
+// timingTrace records the phase timestamps of one request attempt.
+// Dialing happens on the transport's goroutines, hence the lock.
+type timingTrace struct {
+	mu                        sync.Mutex
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+// newTimingTrace starts timing a request attempt
+func newTimingTrace() *timingTrace {
+	return &timingTrace{start: time.Now()}
+}
+
+// mark sets *t to now unless it is already set, so with several dial attempts a phase starts at the first
+func (tt *timingTrace) mark(t *time.Time) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+// markLast sets *t to now, so with several dial attempts a phase ends at the last
+func (tt *timingTrace) markLast(t *time.Time) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	*t = time.Now()
+}
+
+// clientTrace returns the hooks recording the attempt's phases
+func (tt *timingTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { tt.mark(&tt.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { tt.markLast(&tt.dnsDone) },
+		ConnectStart:         func(string, string) { tt.mark(&tt.connectStart) },
+		ConnectDone:          func(string, string, error) { tt.markLast(&tt.connectDone) },
+		TLSHandshakeStart:    func() { tt.mark(&tt.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { tt.markLast(&tt.tlsDone) },
+		GotFirstResponseByte: func() { tt.mark(&tt.firstByte) },
+	}
+}
+
+// result returns the attempt's timing breakdown, with total as the total, or nil if no attempt was made
+func (tt *timingTrace) result(total time.Duration) *RequestTiming {
+	if tt == nil {
+		return nil
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	span := func(from, to time.Time) int64 {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from).Milliseconds()
+	}
+	return &RequestTiming{
+		DNSMs:     span(tt.dnsStart, tt.dnsDone),
+		ConnectMs: span(tt.connectStart, tt.connectDone),
+		TLSMs:     span(tt.tlsStart, tt.tlsDone),
+		TTFBMs:    span(tt.start, tt.firstByte),
+		TotalMs:   total.Milliseconds(),
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+	"time"
+)
+
+func TestTimingTrace(t *testing.T) {
+	if got := (*timingTrace)(nil).result(time.Second); got != nil {
+		t.Errorf("result of no attempt = %+v, want nil", got)
+	}
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+	}))
+	defer backend.Close()
+	client := backend.Client()
+	get := func() *timingTrace {
+		trace := newTimingTrace()
+		req, err := http.NewRequest(http.MethodGet, backend.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace.clientTrace())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return trace
+	}
+
+	first := get()
+	if first.connectStart.IsZero() || first.connectDone.IsZero() || first.tlsStart.IsZero() || first.tlsDone.IsZero() {
+		t.Errorf("new connection: connect %v-%v, TLS %v-%v, want all set",
+			first.connectStart, first.connectDone, first.tlsStart, first.tlsDone)
+	}
+	if !first.dnsStart.IsZero() {
+		t.Errorf("DNS started at %v for an IP address", first.dnsStart)
+	}
+	timing := first.result(time.Since(first.start))
+	if timing.TTFBMs < 30 || timing.TotalMs < timing.TTFBMs {
+		t.Errorf("timing = %+v, want ttfb of at least the handler's 30ms and total at least ttfb", timing)
+	}
+
+	reused := get().result(50 * time.Millisecond)
+	if reused.DNSMs != 0 || reused.ConnectMs != 0 || reused.TLSMs != 0 {
+		t.Errorf("kept-alive connection timing = %+v, want no dns, connect or tls", reused)
+	}
+	if reused.TTFBMs < 30 || reused.TotalMs != 50 {
+		t.Errorf("kept-alive connection timing = %+v, want ttfb of at least 30ms and total 50", reused)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultUptimeWindow is the window /uptime covers when since is not given
+const defaultUptimeWindow = 30 * 24 * time.Hour
+
+// ServerUptime is a server's availability over a window, as served by /uptime
+type ServerUptime struct {
+	URL           string   `json:"url"`
+	Model         string   `json:"model"`
+	UptimePercent *float64 `json:"uptime_percent"` // 0-100, null without any check in the window
+	Checks        int      `json:"checks"`
+	Failures      int      `json:"failures"`
+}
+
+// serverChecks counts a server's checks and failed checks, as returned by the uptime pipeline
+type serverChecks struct {
+	ID struct {
+		URL   string `bson:"url"`
+		Model string `bson:"model"`
+	} `bson:"_id"`
+	Checks   int `bson:"checks"`
+	Failures int `bson:"failures"`
+}
+
+// countChecks counts the checks recorded as health events in [since, until) per url and model, and how many of
+// them failed
+func countChecks(ctx context.Context, healthCollection *mongo.Collection, since, until time.Time) ([]serverChecks, error) {
+	cursor, err := healthCollection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": since, "$lt": until}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      bson.M{"url": "$url", "model": "$model"},
+			"checks":   bson.M{"$sum": 1},
+			"failures": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$failed", true}}, 1, 0}}},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var counts []serverChecks
+	return counts, cursor.All(ctx, &counts)
+}
+
+// buildUptime computes each server's uptime in [since, until): its passed checks out of all its checks, failed
+// ones counting whether or not they reached status_failure_threshold and were recorded as crashes. Every enabled server
+// of servers is listed, even without checks in the window, as are servers with checks in it that have since
+// been removed.
+func buildUptime(servers []Server, since, until time.Time, healthCollection *mongo.Collection) ([]ServerUptime, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	counts, err := countChecks(ctx, healthCollection, since, until)
+	if err != nil {
+		return nil, err
+	}
+	return compileUptime(servers, counts), nil
+}
+
+// compileUptime lists the uptime of the enabled servers and of those with counts
+func compileUptime(servers []Server, counts []serverChecks) []ServerUptime {
+	perServer := make(map[string]*ServerUptime)
+	serverEntry := func(url, model string) *ServerUptime {
+		key := url + "|" + model
+		if perServer[key] == nil {
+			perServer[key] = &ServerUptime{URL: url, Model: model}
+		}
+		return perServer[key]
+	}
+	for _, server := range servers {
+		if server.Enabled == nil || *server.Enabled {
+			serverEntry(server.URL, server.Model)
+		}
+	}
+	for _, count := range counts {
+		entry := serverEntry(count.ID.URL, count.ID.Model)
+		entry.Checks += count.Checks
+		entry.Failures += count.Failures
+	}
+
+	uptimes := make([]ServerUptime, 0, len(perServer))
+	for _, entry := range perServer {
+		if entry.Checks > 0 {
+			percent := 100 * float64(entry.Checks-entry.Failures) / float64(entry.Checks)
+			entry.UptimePercent = &percent
+		}
+		uptimes = append(uptimes, *entry)
+	}
+	sort.Slice(uptimes, func(i, j int) bool {
+		if uptimes[i].URL != uptimes[j].URL {
+			return uptimes[i].URL < uptimes[j].URL
+		}
+		return uptimes[i].Model < uptimes[j].Model
+	})
+	return uptimes
+}
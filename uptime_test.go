@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestCompileUptime(t *testing.T) {
+	disabled := false
+	percent := func(p float64) *float64 { return &p }
+	counts := func(url string, checks, failures int) serverChecks {
+		var c serverChecks
+		c.ID.URL, c.ID.Model = url, "llama3"
+		c.Checks, c.Failures = checks, failures
+		return c
+	}
+	tests := []struct {
+		name    string
+		servers []Server
+		counts  []serverChecks
+		want    []ServerUptime
+	}{
+		{
+			name:    "configured server without checks",
+			servers: []Server{{URL: "http://a", Model: "llama3"}},
+			want:    []ServerUptime{{URL: "http://a", Model: "llama3"}},
+		},
+		{
+			name:    "failed checks below the threshold count",
+			servers: []Server{{URL: "http://a", Model: "llama3"}},
+			counts:  []serverChecks{counts("http://a", 8, 2)},
+			want:    []ServerUptime{{URL: "http://a", Model: "llama3", Checks: 8, Failures: 2, UptimePercent: percent(75)}},
+		},
+		{
+			name:    "disabled servers are left out",
+			servers: []Server{{URL: "http://a", Model: "llama3"}, {URL: "http://b", Model: "llama3", Enabled: &disabled}},
+			want:    []ServerUptime{{URL: "http://a", Model: "llama3"}},
+		},
+		{
+			name:   "removed server with checks in the window",
+			counts: []serverChecks{counts("http://gone", 4, 4)},
+			want:   []ServerUptime{{URL: "http://gone", Model: "llama3", Checks: 4, Failures: 4, UptimePercent: percent(0)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compileUptime(tt.servers, tt.counts)
+			if len(got) != len(tt.want) {
+				t.Fatalf("compileUptime() = %+v, want %+v", got, tt.want)
+			}
+			for i, w := range tt.want {
+				g := got[i]
+				if g.URL != w.URL || g.Model != w.Model || g.Checks != w.Checks || g.Failures != w.Failures {
+					t.Errorf("entry %d = %+v, want %+v", i, g, w)
+				}
+				if deref(g.UptimePercent) != deref(w.UptimePercent) {
+					t.Errorf("entry %d uptime = %v, want %v", i, deref(g.UptimePercent), deref(w.UptimePercent))
+				}
+			}
+		})
+	}
+}
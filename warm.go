@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// warmTimeout bounds the requests that open a server's warm connections
+const warmTimeout = 5 * time.Second
+
+// warmTransport is a long-lived transport and the settings it was built with
+type warmTransport struct {
+	settings  transportSettings
+	transport *http.Transport
+}
+
+// transportSettings are the settings a server's transport is built from, see newTransport. Other settings, such
+// as the model checked with check_mode "loaded", share the transport.
+type transportSettings struct {
+	DNSOverrides     map[string]string
+	Timeout          time.Duration
+	DisableKeepAlive bool
+	WarmConnections  int
+}
+
+// transportSettingsOf returns the settings the server's transport is built from
+func transportSettingsOf(server Server, config *Config) transportSettings {
+	return transportSettings{
+		DNSOverrides:     server.DNSOverrides,
+		Timeout:          checkTimeout(server, config),
+		DisableKeepAlive: server.DisableKeepAlive,
+		WarmConnections:  server.WarmConnections,
+	}
+}
+
+// warmTransports holds the transports of servers with warm_connections, keyed by URL, so their idle
+// connections survive from one check to the next
+var warmTransports = struct {
+	sync.Mutex
+	transports map[string]warmTransport
+}{transports: make(map[string]warmTransport)}
+
+// transportFor returns the transport to check a server with: a fresh one, or the server's long-lived one
+// if it keeps warm connections. A long-lived transport is replaced once the settings it was built with change,
+// see transportSettings.
+func transportFor(server Server, config *Config) *http.Transport {
+	if server.WarmConnections == 0 {
+		return newTransport(server, config)
+	}
+	warmTransports.Lock()
+	defer warmTransports.Unlock()
+	settings := transportSettingsOf(server, config)
+	warm, ok := warmTransports.transports[server.URL]
+	if ok && reflect.DeepEqual(warm.settings, settings) {
+		return warm.transport
+	}
+	if ok {
+		warm.transport.CloseIdleConnections()
+	}
+	transport := newTransport(server, config)
+	transport.MaxIdleConnsPerHost = server.WarmConnections
+	warmTransports.transports[server.URL] = warmTransport{settings: settings, transport: transport}
+	return transport
+}
+
+// dropWarmTransports closes the warm connections of a server no longer checked, to its URL and endpoints
+func dropWarmTransports(server Server) {
+	warmTransports.Lock()
+	defer warmTransports.Unlock()
+	for _, endpoint := range append([]string{server.URL}, server.Endpoints...) {
+		if warm, ok := warmTransports.transports[endpoint]; ok {
+			warm.transport.CloseIdleConnections()
+			delete(warmTransports.transports, endpoint)
+		}
+	}
+}
+
+// warmConnections fills the transport's idle pool up to the server's warm_connections by sending that many
+// concurrent GETs to the root of target's host, which Ollama answers without touching a model. Connections
+// already idle are reused, so this only dials the ones that were closed since the last check. Each GET
+// takes a max_requests_per_host slot, so warming never sends the host more requests than that.
+func warmConnections(client *http.Client, server Server, config *Config, target *url.URL) {
+	root := url.URL{Scheme: target.Scheme, Host: target.Host, Path: "/"}
+	ctx, cancel := context.WithTimeout(context.Background(), warmTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < server.WarmConnections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := hostRequests.acquire(root.Host, config.MaxRequestsPerHost)
+			defer release()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, root.String(), nil)
+			if err != nil {
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				slog.Warn("Failed to warm a connection", "host", root.Host, "error", err)
+				return
+			}
+			// Drain the body so the connection goes back to the pool
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
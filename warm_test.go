@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyRecorder is an httptest handler recording the most requests it served at once
+type concurrencyRecorder struct {
+	running, peak, total int32
+}
+
+func (c *concurrencyRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	atomic.AddInt32(&c.total, 1)
+	for {
+		p := atomic.LoadInt32(&c.peak)
+		if n <= p || atomic.CompareAndSwapInt32(&c.peak, p, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.Write([]byte(`{"models":[]}`))
+}
+
+func TestHostRequestLimitCoversWarmingAndModelLists(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		run   func(server Server, config *Config)
+	}{
+		{"warm connections", 2, func(server Server, config *Config) {
+			target, _ := url.Parse(server.URL)
+			warmConnections(&http.Client{Transport: transportFor(server, config)}, server, config, target)
+		}},
+		{"available models", 1, func(server Server, config *Config) {
+			done := make(chan struct{})
+			for i := 0; i < 4; i++ {
+				go func() {
+					fetchAvailableModels(server, config)
+					done <- struct{}{}
+				}()
+			}
+			for i := 0; i < 4; i++ {
+				<-done
+			}
+		}},
+		{"loaded models", 1, func(server Server, config *Config) {
+			done := make(chan struct{})
+			for i := 0; i < 4; i++ {
+				go func() {
+					fetchLoadedModels(server, config)
+					done <- struct{}{}
+				}()
+			}
+			for i := 0; i < 4; i++ {
+				<-done
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &concurrencyRecorder{}
+			host := httptest.NewServer(recorder)
+			defer host.Close()
+			config := &Config{MaxRequestsPerHost: tt.limit}
+			server := Server{URL: host.URL + "/api/chat", Model: "llama3", WarmConnections: 5}
+
+			tt.run(server, config)
+			if recorder.total == 0 {
+				t.Fatal("no requests sent")
+			}
+			if int(recorder.peak) > tt.limit {
+				t.Errorf("%d requests at once with max_requests_per_host %d", recorder.peak, tt.limit)
+			}
+		})
+	}
+}
+
+func TestTransportForReusesWarmTransports(t *testing.T) {
+	config := &Config{}
+	server := Server{URL: "http://warm-test:11434/api/chat", Model: "llama3", WarmConnections: 2, Endpoints: []string{"http://warm-test:11435/api/chat"}}
+	endpoint := server
+	endpoint.URL = server.Endpoints[0]
+	changed := server
+	changed.DNSOverrides = map[string]string{"warm-test": "10.0.0.2"}
+	cold := server
+	cold.WarmConnections = 0
+	otherModel := server
+	otherModel.Model = "mistral"
+	slower := server
+	slower.Timeout = Duration(time.Minute)
+
+	first := transportFor(server, config)
+	tests := []struct {
+		name   string
+		server Server
+		same   bool
+	}{
+		{"same settings", server, true},
+		{"other model", otherModel, true},
+		{"cold server", cold, false},
+		{"changed timeout", slower, false},
+		{"changed settings", changed, false},
+	}
+	for _, tt := range tests {
+		if got := transportFor(tt.server, config); (got == first) != tt.same {
+			t.Errorf("%s: reused = %v, want %v", tt.name, got == first, tt.same)
+		}
+	}
+	current := transportFor(changed, config)
+	if transportFor(changed, config) != current {
+		t.Error("replaced transport not reused")
+	}
+	if current.MaxIdleConnsPerHost != server.WarmConnections {
+		t.Errorf("MaxIdleConnsPerHost = %d, want %d", current.MaxIdleConnsPerHost, server.WarmConnections)
+	}
+
+	transportFor(endpoint, config)
+	dropWarmTransports(server)
+	warmTransports.Lock()
+	_, urlKept := warmTransports.transports[server.URL]
+	_, endpointKept := warmTransports.transports[endpoint.URL]
+	warmTransports.Unlock()
+	if urlKept || endpointKept {
+		t.Errorf("after dropWarmTransports: url kept %v, endpoint kept %v", urlKept, endpointKept)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// WebhookConfig is an HTTP endpoint notified of crashes and failed restarts
+type WebhookConfig struct {
+	URL      string            `yaml:"url"`
+	Method   string            `yaml:"method"`   // default POST
+	Headers  map[string]string `yaml:"headers"`  // e.g. Authorization
+	Template string            `yaml:"template"` // text/template of the body, executed with .Kind and .Event; the event as JSON if empty
+
+	tmpl *template.Template // parsed Template, set by validateConfig
+}
+
+// webhookData is what webhook templates are executed with, and the default body
+type webhookData struct {
+	Kind  string      `json:"kind"`  // "crash", "restart_failed", "restart_circuit_open", "quiet_hours_summary" or "test"
+	Event interface{} `json:"event"` // the CrashEvent or RestartEvent
+}
+
+// webhookFuncs are available in webhook templates, json quotes a value for embedding in a JSON payload
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// compileWebhook checks the webhook's method and parses its template
+func compileWebhook(webhook *WebhookConfig) error {
+	if webhook.Method == "" {
+		webhook.Method = http.MethodPost
+	}
+	if webhook.Template == "" {
+		return nil
+	}
+	tmpl, err := template.New(webhook.URL).Funcs(webhookFuncs).Parse(webhook.Template)
+	if err != nil {
+		return err
+	}
+	webhook.tmpl = tmpl
+	return nil
+}
+
+// webhooks are notified of crashes and failed restarts, set by main from Config.Webhooks
+var webhooks []WebhookConfig
+
+// webhookClient delivers webhooks, bounded so an unreachable receiver doesn't pile up goroutines
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyWebhooks delivers an event to every configured webhook concurrently in the background.
+// Failures are logged per webhook and never hold up a check.
+func notifyWebhooks(kind, key string, event interface{}) {
+	for _, webhook := range webhooks {
+		go func(webhook WebhookConfig) {
+			if err := deliverWebhook(webhook, kind, key, event); err != nil {
+				slog.Error("Failed to deliver webhook", "kind", kind, "webhook", webhook.URL, "error", err)
+			}
+		}(webhook)
+	}
+}
+
+// deliverWebhook renders the webhook's body for the event and sends it, with the alert's idempotency key,
+// if it has one, in the Idempotency-Key header so receivers can drop redeliveries
+func deliverWebhook(webhook WebhookConfig, kind, key string, event interface{}) error {
+	var body bytes.Buffer
+	if webhook.tmpl != nil {
+		if err := webhook.tmpl.Execute(&body, webhookData{Kind: kind, Event: event}); err != nil {
+			return err
+		}
+	} else if err := json.NewEncoder(&body).Encode(webhookData{Kind: kind, Event: event}); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(webhook.Method, webhook.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver returned %s", resp.Status)
+	}
+	return nil
+}